@@ -0,0 +1,33 @@
+// Command stitchr stitches a grid of TIFF tiles into a mosaic; see package
+// stitchr/stitch for the library it wraps.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"stitchr/stitch"
+)
+
+func main() {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "batch":
+		err = stitch.RunBatch(os.Args[2:])
+	default:
+		err = stitch.Run(os.Args[1:])
+	}
+	if err != nil {
+		var uerr stitch.UsageError
+		if errors.As(err, &uerr) {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			flag.Usage()
+		} else {
+			slog.Error(err.Error())
+		}
+		os.Exit(1)
+	}
+}
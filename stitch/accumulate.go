@@ -0,0 +1,70 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"log/slog"
+	"math"
+)
+
+// floatCanvas accumulates summed tiles in float32, for --accumulate float, so
+// overlaps adding up past 65535 keep their relative values until the final rescale
+type floatCanvas struct {
+	w, h int
+	sum  []float32
+}
+
+func newFloatCanvas(w, h int, s *scratch) (*floatCanvas, error) {
+	sum, err := s.float32s(w * h)
+	if err != nil {
+		return nil, err
+	}
+	return &floatCanvas{w: w, h: h, sum: sum}, nil
+}
+
+// add sums src at (x0, y0), scaled by alpha(x, y) in tile coordinates when alpha
+// is not nil
+func (c *floatCanvas) add(src image.Image, x0, y0 int, alpha func(x, y int) float64) {
+	b := src.Bounds()
+	for y := max(y0, 0); y < min(y0+b.Dy(), c.h); y++ {
+		for x := max(x0, 0); x < min(x0+b.Dx(), c.w); x++ {
+			v := float64(color.Gray16Model.Convert(src.At(b.Min.X+x-x0, b.Min.Y+y-y0)).(color.Gray16).Y)
+			if alpha != nil {
+				v *= alpha(x-x0, y-y0)
+			}
+			c.sum[y*c.w+x] += float32(v)
+		}
+	}
+}
+
+// writeTo rescales the sums into out's 16-bit range. linear divides every sum by
+// the same factor, only when the peak exceeds 65535, so ratios between pixels are
+// kept exactly; log maps log(1+v) linearly onto the range, the peak reading 65535.
+// The factor is logged so the original sums can be recovered.
+func (c *floatCanvas) writeTo(out *image.Gray16, scale string) {
+	var peak float32
+	for _, v := range c.sum {
+		peak = max(peak, v)
+	}
+	k := 1.0
+	if scale == "log" {
+		if peak > 0 {
+			k = 65535 / math.Log1p(float64(peak))
+		}
+		slog.Info("rescaled the float accumulation", "scale", scale, "peak", peak, "factor", k)
+	} else if peak > 65535 {
+		k = 65535 / float64(peak)
+		slog.Info("rescaled the float accumulation", "scale", scale, "peak", peak, "factor", k)
+	} else {
+		slog.Debug("float accumulation fits 16 bits; not rescaled", "peak", peak)
+	}
+	for y := 0; y < c.h; y++ {
+		for x := 0; x < c.w; x++ {
+			v := float64(c.sum[y*c.w+x])
+			if scale == "log" {
+				v = math.Log1p(v)
+			}
+			out.SetGray16(out.Rect.Min.X+x, out.Rect.Min.Y+y, color.Gray16{clamp16(math.Round(v * k))})
+		}
+	}
+}
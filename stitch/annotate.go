@@ -0,0 +1,128 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// scaleBar describes a labelled scale bar drawn onto the output
+type scaleBar struct {
+	lengthUM float64 // bar length in micrometres
+	label    string
+	color    color.Color
+	position string // top-left, top-right, bottom-left or bottom-right
+}
+
+// parseLength parses a physical length such as "100um", "0.5mm" or "250nm" into micrometres
+func parseLength(s string) (float64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"nm", 1e-3}, {"um", 1}, {"µm", 1}, {"mm", 1e3}}
+	for _, u := range units {
+		if num, ok := strings.CutSuffix(strings.TrimSpace(s), u.suffix); ok {
+			v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+			if err != nil || v <= 0 {
+				break
+			}
+			return v * u.scale, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid length %q (use e.g. 100um, 0.5mm or 250nm)", s)
+}
+
+// parseColor parses a colour name (white, black, red, green, blue, yellow) or #rrggbb
+func parseColor(s string) (color.Color, error) {
+	switch strings.ToLower(s) {
+	case "white":
+		return color.White, nil
+	case "black":
+		return color.Black, nil
+	case "red":
+		return color.RGBA{255, 0, 0, 255}, nil
+	case "green":
+		return color.RGBA{0, 255, 0, 255}, nil
+	case "blue":
+		return color.RGBA{0, 0, 255, 255}, nil
+	case "yellow":
+		return color.RGBA{255, 255, 0, 255}, nil
+	}
+	if hex, ok := strings.CutPrefix(s, "#"); ok && len(hex) == 6 {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid colour %q (use a name such as white or #rrggbb)", s)
+}
+
+// asDrawable returns img if it can be drawn on, otherwise a 16-bit RGBA copy
+func asDrawable(img image.Image) draw.Image {
+	if d, ok := img.(draw.Image); ok {
+		return d
+	}
+	b := img.Bounds()
+	d := image.NewRGBA64(b)
+	draw.Draw(d, b, img, b.Min, draw.Src)
+	return d
+}
+
+// drawScaleBar burns bar into img, whose pixels are pixelSizeUM micrometres wide.
+// The bar thickness, margin and label size scale with the image.
+func drawScaleBar(img image.Image, bar scaleBar, pixelSizeUM float64) (image.Image, error) {
+	dst := asDrawable(img)
+	b := dst.Bounds()
+	length := int(math.Round(bar.lengthUM / pixelSizeUM))
+	margin := max(4, min(b.Dx(), b.Dy())/40)
+	if length < 1 || length > b.Dx()-2*margin {
+		return nil, fmt.Errorf("scale bar of %s is %d pixels, which does not fit the %d pixel wide output", bar.label, length, b.Dx())
+	}
+	thickness := max(2, b.Dy()/100)
+
+	// render the label at the font's native size, then enlarge it to suit the bar
+	face := basicfont.Face7x13
+	textW := font.MeasureString(face, bar.label).Ceil()
+	textH := face.Metrics().Height.Ceil()
+	mask := image.NewAlpha(image.Rect(0, 0, textW, textH))
+	d := font.Drawer{Dst: mask, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Metrics().Ascent.Ceil())}
+	d.DrawString(bar.label)
+	scale := max(1, thickness*2/textH+1)
+
+	blockW := max(length, textW*scale)
+	blockH := textH*scale + thickness + thickness/2
+	x0, y0 := b.Min.X+margin, b.Min.Y+margin
+	if strings.HasSuffix(bar.position, "right") {
+		x0 = b.Max.X - margin - blockW
+	}
+	if strings.HasPrefix(bar.position, "bottom") {
+		y0 = b.Max.Y - margin - blockH
+	}
+	if y0 < b.Min.Y {
+		return nil, fmt.Errorf("scale bar label does not fit the %d pixel high output", b.Dy())
+	}
+
+	src := image.NewUniform(bar.color)
+	// label centred over the bar
+	tx := x0 + (blockW-textW*scale)/2
+	for y := 0; y < textH; y++ {
+		for x := 0; x < textW; x++ {
+			if mask.AlphaAt(x, y).A < 128 {
+				continue
+			}
+			r := image.Rect(tx+x*scale, y0+y*scale, tx+(x+1)*scale, y0+(y+1)*scale)
+			draw.Draw(dst, r, src, image.Point{}, draw.Src)
+		}
+	}
+	bx := x0 + (blockW-length)/2
+	by := y0 + blockH - thickness
+	draw.Draw(dst, image.Rect(bx, by, bx+length, by+thickness), src, image.Point{}, draw.Src)
+	return dst, nil
+}
@@ -0,0 +1,80 @@
+// Package stitch assembles grids of microscope tiles into mosaics. Mosaic and
+// Encode form the library API, RegisterBlend and RegisterEncoder extend it, and
+// Run and RunBatch implement the stitchr command line.
+package stitch
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Errors returned by the stitching functions, wrapped with detail; test for them
+// with errors.Is
+var (
+	ErrGridMismatch    = errors.New("grid mismatch")     // the tile count or index map does not fit rows x cols
+	ErrNotEnoughImages = errors.New("not enough images") // fewer tiles were found than the grid needs
+	ErrNoImages        = errors.New("no images")         // a directory or list held no tiles at all
+)
+
+// TileError reports a tile that could not be read or decoded; use errors.As to
+// get the path
+type TileError struct {
+	Path string
+	Err  error
+}
+
+func (e *TileError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+func (e *TileError) Unwrap() error { return e.Err }
+
+// MosaicOptions configures Mosaic. The zero value places tiles edge to edge in a
+// vertical snake and sums any overlap.
+type MosaicOptions struct {
+	OverlapX, OverlapY int       // overlap between neighbouring tiles, in pixels
+	Snake              string    // vertical (default) or horizontal
+	Blend              string    // sum (default), average, feather, none or a RegisterBlend name
+	FeatherWidth       *int      // width of the feather band, 0 for a hard seam; nil uses the whole overlap
+	FeatherAxis        string    // x or y to feather along one axis only; "" feathers along both
+	Weights            []float64 // per-tile weights for averaging; nil weighs tiles equally
+}
+
+// Mosaic stitches equally sized tiles, given in acquisition order, into a rows x cols
+// grid and returns the composited image. Nothing is written to disk; pass the result
+// to Encode or process it further. A tile count other than rows*cols is an error
+// wrapping ErrGridMismatch.
+func Mosaic(tiles []image.Image, rows, cols int, opts MosaicOptions) (*image.Gray16, error) {
+	feather := -1
+	if opts.FeatherWidth != nil {
+		if *opts.FeatherWidth < 0 {
+			return nil, fmt.Errorf("invalid feather width: %d (must be >= 0)", *opts.FeatherWidth)
+		}
+		feather = *opts.FeatherWidth
+	}
+	return mosaic(tiles, rows, cols, mosaicOptions{
+		overlapX:     opts.OverlapX,
+		overlapY:     opts.OverlapY,
+		overlapTurn:  -1,
+		snake:        opts.Snake,
+		blend:        opts.Blend,
+		featherWidth: feather,
+		featherAxis:  opts.FeatherAxis,
+		weights:      opts.Weights,
+	})
+}
+
+// Encode writes img to w in a registered format such as tiff, png or jpeg;
+// an empty format selects TIFF
+func Encode(w io.Writer, img image.Image, format string, opts EncodeOptions) error {
+	if opts.DPI != 0 {
+		if err := checkDPI(opts.DPI); err != nil {
+			return err
+		}
+	}
+	_, enc, err := lookupEncoder(format, "")
+	if err != nil {
+		return err
+	}
+	return enc.Encode(w, img, opts)
+}
@@ -0,0 +1,225 @@
+package stitch
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+)
+
+// autoflatMaxSamples caps the overlap pixel pairs estimateAutoflat fits; larger
+// overlaps are sampled on a coarser lattice
+const autoflatMaxSamples = 1 << 20
+
+// autoflatTerms returns the exponents (i, j) of the monomials u^i v^j with
+// 1 <= i+j <= deg making up the log illumination profile. The constant term is
+// left out: overlaps only compare pixels of equally lit tiles, so it is fixed by
+// normalising the mean gain to 1 instead.
+func autoflatTerms(deg int) [][2]int {
+	var terms [][2]int
+	for d := 1; d <= deg; d++ {
+		for i := d; i >= 0; i-- {
+			terms = append(terms, [2]int{i, d - i})
+		}
+	}
+	return terms
+}
+
+// autoflatBasis fills phi with the monomials of terms at tile pixel (x, y) of a
+// w x h tile, on coordinates scaled to [-1, 1] so the fit stays well conditioned
+func autoflatBasis(phi []float64, terms [][2]int, x, y, w, h int) {
+	u := 2*float64(x)/float64(max(w-1, 1)) - 1
+	v := 2*float64(y)/float64(max(h-1, 1)) - 1
+	for k, t := range terms {
+		phi[k] = math.Pow(u, float64(t[0])) * math.Pow(v, float64(t[1]))
+	}
+}
+
+// estimateAutoflat estimates the illumination profile shared by all tiles of a grid
+// from their overlaps, in the spirit of BaSiC's retrospective shading correction:
+// a point seen by two neighbours at different tile positions differs only by the
+// profile there. The log profile is a polynomial of degree deg in tile
+// coordinates, fitted by least squares to the log ratios of every overlapping
+// pixel pair that is neither dark nor saturated. It returns the per-pixel gain that
+// flattens the profile, row-major over the tile and with a mean of 1.
+func estimateAutoflat(tiles []*image.Gray16, cells []image.Point, overlapX, overlapY, deg int) ([]float64, error) {
+	w, h := tiles[0].Bounds().Dx(), tiles[0].Bounds().Dy()
+	terms := autoflatTerms(deg)
+	n := len(terms)
+	ata := make([][]float64, n)
+	for i := range ata {
+		ata[i] = make([]float64, n)
+	}
+	atb := make([]float64, n)
+	phiA, phiB, row := make([]float64, n), make([]float64, n), make([]float64, n)
+
+	// pairs of tile coordinates that see the same point, per axis
+	type seam struct {
+		pairs   [][2]int
+		overlap int
+		at      func(k, t int) (xa, ya, xb, yb int) // k across the overlap, t along it
+		length  int
+	}
+	seams := []seam{
+		{neighbourPairs(cells, true), overlapX, func(k, t int) (int, int, int, int) { return w - overlapX + k, t, k, t }, h},
+		{neighbourPairs(cells, false), overlapY, func(k, t int) (int, int, int, int) { return t, h - overlapY + k, t, k }, w},
+	}
+	total := 0
+	for _, s := range seams {
+		if s.overlap > 0 {
+			total += len(s.pairs) * s.overlap * s.length
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("the grid has no overlaps to estimate the illumination from")
+	}
+	step := max(1, int(math.Ceil(math.Sqrt(float64(total)/autoflatMaxSamples))))
+
+	var samples int
+	var sumSq float64
+	for _, s := range seams {
+		if s.overlap <= 0 {
+			continue
+		}
+		for _, p := range s.pairs {
+			a, b := tiles[p[0]], tiles[p[1]]
+			for k := 0; k < s.overlap; k += step {
+				for t := 0; t < s.length; t += step {
+					xa, ya, xb, yb := s.at(k, t)
+					va := a.Gray16At(a.Rect.Min.X+xa, a.Rect.Min.Y+ya).Y
+					vb := b.Gray16At(b.Rect.Min.X+xb, b.Rect.Min.Y+yb).Y
+					// dark pixels are dominated by noise and offset, saturated ones by clipping
+					if va < 16 || vb < 16 || va == 65535 || vb == 65535 {
+						continue
+					}
+					autoflatBasis(phiA, terms, xa, ya, w, h)
+					autoflatBasis(phiB, terms, xb, yb, w, h)
+					for i := range row {
+						row[i] = phiA[i] - phiB[i]
+					}
+					d := math.Log(float64(va)) - math.Log(float64(vb))
+					for i := range row {
+						for j := range row {
+							ata[i][j] += row[i] * row[j]
+						}
+						atb[i] += row[i] * d
+					}
+					sumSq += d * d
+					samples++
+				}
+			}
+		}
+	}
+	if samples < 4*n {
+		return nil, fmt.Errorf("only %d overlap pixels are bright enough to estimate the illumination from", samples)
+	}
+	// a light ridge keeps the terms the overlaps cannot see, such as y terms
+	// of a single-row grid, at zero
+	var trace float64
+	for i := range ata {
+		trace += ata[i][i]
+	}
+	for i := range ata {
+		ata[i][i] += 1e-6*trace/float64(n) + 1e-12
+	}
+	rhs := append([]float64(nil), atb...)
+	coef, err := solveLinear(ata, rhs)
+	if err != nil {
+		return nil, err
+	}
+
+	gain := make([]float64, w*h)
+	var sum float64
+	phi := make([]float64, n)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			autoflatBasis(phi, terms, x, y, w, h)
+			var l float64
+			for k, c := range coef {
+				l += c * phi[k]
+			}
+			gain[y*w+x] = math.Exp(-l)
+			sum += gain[y*w+x]
+		}
+	}
+	mean := sum / float64(len(gain))
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := range gain {
+		gain[i] /= mean
+		lo, hi = min(lo, gain[i]), max(hi, gain[i])
+	}
+	// the residual of the fit is the mismatch the profile does not explain
+	var explained float64
+	for i := range coef {
+		explained += coef[i] * atb[i]
+	}
+	slog.Info("estimated illumination from the overlaps", "samples", samples, "degree", deg,
+		"gain_min", lo, "gain_max", hi, "log_ratio_rms", math.Sqrt(sumSq/float64(samples)),
+		"residual_rms", math.Sqrt(max(sumSq-explained, 0)/float64(samples)))
+	return gain, nil
+}
+
+// flattenFromOverlaps estimates the illumination profile of the grid tiles imgs,
+// placed in order, with estimateAutoflat and replaces each tile by its flattened
+// copy. Colour tiles are fitted on their luminance, with the same gain applied to
+// every channel.
+func flattenFromOverlaps(imgs []image.Image, order gridOrder, overlapX, overlapY, deg int) error {
+	cells, err := order.cellList()
+	if err != nil {
+		return err
+	}
+	if len(imgs) != len(cells) {
+		return fmt.Errorf("%w: number of images (%d) does not match grid size (%d)", ErrGridMismatch, len(imgs), len(cells))
+	}
+	tiles := make([]*image.Gray16, len(imgs))
+	for i, img := range imgs {
+		if img.Bounds().Size() != imgs[0].Bounds().Size() {
+			return fmt.Errorf("--autoflat-overlaps needs tiles of one size, but tile %d is %v and tile 0 %v", i, img.Bounds().Size(), imgs[0].Bounds().Size())
+		}
+		tiles[i] = toGray16(img)
+	}
+	gain, err := estimateAutoflat(tiles, cells, overlapX, overlapY, deg)
+	if err != nil {
+		return fmt.Errorf("--autoflat-overlaps: %w", err)
+	}
+	for i, img := range imgs {
+		imgs[i] = applyGain(img, gain)
+	}
+	return nil
+}
+
+// solveLinear solves a x = b for square a by Gaussian elimination with partial
+// pivoting. a and b are overwritten.
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if a[pivot][col] == 0 {
+			return nil, errors.New("the illumination fit is singular")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < n; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		s := b[r]
+		for c := r + 1; c < n; c++ {
+			s -= a[r][c] * x[c]
+		}
+		x[r] = s / a[r][r]
+	}
+	return x, nil
+}
@@ -0,0 +1,168 @@
+package stitch
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// batchJob is one stitch described in a batch manifest: the flags of a normal
+// run, keyed by flag name without dashes
+type batchJob struct {
+	name  string
+	flags map[string]any
+}
+
+// loadBatch reads a JSON manifest holding a list of jobs such as
+// [{"name": "A01", "dir": "plate/A01", "rows": 3, "cols": 4, "out": "A01.tiff"}].
+// The optional "name" labels the job in logs and defaults to its position.
+func loadBatch(filename string) ([]batchJob, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	jobs := make([]batchJob, len(entries))
+	for i, e := range entries {
+		name := fmt.Sprintf("job %d", i+1)
+		if v, ok := e["name"]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: job %d: name must be a string", filename, i+1)
+			}
+			name = s
+			delete(e, "name")
+		}
+		jobs[i] = batchJob{name: name, flags: e}
+	}
+	return jobs, nil
+}
+
+// args turns the job's flags into a command line, in sorted flag order
+func (j batchJob) args() ([]string, error) {
+	keys := make([]string, 0, len(j.flags))
+	for k := range j.flags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		var v string
+		switch val := j.flags[k].(type) {
+		case string:
+			v = val
+		case float64:
+			v = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			v = strconv.FormatBool(val)
+		default:
+			return nil, fmt.Errorf("flag %s: value must be a string, number or boolean", k)
+		}
+		args = append(args, "--"+k+"="+v)
+	}
+	return args, nil
+}
+
+// RunBatch implements "stitchr batch [options] manifest.json". Every job runs
+// even when others fail; the batch fails if any job did.
+func RunBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	parallel := fs.Int("parallel-jobs", 1, "Number of jobs to run at the same time")
+	httpTimeout := fs.Duration("http-timeout", 60*time.Second, "Timeout for fetching each http(s) image, for jobs that do not set their own")
+	logLevel := fs.String("log-level", "info", "Log level: debug, info, warn or error")
+	logJSON := fs.Bool("log-json", false, "Write logs as JSON lines")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s batch [options] manifest.json:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("batch needs exactly one manifest file")
+	}
+	if *parallel < 1 {
+		fs.Usage()
+		return errors.New("--parallel-jobs must be >= 1")
+	}
+	if err := setupLogging(*logLevel, *logJSON, ""); err != nil {
+		return err
+	}
+
+	jobs, err := loadBatch(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	sem := make(chan struct{}, *parallel)
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			start := time.Now()
+			slog.Info("job started", "job", job.name)
+			err := runJob(job, *httpTimeout)
+			if err != nil {
+				slog.Error("job failed", "job", job.name, "err", err)
+				mu.Lock()
+				failed = append(failed, job.name)
+				mu.Unlock()
+				return
+			}
+			slog.Info("job finished", "job", job.name, "elapsed", time.Since(start).Round(time.Millisecond))
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d of %d jobs failed: %v", len(failed), len(jobs), failed)
+	}
+	slog.Info("batch finished", "jobs", len(jobs))
+	return nil
+}
+
+// check rejects flags that cannot work while other jobs run alongside: writing
+// the mosaic to stdout, which every job shares, and --watch, which never returns
+func (j batchJob) check() error {
+	if fmt.Sprint(j.flags["out"]) == "-" {
+		return errors.New("a batch job cannot write to stdout (--out -)")
+	}
+	if v, ok := j.flags["watch"]; ok && fmt.Sprint(v) != "false" {
+		return errors.New("a batch job cannot --watch, which never returns")
+	}
+	return nil
+}
+
+// runJob runs one batch job as if its flags had been given on the command line.
+// Logging flags in a job are accepted but the batch's settings apply; a job
+// without --http-timeout of its own fetches with the batch's httpTimeout.
+func runJob(job batchJob, httpTimeout time.Duration) error {
+	if err := job.check(); err != nil {
+		return err
+	}
+	args, err := job.args()
+	if err != nil {
+		return err
+	}
+	if _, ok := job.flags["http-timeout"]; !ok {
+		args = append(args, "--http-timeout="+httpTimeout.String())
+	}
+	return run(args, false)
+}
@@ -0,0 +1,66 @@
+package stitch
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunBatchJobIsolation runs jobs side by side and checks that each fetches
+// with its own --http-timeout, falling back to the batch's, and that jobs writing
+// to stdout or watching fail on their own without stopping the others
+func TestRunBatchJobIsolation(t *testing.T) {
+	var tile bytes.Buffer
+	if err := encoders["tiff"].Encode(&tile, syntheticScene(32, 24), EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write(tile.Bytes())
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	list := filepath.Join(dir, "tiles.txt")
+	if err := os.WriteFile(list, []byte(srv.URL+"/tile.tif\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	job := func(name string, extra map[string]any) map[string]any {
+		j := map[string]any{"name": name, "list": list, "rows": 1, "cols": 1, "out": filepath.Join(dir, name+".tif")}
+		for k, v := range extra {
+			j[k] = v
+		}
+		return j
+	}
+	jobs := []map[string]any{
+		job("short", map[string]any{"http-timeout": "20ms"}),
+		job("default", nil),
+		job("stdout", map[string]any{"out": "-"}),
+		job("watch", map[string]any{"watch": true}),
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "batch.json")
+	if err := os.WriteFile(manifest, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch sets up its own logging
+	defer slog.SetDefault(slog.Default())
+	err = RunBatch([]string{"--parallel-jobs", "4", "--http-timeout", "5s", "--log-level", "error", manifest})
+	if err == nil || !strings.Contains(err.Error(), "3 of 4 jobs failed: [short stdout watch]") {
+		t.Errorf("got error %v, want the short, stdout and watch jobs failed", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "default.tif")); err != nil {
+		t.Errorf("job with the batch's timeout: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// BlendFunc composites one tile src onto the mosaic dst, with src's top-left
+// corner at (x0, y0) relative to dst's. overlapX and overlapY are the grid
+// overlaps in pixels (0 for positioned tiles). Tiles are passed in placement
+// order, and pixels falling outside dst must be dropped.
+//
+// dst is an *image.Gray16, not an *image.RGBA: every mosaic is built at 16 bits
+// per sample, which an RGBA destination would cut to 8. Colour mosaics call the
+// BlendFunc once per plane, each a Gray16: red, green, blue and, for translucent
+// tiles, alpha. A BlendFunc never sees more than one channel at a time.
+type BlendFunc func(dst *image.Gray16, src image.Image, x0, y0, overlapX, overlapY int)
+
+// blendMode is one --blend name. A mode either composites each tile straight onto
+// the mosaic with fn, or, when fn is nil, averages: every tile is added to a
+// weighted canvas, with per-pixel weights from alpha (even when alpha is nil), and
+// the canvas is divided by its total weight once all tiles are placed. A BlendFunc
+// sees only the clamped 16-bit mosaic so far, not the weights behind it, so the
+// averaging modes cannot be BlendFuncs. Per-tile --weights and --center-weight
+// scale the averaging weights whatever the mode, and --sum-taper is an option of
+// the sum blend rather than a mode of its own.
+type blendMode struct {
+	fn    BlendFunc
+	alpha func(b image.Rectangle, opts mosaicOptions) func(x, y int) float64
+}
+
+// blendModes holds every --blend name, built in or added with RegisterBlend
+var blendModes = make(map[string]blendMode)
+
+// RegisterBlend makes fn available as --blend name (and MosaicOptions.Blend),
+// replacing any BlendFunc registered under name before. It panics if fn is nil or
+// if name is average or feather, whose averaging cannot be a BlendFunc.
+func RegisterBlend(name string, fn BlendFunc) {
+	if fn == nil {
+		panic("stitch: RegisterBlend of a nil BlendFunc for " + name)
+	}
+	if mode, ok := blendModes[name]; ok && mode.fn == nil {
+		panic("stitch: RegisterBlend of " + name + ", an averaging blend that is not a BlendFunc")
+	}
+	blendModes[name] = blendMode{fn: fn}
+}
+
+// blendNames returns every blend name in sorted order
+func blendNames() []string {
+	var names []string
+	for name := range blendModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// featherAlpha returns the feather blend's weights for a tile with bounds b: linear
+// ramps across the grid overlaps, along the axes opts.featherAxis selects
+func featherAlpha(b image.Rectangle, opts mosaicOptions) func(x, y int) float64 {
+	ax := featherRamp(b.Dx(), opts.overlapX, featherWidth(opts.overlapX, opts.featherWidth))
+	ay := featherRamp(b.Dy(), opts.overlapY, featherWidth(opts.overlapY, opts.featherWidth))
+	switch opts.featherAxis {
+	case "x":
+		return func(x, y int) float64 { return ax[x] }
+	case "y":
+		return func(x, y int) float64 { return ay[y] }
+	}
+	// the product of complementary ramps sums to 1 over the tiles meeting at a
+	// corner, as it does along a single seam
+	return func(x, y int) float64 { return ax[x] * ay[y] }
+}
+
+// overwriteImage draws src over dst at (x0, y0), replacing whatever earlier
+// tiles left in the overlap
+func overwriteImage(dst *image.Gray16, src image.Image, x0, y0 int) {
+	b := src.Bounds()
+	r := image.Rect(x0, y0, x0+b.Dx(), y0+b.Dy()).Add(dst.Rect.Min)
+	draw.Draw(dst, r, src, b.Min, draw.Src)
+}
+
+// taperRamp returns per-pixel alphas along one tile axis of length n that rise
+// from the tile's first pixel (with head) and towards its last (with tail) over
+// width pixels. Two tiles overlapping by width pixels get complementary ramps.
+func taperRamp(n, width int, head, tail bool) []float64 {
+	alpha := make([]float64, n)
+	for i := range alpha {
+		alpha[i] = 1
+		if head && i < width {
+			alpha[i] = float64(i+1) / float64(width+1)
+		}
+		if tail && n-1-i < width {
+			alpha[i] = min(alpha[i], float64(n-i)/float64(width+1))
+		}
+	}
+	return alpha
+}
+
+// sumImagesAlpha adds src scaled by alpha(x, y), in tile coordinates, onto dst at
+// (x0, y0), clamping at 65535
+func sumImagesAlpha(dst *image.Gray16, src image.Image, x0, y0 int, alpha func(x, y int) float64) {
+	b := src.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dstX, dstY := dst.Rect.Min.X+x0+x, dst.Rect.Min.Y+y0+y
+			if !(image.Point{dstX, dstY}.In(dst.Rect)) {
+				continue
+			}
+			v := color.Gray16Model.Convert(src.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16).Y
+			sum := float64(dst.Gray16At(dstX, dstY).Y) + alpha(x, y)*float64(v)
+			dst.SetGray16(dstX, dstY, color.Gray16{uint16(min(math.Round(sum), 65535))})
+		}
+	}
+}
+
+func init() {
+	blendModes["average"] = blendMode{}
+	blendModes["feather"] = blendMode{alpha: featherAlpha}
+	RegisterBlend("sum", func(dst *image.Gray16, src image.Image, x0, y0, _, _ int) {
+		sumImages(dst, src, x0, y0)
+	})
+	RegisterBlend("none", func(dst *image.Gray16, src image.Image, x0, y0, _, _ int) {
+		overwriteImage(dst, src, x0, y0)
+	})
+}
@@ -0,0 +1,128 @@
+package stitch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint caches the tiles loadTiles has decoded and corrected in a directory
+// that persists across runs, so that re-running with other blend or output
+// settings skips the per-tile work. Each tile is stored under a key hashing its
+// path, size and modification time, those of its flat-field reference, and every
+// setting that changes the loaded tile, so any change to them misses the cache.
+type checkpoint struct {
+	dir      string
+	settings string // the corrections common to all tiles, e.g. the resampling filter
+	hits     int
+	misses   int
+}
+
+// fileStamp identifies the current contents of a local file by its absolute path,
+// size and modification time. ok is false for URLs and files that cannot be read.
+func fileStamp(path string) (string, bool) {
+	if isURL(path) {
+		return "", false
+	}
+	file := path
+	if page, ok := lookupStackPage(path); ok {
+		// a --stack page changes with its file, and is told apart by its index
+		file = page.file
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s|%d|%d", abs, info.Size(), info.ModTime().UnixNano()), true
+}
+
+// key returns the cache key of tile path loaded with opts as tile i of n. ok is
+// false when the tile or its flat-field reference is not a local file, which is
+// never cached.
+func (c *checkpoint) key(path string, i, n int, opts loadOptions) (string, bool) {
+	stamp, ok := fileStamp(path)
+	if !ok {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\ndownsample=%d\n", stamp, c.settings, opts.downsample)
+	if f, ok := opts.exposure[path]; ok {
+		fmt.Fprintf(h, "exposure=%g\n", f)
+	}
+	if opts.flat != nil {
+		ref, err := opts.flat.reference(i, n, path)
+		if err != nil {
+			return "", false
+		}
+		refStamp, ok := fileStamp(ref)
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(h, "flat=%s\n", refStamp)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// entryDepths are the bit depths an entry's name can record
+var entryDepths = []int{16, 8}
+
+// entryPath returns the file caching the tile of key that was decoded at depth
+// bits. The depth is the tile's own, which the corrected tile may no longer have:
+// --input-gamma promotes 8-bit tiles to 16 bits.
+func (c *checkpoint) entryPath(key string, depth int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%d.tif", key, depth))
+}
+
+// load returns the tile cached under key and the bit depth it was decoded at, if
+// any. Unreadable entries are misses, and so are entries within a pixel of the
+// downsampled size target but not at it: they were resized to match another first
+// tile and are resized again. target is zero until the first downsampled tile
+// sets it.
+func (c *checkpoint) load(key string, target image.Point) (image.Image, int, bool) {
+	for _, depth := range entryDepths {
+		path := c.entryPath(key, depth)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		img, err := loadTIFF(path, nil) // entries are local files
+		if err != nil {
+			slog.Warn("ignoring unreadable checkpoint entry", "path", path, "err", err)
+			break
+		}
+		if sz := img.Bounds().Size(); target != (image.Point{}) && sz != target && nearSize(sz, target) {
+			slog.Debug("ignoring checkpoint entry of another downsampled size", "path", path, "size", sz, "target", target)
+			break
+		}
+		c.hits++
+		return img, depth, true
+	}
+	c.misses++
+	return nil, 0, false
+}
+
+// store caches img, decoded at depth bits, under key, through a temporary file so
+// an interrupted run never leaves a truncated entry. Failures only cost the next
+// run a cache miss, so they are logged rather than returned.
+func (c *checkpoint) store(key string, img image.Image, depth int) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		slog.Warn("cannot write checkpoint", "dir", c.dir, "err", err)
+		return
+	}
+	if err := encodeFile(c.entryPath(key, depth), encoders["tiff"], img, EncodeOptions{}); err != nil {
+		slog.Warn("cannot write checkpoint", "err", err)
+	}
+}
+
+// summarize logs how many tiles were reused and decoded since the last summary
+func (c *checkpoint) summarize() {
+	slog.Info("checkpoint", "dir", c.dir, "reused", c.hits, "decoded", c.misses)
+	c.hits, c.misses = 0, 0
+}
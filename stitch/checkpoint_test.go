@@ -0,0 +1,66 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCheckpointDepth checks that a checkpoint entry keeps the depth its tile was
+// decoded at, so that a rerun from the cache still reports mixed depths although
+// --input-gamma stored both tiles at 16 bits
+func TestCheckpointDepth(t *testing.T) {
+	dir, cache := t.TempDir(), t.TempDir()
+	gray8 := image.NewGray(image.Rect(0, 0, 8, 6))
+	gray16 := image.NewGray16(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			gray8.SetGray(x, y, color.Gray{100})
+			gray16.SetGray16(x, y, color.Gray16{100 * 0x101})
+		}
+	}
+	paths := []string{filepath.Join(dir, "tile-1.tif"), filepath.Join(dir, "tile-2.tif")}
+	for i, img := range []image.Image{gray16, gray8} {
+		if err := encodeFile(paths[i], encoders["tiff"], img, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := loadOptions{gamma: newGammaCurve(2.2), checkpoint: &checkpoint{dir: cache}}
+	if _, err := loadTiles(paths, opts); err == nil || !strings.Contains(err.Error(), "tiles mix bit depths") {
+		t.Fatalf("got error %v, want the mixed depths reported", err)
+	}
+	entries, err := os.ReadDir(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d checkpoint entries, want 2", len(entries))
+	}
+	// mark the cached tiles, both 16-bit after the gamma curve, so reuse shows
+	marked := image.NewGray16(gray16.Rect)
+	for i := range marked.Pix {
+		marked.Pix[i] = 7
+	}
+	for _, e := range entries {
+		if err := encodeFile(filepath.Join(cache, e.Name()), encoders["tiff"], marked, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := loadTiles(paths, opts); err == nil || !strings.Contains(err.Error(), "tiles mix bit depths") {
+		t.Errorf("from the checkpoint: got error %v, want the mixed depths reported", err)
+	}
+	opts.promoteDepth = true
+	imgs, err := loadTiles(paths, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, img := range imgs {
+		if v := toGray16(img).Gray16At(0, 0).Y; v != 7*0x101 {
+			t.Errorf("tile %d: pixel is %d, want the cached %d", i, v, 7*0x101)
+		}
+	}
+}
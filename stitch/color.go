@@ -0,0 +1,196 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// D65 reference white
+const whiteX, whiteY, whiteZ = 0.95047, 1.0, 1.08883
+
+// srgbToLinear removes the sRGB transfer curve from v in [0,1]
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB applies the sRGB transfer curve to v in [0,1]
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// rgbToLab converts a 16-bit sRGB colour to CIELAB (D65)
+func rgbToLab(r, g, b uint16) (L, A, B float64) {
+	rl := srgbToLinear(float64(r) / 65535)
+	gl := srgbToLinear(float64(g) / 65535)
+	bl := srgbToLinear(float64(b) / 65535)
+
+	x := (0.4124564*rl + 0.3575761*gl + 0.1804375*bl) / whiteX
+	y := (0.2126729*rl + 0.7151522*gl + 0.0721750*bl) / whiteY
+	z := (0.0193339*rl + 0.1191920*gl + 0.9503041*bl) / whiteZ
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// labToRGB converts a CIELAB (D65) colour back to 16-bit sRGB, clipping out-of-gamut values
+func labToRGB(L, A, B float64) (r, g, b uint16) {
+	fy := (L + 16) / 116
+	fx := fy + A/500
+	fz := fy - B/200
+	finv := func(t float64) float64 {
+		if t3 := t * t * t; t3 > 216.0/24389 {
+			return t3
+		}
+		return (116*t - 16) * 27 / 24389
+	}
+	x := finv(fx) * whiteX
+	y := finv(fy) * whiteY
+	z := finv(fz) * whiteZ
+
+	rl := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	gl := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	bl := 0.0556434*x - 0.2040259*y + 1.0572252*z
+
+	to16 := func(v float64) uint16 {
+		return clamp16(linearToSRGB(math.Max(0, math.Min(1, v)))*65535 + 0.5)
+	}
+	return to16(rl), to16(gl), to16(bl)
+}
+
+// Lab components are stored in 16-bit planes: L in [0,100], a and b in [-128,128)
+func encodeL(L float64) uint16  { return clamp16(L/100*65535 + 0.5) }
+func encodeAB(v float64) uint16 { return clamp16((v+128)/256*65535 + 0.5) }
+func decodeL(v uint16) float64  { return float64(v) / 65535 * 100 }
+func decodeAB(v uint16) float64 { return float64(v)/65535*256 - 128 }
+
+// splitPlanes splits colour tiles into three 16-bit planes, either R, G and B or
+// L, a and b when space is "lab", so each plane can be stitched on its own. R, G
+// and B keep Go's alpha premultiplication, so blending weighs each tile's colour by
+// its alpha; Lab is computed from the unpremultiplied colour. When any tile is not
+// opaque its alpha is returned as a fourth plane, to be stitched the same way.
+func splitPlanes(imgs []image.Image, space string) ([3][]image.Image, []image.Image, error) {
+	var planes [3][]image.Image
+	if space != "rgb" && space != "lab" {
+		return planes, nil, fmt.Errorf("invalid blend space: %s (use rgb or lab)", space)
+	}
+	opaque := true
+	for _, img := range imgs {
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			opaque = false
+		}
+	}
+	var alpha []image.Image
+	for _, img := range imgs {
+		b := img.Bounds()
+		var p [3]*image.Gray16
+		for c := range p {
+			p[c] = image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+		}
+		var a *image.Gray16
+		if !opaque {
+			a = image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+			alpha = append(alpha, a)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.RGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)
+				v := [3]uint16{c.R, c.G, c.B}
+				if space == "lab" {
+					r, g, bl := unpremultiply(c)
+					L, A, B := rgbToLab(r, g, bl)
+					v = [3]uint16{encodeL(L), encodeAB(A), encodeAB(B)}
+				}
+				for i := range p {
+					p[i].SetGray16(x, y, color.Gray16{v[i]})
+				}
+				if a != nil {
+					a.SetGray16(x, y, color.Gray16{c.A})
+				}
+			}
+		}
+		for c := range planes {
+			planes[c] = append(planes[c], p[c])
+		}
+	}
+	return planes, alpha, nil
+}
+
+// unpremultiply returns the straight (non-premultiplied) colour of c
+func unpremultiply(c color.RGBA64) (r, g, b uint16) {
+	if c.A == 0xffff {
+		return c.R, c.G, c.B
+	}
+	if c.A == 0 {
+		return 0, 0, 0
+	}
+	un := func(v uint16) uint16 { return uint16(min(uint32(v)*0xffff/uint32(c.A), 0xffff)) }
+	return un(c.R), un(c.G), un(c.B)
+}
+
+// mergePlanes recombines three stitched planes produced from splitPlanes into an
+// RGBA image. alpha is the stitched alpha plane, or nil when every tile was opaque.
+func mergePlanes(planes [3]*image.Gray16, alpha *image.Gray16, space string) (*image.RGBA64, error) {
+	if space == "rgb" && alpha == nil {
+		return composite(map[string]*image.Gray16{"red": planes[0], "green": planes[1], "blue": planes[2]})
+	}
+	b := planes[0].Bounds()
+	for _, p := range planes[1:] {
+		if p.Bounds() != b {
+			return nil, fmt.Errorf("colour planes differ in size: %v and %v", b.Size(), p.Bounds().Size())
+		}
+	}
+	if alpha != nil && alpha.Bounds() != b {
+		return nil, fmt.Errorf("alpha plane is %v, expected %v", alpha.Bounds().Size(), b.Size())
+	}
+	out := image.NewRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBA64{planes[0].Gray16At(x, y).Y, planes[1].Gray16At(x, y).Y, planes[2].Gray16At(x, y).Y, 0xffff}
+			if space == "lab" {
+				c.R, c.G, c.B = labToRGB(decodeL(c.R), decodeAB(c.G), decodeAB(c.B))
+			}
+			if alpha != nil {
+				c.A = alpha.Gray16At(x, y).Y
+				if space == "lab" {
+					// Lab was blended unpremultiplied
+					pre := func(v uint16) uint16 { return uint16(uint32(v) * uint32(c.A) / 0xffff) }
+					c.R, c.G, c.B = pre(c.R), pre(c.G), pre(c.B)
+				}
+				// summed overlaps are clamped separately, so keep colour within alpha
+				c.R, c.G, c.B = min(c.R, c.A), min(c.G, c.A), min(c.B, c.A)
+			}
+			out.SetRGBA64(x, y, c)
+		}
+	}
+	return out, nil
+}
+
+// unpremultiplyPlanes divides stitched premultiplied R, G and B planes by the
+// stitched alpha plane in place, for outputs that carry no alpha
+func unpremultiplyPlanes(planes [3]*image.Gray16, alpha *image.Gray16) {
+	b := alpha.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBA64{planes[0].Gray16At(x, y).Y, planes[1].Gray16At(x, y).Y, planes[2].Gray16At(x, y).Y, alpha.Gray16At(x, y).Y}
+			c.R, c.G, c.B = min(c.R, c.A), min(c.G, c.A), min(c.B, c.A)
+			r, g, bl := unpremultiply(c)
+			planes[0].SetGray16(x, y, color.Gray16{r})
+			planes[1].SetGray16(x, y, color.Gray16{g})
+			planes[2].SetGray16(x, y, color.Gray16{bl})
+		}
+	}
+}
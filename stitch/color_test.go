@@ -0,0 +1,82 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// solidTile returns a w x h RGBA64 tile of the premultiplied colour c
+func solidTile(w, h int, c color.RGBA64) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA64(x, y, c)
+		}
+	}
+	return img
+}
+
+// stitchColour stitches colour tiles plane by plane, as --color does
+func stitchColour(t *testing.T, tiles []image.Image, rows, cols int, opts mosaicOptions) *image.RGBA64 {
+	t.Helper()
+	planes, alpha, err := splitPlanes(tiles, "rgb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stitched [3]*image.Gray16
+	for c := range planes {
+		if stitched[c], err = mosaic(planes[c], rows, cols, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var a *image.Gray16
+	if alpha != nil {
+		if a, err = mosaic(alpha, rows, cols, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := mergePlanes(stitched, a, "rgb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// TestBlendSemiTransparent stitches an opaque red tile next to a quarter opaque
+// blue one and checks that colour is blended premultiplied and alpha is kept
+func TestBlendSemiTransparent(t *testing.T) {
+	const w, h, overlap = 12, 6, 4
+	red := color.RGBA64{0xffff, 0, 0, 0xffff}
+	blue := color.RGBA64{0, 0, 0x4000, 0x4000} // straight blue at alpha 0.25
+	tiles := []image.Image{solidTile(w, h, red), solidTile(w, h, blue)}
+
+	tests := []struct {
+		blend   string
+		overlap color.RGBA64 // expected pixel where the tiles overlap
+	}{
+		{"average", color.RGBA64{0x8000, 0, 0x2000, 0xa000}},
+		{"sum", color.RGBA64{0xffff, 0, 0x4000, 0xffff}},
+		{"none", blue},
+	}
+	for _, tt := range tests {
+		out := stitchColour(t, tiles, 1, 2, mosaicOptions{overlapX: overlap, overlapTurn: -1, snake: "horizontal", blend: tt.blend})
+		if got := out.Bounds().Size(); got != image.Pt(2*w-overlap, h) {
+			t.Fatalf("%s: mosaic is %v", tt.blend, got)
+		}
+		for _, c := range []struct {
+			x    int
+			want color.RGBA64
+		}{
+			{0, red},
+			{w - overlap/2, tt.overlap},
+			{2*w - overlap - 1, blue},
+		} {
+			got := out.RGBA64At(c.x, h/2)
+			near := func(a, b uint16) bool { return int(a)-int(b) <= 2 && int(b)-int(a) <= 2 }
+			if !near(got.R, c.want.R) || !near(got.G, c.want.G) || !near(got.B, c.want.B) || !near(got.A, c.want.A) {
+				t.Errorf("%s: pixel %d is %v, want %v", tt.blend, c.x, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package stitch
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// tileHash returns a hash of img's size, pixel format and pixel values, ignoring
+// file metadata so that repeated frames match even when their tags differ
+func tileHash(img image.Image) [sha256.Size]byte {
+	h := sha256.New()
+	b := img.Bounds()
+	fmt.Fprintf(h, "%T %d %d\n", img, b.Dx(), b.Dy())
+	var buf [8]byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		switch m := img.(type) {
+		case *image.Gray16:
+			i := m.PixOffset(b.Min.X, y)
+			h.Write(m.Pix[i : i+2*b.Dx()])
+		case *image.Gray:
+			i := m.PixOffset(b.Min.X, y)
+			h.Write(m.Pix[i : i+b.Dx()])
+		default:
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+				binary.BigEndian.PutUint16(buf[0:], c.R)
+				binary.BigEndian.PutUint16(buf[2:], c.G)
+				binary.BigEndian.PutUint16(buf[4:], c.B)
+				binary.BigEndian.PutUint16(buf[6:], c.A)
+				h.Write(buf[:])
+			}
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// dedupTiles decodes every tile and warns about each one whose pixels repeat an
+// earlier tile's. With drop the repeats are removed from the returned list. Tiles
+// that fail to load are kept so the normal loader reports them.
+func dedupTiles(paths []string, timeout time.Duration, drop bool, client *http.Client) []string {
+	first := make(map[[sha256.Size]byte]string)
+	kept := paths[:0:0]
+	dups := 0
+	for _, p := range paths {
+		img, err := loadTIFFTimeout(p, timeout, client)
+		if err != nil {
+			kept = append(kept, p)
+			continue
+		}
+		sum := tileHash(img)
+		if orig, ok := first[sum]; ok {
+			slog.Warn("duplicate tile", "path", p, "same_as", orig, "dropped", drop)
+			dups++
+			if drop {
+				continue
+			}
+		} else {
+			first[sum] = p
+		}
+		kept = append(kept, p)
+	}
+	if dups > 0 {
+		slog.Warn("found duplicate tiles", "count", dups, "tiles", len(paths))
+	}
+	return kept
+}
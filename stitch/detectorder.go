@@ -0,0 +1,300 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// detectBlock is the side, in grid cells, of the top-left block whose seams
+// --detect-order correlates for each candidate order
+const detectBlock = 3
+
+// orderCandidate is one tile order --detect-order tries, with the flags selecting
+// it, or, for an order the grid flags cannot express, a description in raster
+type orderCandidate struct {
+	flags  string
+	raster string
+	cells  []image.Point // grid cell of each tile in sorted order
+}
+
+// name returns the flags selecting the order, or its description
+func (c orderCandidate) name() string {
+	if c.raster != "" {
+		return "raster, " + c.raster
+	}
+	return c.flags
+}
+
+// orderCandidates returns every distinct order the grid flags can express: both
+// snake directions from either start, each read forwards or, with --origin-index,
+// backwards along the list. After them come the eight raster orders, row by row
+// or column by column from each corner, which only --index-map can give. Orders
+// that coincide on this grid are listed once, under the flags when they can be.
+func orderCandidates(rows, cols int) ([]orderCandidate, error) {
+	var out []orderCandidate
+	seen := make(map[string]bool)
+	add := func(c orderCandidate) {
+		key := fmt.Sprint(c.cells)
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, c)
+		}
+	}
+	for _, snake := range []string{"vertical", "horizontal"} {
+		for _, reverse := range []bool{false, true} {
+			cells, err := gridCells(rows, cols, snake, reverse)
+			if err != nil {
+				return nil, err
+			}
+			flags := "--snake " + snake
+			switch {
+			case snake == "vertical" && reverse:
+				flags += " --col-start top"
+			case snake == "vertical":
+				flags += " --col-start bottom"
+			case reverse:
+				flags += " --row-start right"
+			default:
+				flags += " --row-start left"
+			}
+			add(orderCandidate{flags: flags, cells: cells})
+
+			n := len(cells)
+			back := make([]image.Point, n)
+			first := 0
+			for i, c := range cells {
+				back[n-1-i] = c
+				if c == (image.Point{}) {
+					first = i
+				}
+			}
+			add(orderCandidate{flags: fmt.Sprintf("%s --origin-index %d", flags, n-1-first), cells: back})
+		}
+	}
+	for _, byCol := range []bool{false, true} {
+		for _, bottom := range []bool{false, true} {
+			for _, right := range []bool{false, true} {
+				add(rasterOrder(rows, cols, byCol, bottom, right))
+			}
+		}
+	}
+	return out, nil
+}
+
+// rasterOrder returns the order running every row (or, with byCol, every column)
+// the same way, starting from the grid corner given by bottom and right
+func rasterOrder(rows, cols int, byCol, bottom, right bool) orderCandidate {
+	vert, horiz := "top", "left"
+	if bottom {
+		vert = "bottom"
+	}
+	if right {
+		horiz = "right"
+	}
+	desc := fmt.Sprintf("row by row from the %s %s", vert, horiz)
+	outer, inner := rows, cols
+	if byCol {
+		desc = fmt.Sprintf("column by column from the %s %s", vert, horiz)
+		outer, inner = cols, rows
+	}
+	cells := make([]image.Point, 0, rows*cols)
+	for a := 0; a < outer; a++ {
+		for k := 0; k < inner; k++ {
+			c := image.Pt(k, a)
+			if byCol {
+				c = image.Pt(a, k)
+			}
+			if right {
+				c.X = cols - 1 - c.X
+			}
+			if bottom {
+				c.Y = rows - 1 - c.Y
+			}
+			cells = append(cells, c)
+		}
+	}
+	return orderCandidate{raster: desc, cells: cells}
+}
+
+// stageCoord is a tile's stage position read from its TIFF tags; ok is false when
+// the tile has none
+type stageCoord struct {
+	x, y float64
+	ok   bool
+}
+
+// readStageCoords reads the stage coordinates of each local tile in paths
+func readStageCoords(paths []string, tags [2]uint16) ([]stageCoord, error) {
+	coords := make([]stageCoord, len(paths))
+	for i, p := range paths {
+		if isURL(p) {
+			continue
+		}
+		vals, err := readTIFFTags(p, tags[0], tags[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		x, okx := vals[tags[0]]
+		y, oky := vals[tags[1]]
+		coords[i] = stageCoord{x, y, okx && oky}
+	}
+	return coords, nil
+}
+
+// stageResidual fits the stage coordinates to the grid positions of cells as
+// checkStageOrder does and returns the RMS distance of the tiles from the fit, in
+// tile steps. ok is false when fewer than two tiles carry coordinates. The fit
+// does not know which way the stage axes run, so mirrored orders score alike.
+func stageResidual(cells []image.Point, coords []stageCoord, step image.Point) (rms float64, ok bool) {
+	var gx, gy, sx, sy []float64
+	for i, c := range coords {
+		if c.ok {
+			gx = append(gx, float64(cells[i].X*step.X))
+			gy = append(gy, float64(cells[i].Y*step.Y))
+			sx, sy = append(sx, c.x), append(sy, c.y)
+		}
+	}
+	if len(gx) < 2 {
+		return 0, false
+	}
+	var sum float64
+	for _, axis := range []struct {
+		grid, stage []float64
+		step        int
+	}{{gx, sx, step.X}, {gy, sy, step.Y}} {
+		fit, ok := fitStage(axis.grid, axis.stage)
+		if !ok {
+			continue
+		}
+		if fit.scale == 0 {
+			return math.Inf(1), true
+		}
+		for k := range axis.grid {
+			off := (axis.stage[k] - fit.offset - fit.scale*axis.grid[k]) / math.Abs(fit.scale) / float64(axis.step)
+			sum += off * off
+		}
+	}
+	return math.Sqrt(sum / float64(len(gx))), true
+}
+
+// blockSeamNCC returns the mean correlation of the seams between the cells of the
+// top-left detectBlock x detectBlock block, with tile(i) loading tile i as placed
+func blockSeamNCC(cells []image.Point, overlapX, overlapY int, tile func(i int) (*image.Gray16, error)) (float64, int, error) {
+	inBlock := func(c image.Point) bool { return c.X < detectBlock && c.Y < detectBlock }
+	var sum float64
+	count := 0
+	for _, axis := range []struct {
+		overlap    int
+		horizontal bool
+	}{{overlapX, true}, {overlapY, false}} {
+		if axis.overlap <= 0 {
+			continue
+		}
+		for _, p := range neighbourPairs(cells, axis.horizontal) {
+			if !inBlock(cells[p[0]]) || !inBlock(cells[p[1]]) {
+				continue
+			}
+			a, err := tile(p[0])
+			if err != nil {
+				return 0, 0, err
+			}
+			b, err := tile(p[1])
+			if err != nil {
+				return 0, 0, err
+			}
+			sum += seamNCC(a, b, axis.overlap, axis.horizontal)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, 0, nil
+	}
+	return sum / float64(count), count, nil
+}
+
+// detectOrder scores every candidate order of the rows x cols grid of paths against
+// the stage coordinates in the tiles' tags and against the correlation of the
+// seams in the grid's top-left corner, logs each score and writes the flags of the
+// best order to w. Orders that put every tile within tolerance tile steps of its stage
+// position are preferred; among those, and to tell mirrored orders apart, the
+// best correlated seams win. A winning raster order is written as an index map. step is the nominal tile step in input pixels, and
+// overlapX, overlapY are in loaded pixels.
+func detectOrder(paths []string, rows, cols int, tags [2]uint16, step image.Point, tolerance float64, overlapX, overlapY int, opts loadOptions, w io.Writer) error {
+	candidates, err := orderCandidates(rows, cols)
+	if err != nil {
+		return err
+	}
+	coords, err := readStageCoords(paths, tags)
+	if err != nil {
+		return err
+	}
+	tiles := make(map[int]*image.Gray16)
+	tile := func(i int) (*image.Gray16, error) {
+		if t, ok := tiles[i]; ok {
+			return t, nil
+		}
+		imgs, err := loadTiles(paths[i:i+1], opts)
+		if err != nil {
+			return nil, err
+		}
+		tiles[i] = toGray16(imgs[0])
+		return tiles[i], nil
+	}
+
+	best := -1
+	var bestFits bool
+	var bestNCC float64
+	for k, c := range candidates {
+		rms, haveStage := stageResidual(c.cells, coords, step)
+		ncc, seams, err := blockSeamNCC(c.cells, overlapX, overlapY, tile)
+		if err != nil {
+			return err
+		}
+		attrs := []any{"order", c.name(), "seams", seams, "seam_ncc", math.Round(ncc*1000) / 1000}
+		if haveStage {
+			attrs = append(attrs, "stage_rms_steps", math.Round(rms*1000)/1000)
+		}
+		slog.Info("order candidate", attrs...)
+		fits := !haveStage || rms <= tolerance
+		if best < 0 || fits && !bestFits || fits == bestFits && ncc > bestNCC {
+			best, bestFits, bestNCC = k, fits, ncc
+		}
+	}
+	if !bestFits {
+		slog.Warn("no candidate order matches the stage coordinates; check --rows/--cols and the file sort order", "tolerance", tolerance)
+	}
+	if !anyStage(coords) {
+		slog.Info("no tile carries stage coordinates; the order was chosen by seam correlation alone", "tags", tags)
+	}
+	c := candidates[best]
+	if c.raster == "" {
+		_, err := fmt.Fprintf(w, "Recommended: %s\n", c.flags)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Recommended: %s (not expressible with current flags; save the lines below as an --index-map file)\n%s", c.name(), indexMapText(c.cells))
+	return err
+}
+
+// indexMapText formats cells as an --index-map file, one "<row> <col>" line per tile
+func indexMapText(cells []image.Point) string {
+	var b strings.Builder
+	b.WriteString("# row col\n")
+	for _, c := range cells {
+		fmt.Fprintf(&b, "%d %d\n", c.Y, c.X)
+	}
+	return b.String()
+}
+
+// anyStage reports whether any tile carries stage coordinates
+func anyStage(coords []stageCoord) bool {
+	for _, c := range coords {
+		if c.ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package stitch
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+// EncodeOptions carries encoder settings; each encoder uses the ones that apply to it
+type EncodeOptions struct {
+	Quality     int     // JPEG quality, 1-100
+	Compression string  // TIFF compression: deflate (the default) or none
+	Flat        bool    // TIFF: the simplest layout, one image directory and one strip without a predictor
+	DPI         float64 // resolution written to TIFF, PNG and JPEG files in dots per inch, from 0.5 to 65535; 0 keeps each format's default
+}
+
+// tiffCompression maps an EncodeOptions compression name to TIFF's
+func tiffCompression(name string) (tiff.CompressionType, error) {
+	switch name {
+	case "", "deflate":
+		return tiff.Deflate, nil
+	case "none":
+		return tiff.Uncompressed, nil
+	}
+	return 0, fmt.Errorf("invalid compression: %s (use deflate or none)", name)
+}
+
+// Encoder writes an image in one output format
+type Encoder interface {
+	Encode(w io.Writer, img image.Image, opts EncodeOptions) error
+}
+
+// EncoderFunc adapts an ordinary function to the Encoder interface
+type EncoderFunc func(w io.Writer, img image.Image, opts EncodeOptions) error
+
+func (f EncoderFunc) Encode(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return f(w, img, opts)
+}
+
+// encodeFile encodes img with enc to path through writeOutput
+func encodeFile(path string, enc Encoder, img image.Image, opts EncodeOptions) error {
+	return writeOutput(path, func(w io.Writer) error { return enc.Encode(w, img, opts) })
+}
+
+// writeOutput writes a file to path through write. It writes to path+".partial"
+// and renames that into place once write returns, so a write that fails part way,
+// e.g. on a full disk, removes its partial output and leaves any earlier file at
+// path untouched. Errors name path and how many bytes had been written.
+func writeOutput(path string, write func(io.Writer) error) error {
+	tmp := path + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		var written int64
+		if fi, serr := f.Stat(); serr == nil {
+			written = fi.Size()
+		}
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s failed after %d bytes: %w", path, written, err)
+	}
+	if err := write(f); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+var (
+	encoders   = make(map[string]Encoder)
+	encoderExt = make(map[string]string) // file extension → format name
+)
+
+// RegisterEncoder makes enc available as --format name and for output files
+// with any of the given extensions
+func RegisterEncoder(name string, enc Encoder, exts ...string) {
+	encoders[name] = enc
+	for _, ext := range exts {
+		encoderExt[strings.ToLower(ext)] = name
+	}
+}
+
+// lookupEncoder returns the encoder for format, or when format is empty the one
+// registered for the extension of path. Unknown extensions fall back to TIFF.
+func lookupEncoder(format, path string) (string, Encoder, error) {
+	if format == "" {
+		format = encoderExt[strings.ToLower(filepath.Ext(path))]
+		if format == "" {
+			format = "tiff"
+		}
+	}
+	enc, ok := encoders[format]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown output format: %s (use %s)", format, strings.Join(encoderNames(), ", "))
+	}
+	return format, enc, nil
+}
+
+// encoderNames returns the registered format names in sorted order
+func encoderNames() []string {
+	var names []string
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterEncoder("tiff", EncoderFunc(func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		c, err := tiffCompression(opts.Compression)
+		if err != nil {
+			return err
+		}
+		tiffOpts := &tiff.Options{Compression: c, Predictor: c == tiff.Deflate && !opts.Flat}
+		if opts.DPI <= 0 {
+			return tiff.Encode(w, img, tiffOpts)
+		}
+		// the tiff package always writes 72 dpi, so the resolution is patched in
+		var buf bytes.Buffer
+		if err := tiff.Encode(&buf, img, tiffOpts); err != nil {
+			return err
+		}
+		if err := setTIFFResolution(buf.Bytes(), opts.DPI); err != nil {
+			return err
+		}
+		_, err = w.Write(buf.Bytes())
+		return err
+	}), ".tif", ".tiff")
+
+	RegisterEncoder("png", EncoderFunc(func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		if opts.DPI <= 0 {
+			return png.Encode(w, img)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		b, err := setPNGResolution(buf.Bytes(), opts.DPI)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}), ".png")
+
+	RegisterEncoder("jpeg", EncoderFunc(func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		if opts.DPI <= 0 {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return err
+		}
+		b, err := setJPEGResolution(buf.Bytes(), opts.DPI)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}), ".jpg", ".jpeg")
+}
@@ -0,0 +1,35 @@
+package stitch
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWriteOutputFailure checks that a write failing part way removes its partial
+// file, keeps the earlier file at the path and reports the bytes written
+func TestWriteOutputFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.tsv")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	full := errors.New("no space left on device")
+	err := writeOutput(path, func(w io.Writer) error {
+		if _, err := w.Write(make([]byte, 100)); err != nil {
+			return err
+		}
+		return full
+	})
+	if !errors.Is(err, full) || !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), "after 100 bytes") {
+		t.Errorf("got error %v, want the failure with the path and 100 bytes", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "earlier\n" {
+		t.Errorf("earlier file is %q (%v), want it untouched", data, err)
+	}
+	if _, err := os.Stat(path + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package stitch
+
+import (
+	"bufio"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// excludeList holds the tiles named by an --exclude file, by path or, for entries
+// without a directory, by base name. Both map to the entry as written.
+type excludeList struct {
+	paths   map[string]string // cleaned paths, as given and made absolute
+	names   map[string]string // base names
+	entries []string          // in file order, to report entries that matched nothing
+}
+
+// loadExcludeList reads an --exclude file: one path or base name per line, with
+// blank lines and "#" comments ignored
+func loadExcludeList(filename string) (*excludeList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ex := &excludeList{paths: make(map[string]string), names: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ex.entries = append(ex.entries, line)
+		if !strings.ContainsAny(line, `/\`) {
+			ex.names[line] = line
+			continue
+		}
+		ex.paths[filepath.Clean(line)] = line
+		if abs, err := filepath.Abs(line); err == nil {
+			ex.paths[abs] = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// match returns the entry excluding the tile at path, if any
+func (ex *excludeList) match(path string) (string, bool) {
+	if e, ok := ex.names[filepath.Base(path)]; ok {
+		return e, true
+	}
+	if e, ok := ex.paths[filepath.Clean(path)]; ok {
+		return e, true
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		if e, ok := ex.paths[abs]; ok {
+			return e, true
+		}
+	}
+	return "", false
+}
+
+// mark reports which of paths are excluded, logging each one and warning about
+// entries that match none of them, which usually means a typo in the list
+func (ex *excludeList) mark(paths []string) []bool {
+	excluded := make([]bool, len(paths))
+	used := make(map[string]bool)
+	for i, p := range paths {
+		if e, ok := ex.match(p); ok {
+			excluded[i] = true
+			used[e] = true
+			slog.Info("excluding tile", "path", p, "entry", e)
+		}
+	}
+	for _, e := range ex.entries {
+		if !used[e] {
+			slog.Warn("--exclude entry matches no tile", "entry", e)
+		}
+	}
+	return excluded
+}
+
+// without returns the paths not marked in excluded
+func without(paths []string, excluded []bool) []string {
+	var kept []string
+	for i, p := range paths {
+		if !excluded[i] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// withPlaceholders spreads the tiles loaded for the cells not marked in excluded
+// back over all the cells, with a blank tile the size of the first in each
+// excluded cell
+func withPlaceholders(imgs []image.Image, excluded []bool) []image.Image {
+	all := make([]image.Image, 0, len(excluded))
+	next := 0
+	for _, ex := range excluded {
+		if ex {
+			all = append(all, image.NewGray16(image.Rectangle{Max: imgs[0].Bounds().Size()}))
+			continue
+		}
+		all = append(all, imgs[next])
+		next++
+	}
+	return all
+}
@@ -0,0 +1,216 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+// exportManifest is the file in the export directory listing completed tiles
+const exportManifest = "export-manifest.txt"
+
+// exportOptions controls --export-tiles
+type exportOptions struct {
+	dir      string
+	resume   bool // skip tiles already listed in the manifest
+	validate bool // with resume, re-check that skipped outputs still decode
+
+	template string         // --name-template; empty keeps the input base name
+	cells    []image.Point  // grid cell of each tile, needed by {row} and {col}
+	channel  *regexp.Regexp // its first capture group fills {channel}; optional
+}
+
+// templateField matches a {placeholder} in a name template
+var templateField = regexp.MustCompile(`\{(\w*)\}`)
+
+// checkTemplate rejects unknown placeholders and reports whether the template
+// refers to the grid cell of a tile
+func checkTemplate(tmpl string) (needsCell bool, err error) {
+	for _, m := range templateField.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "row", "col":
+			needsCell = true
+		case "index", "channel", "base":
+		default:
+			return false, fmt.Errorf("unknown placeholder %s in name template (use {row}, {col}, {index}, {channel} or {base})", m[0])
+		}
+	}
+	return needsCell, nil
+}
+
+// exportName returns the output file name for the i-th tile at path: its base name,
+// or the expanded name template. Rows and columns count from 0, and .tif is added
+// when the name has no extension.
+func exportName(path string, i int, opts exportOptions) string {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if opts.template == "" {
+		return base + ".tif"
+	}
+	name := templateField.ReplaceAllStringFunc(opts.template, func(field string) string {
+		switch field {
+		case "{row}":
+			return strconv.Itoa(opts.cells[i].Y)
+		case "{col}":
+			return strconv.Itoa(opts.cells[i].X)
+		case "{index}":
+			return strconv.Itoa(i)
+		case "{channel}":
+			if opts.channel != nil {
+				if m := opts.channel.FindStringSubmatch(filepath.Base(path)); len(m) > 1 {
+					return m[1]
+				}
+			}
+			return ""
+		}
+		return base
+	})
+	if filepath.Ext(name) == "" {
+		name += ".tif"
+	}
+	return name
+}
+
+// readManifest returns the set of output names recorded as completed
+func readManifest(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// validTIFF reports whether path holds a TIFF whose header decodes
+func validTIFF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = tiff.DecodeConfig(f)
+	return err == nil
+}
+
+// exportTiles loads and preprocesses each tile and writes it as a TIFF into opts.dir.
+// Every finished tile is appended to the manifest, so an interrupted export can be
+// resumed without redoing completed tiles.
+func exportTiles(paths []string, load loadOptions, opts exportOptions) error {
+	if err := os.MkdirAll(opts.dir, 0o755); err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(opts.dir, exportManifest)
+
+	done := make(map[string]bool)
+	if opts.resume {
+		var err error
+		if done, err = readManifest(manifestPath); err != nil {
+			return err
+		}
+	} else if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	manifest, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	names := make(map[string]string)
+	skipped := 0
+	for i, p := range paths {
+		name := exportName(p, i, opts)
+		if prev, dup := names[name]; dup {
+			return fmt.Errorf("%s and %s would both be exported as %s", prev, p, name)
+		}
+		names[name] = p
+		out := filepath.Join(opts.dir, name)
+
+		if done[name] {
+			_, err := os.Stat(out)
+			if err == nil && (!opts.validate || validTIFF(out)) {
+				skipped++
+				continue
+			}
+			slog.Warn("re-exporting missing or invalid tile", "path", out)
+		}
+
+		imgs, err := loadTiles([]string{p}, load)
+		if err != nil {
+			return err
+		}
+		// Deflate with the predictor; a crash never leaves a half-written tile
+		if err := encodeFile(out, encoders["tiff"], imgs[0], EncodeOptions{}); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(manifest, name); err != nil {
+			return err
+		}
+		if err := manifest.Sync(); err != nil {
+			return err
+		}
+		slog.Debug("exported tile", "path", out)
+	}
+	slog.Info("tiles exported", "dir", opts.dir, "written", len(paths)-skipped, "skipped", skipped)
+	return nil
+}
+
+// rowBands returns, for each grid row with placed tiles, the part of the mosaic
+// canvas its tiles cover. placed holds the canvas position of each placed tile.
+func rowBands(imgs []image.Image, cells []image.Point, placed map[int]image.Point) map[int]image.Rectangle {
+	// the canvas starts at the top-left of all placed tiles
+	var canvas image.Rectangle
+	rows := make(map[int]image.Rectangle)
+	for idx, pt := range placed {
+		r := image.Rectangle{Min: pt, Max: pt.Add(imgs[idx].Bounds().Size())}
+		canvas = canvas.Union(r)
+		rows[cells[idx].Y] = rows[cells[idx].Y].Union(r)
+	}
+	for row, r := range rows {
+		rows[row] = r.Sub(canvas.Min)
+	}
+	return rows
+}
+
+// exportRows writes the band of each grid row in each mosaic of outs to dir as
+// row-NNN<suffix>.tif, with one suffix per mosaic
+func exportRows(dir string, outs []image.Image, suffixes []string, bands map[int]image.Rectangle) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for i, out := range outs {
+		sub, ok := out.(interface {
+			SubImage(image.Rectangle) image.Image
+		})
+		if !ok {
+			return fmt.Errorf("cannot crop a %T mosaic into rows", out)
+		}
+		for row, band := range bands {
+			path := filepath.Join(dir, fmt.Sprintf("row-%03d%s.tif", row, suffixes[i]))
+			if err := encodeFile(path, encoders["tiff"], sub.SubImage(band.Add(out.Bounds().Min)), EncodeOptions{}); err != nil {
+				return err
+			}
+			slog.Debug("row exported", "row", row, "path", path, "size", band.Size())
+		}
+	}
+	slog.Info("rows exported", "dir", dir, "rows", len(bands))
+	return nil
+}
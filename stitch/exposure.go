@@ -0,0 +1,90 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"path/filepath"
+)
+
+// exposureScales returns the factor each tile is multiplied by to bring it to the
+// shortest exposure among paths, so tiles can be summed photometrically. The
+// exposure times come from the TIFF tag when tag is set, or else from exposures,
+// keyed by full path or base name as in a --weights file. Every tile needs one.
+func exposureScales(paths []string, exposures map[string]float64, tag uint16) (map[string]float64, error) {
+	times := make(map[string]float64, len(paths))
+	shortest := math.Inf(1)
+	for _, p := range paths {
+		var t float64
+		var ok bool
+		if tag != 0 {
+			if isURL(p) {
+				return nil, fmt.Errorf("%s: exposure tags are not read from URLs; use --exposures", p)
+			}
+			vals, err := readTIFFTags(p, tag)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", p, err)
+			}
+			t, ok = vals[tag]
+		} else if t, ok = exposures[p]; !ok {
+			t, ok = exposures[filepath.Base(p)]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: no exposure time", p)
+		}
+		if t <= 0 {
+			return nil, fmt.Errorf("%s: invalid exposure time %g", p, t)
+		}
+		times[p] = t
+		shortest = min(shortest, t)
+	}
+	scales := make(map[string]float64, len(paths))
+	for p, t := range times {
+		scales[p] = shortest / t
+		slog.Debug("exposure", "path", p, "time", t, "scale", scales[p])
+	}
+	if len(paths) > 0 {
+		slog.Info("normalizing tiles to the shortest exposure", "exposure", shortest, "tiles", len(paths))
+	}
+	return scales, nil
+}
+
+// scaleTile multiplies every sample of img by f, keeping 8-bit tiles 8-bit. Colour
+// tiles are scaled premultiplied, so f must not exceed 1 to keep alpha valid.
+func scaleTile(img image.Image, f float64) image.Image {
+	b := img.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+	scale8 := func(v uint8) uint8 { return uint8(min(float64(v)*f+0.5, 255)) }
+	scale16 := func(v uint16) uint16 { return clamp16(float64(v)*f + 0.5) }
+	var out draw.Image
+	var px func(x, y int) color.Color
+	switch m := img.(type) {
+	case *image.Gray:
+		out = image.NewGray(r)
+		px = func(x, y int) color.Color { return color.Gray{scale8(m.GrayAt(x, y).Y)} }
+	case *image.Gray16:
+		out = image.NewGray16(r)
+		px = func(x, y int) color.Color { return color.Gray16{scale16(m.Gray16At(x, y).Y)} }
+	case *image.RGBA:
+		out = image.NewRGBA(r)
+		px = func(x, y int) color.Color {
+			c := m.RGBAAt(x, y)
+			return color.RGBA{scale8(c.R), scale8(c.G), scale8(c.B), c.A}
+		}
+	default:
+		out = image.NewRGBA64(r)
+		px = func(x, y int) color.Color {
+			c := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+			return color.RGBA64{scale16(c.R), scale16(c.G), scale16(c.B), c.A}
+		}
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(x, y, px(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// flatField holds the flat-field references for --flatfield: either a single
+// reference used for every tile, or a directory of references matched to tiles
+// by file name or, failing that, by tile order
+type flatField struct {
+	single  string            // single reference; empty when refs come from a directory
+	byName  map[string]string // directory references by base name
+	ordered []string          // directory references in file name order
+	gains   map[string]flatGain
+	client  *http.Client // fetches a remote single reference
+}
+
+// flatGain is the per-pixel gain of one reference, row-major over bounds
+type flatGain struct {
+	vals   []float64
+	bounds image.Rectangle
+}
+
+// loadFlatField opens path as a single flat-field reference TIFF or as a
+// directory of per-tile references; a remote reference is fetched through client
+func loadFlatField(path string, client *http.Client) (*flatField, error) {
+	ff := &flatField{gains: make(map[string]flatGain), client: client}
+	if isURL(path) {
+		ff.single = path
+		return ff, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		ff.single = path
+		return ff, nil
+	}
+	refs, err := getImagePaths(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no flat-field references (.tif/.tiff) in %s", path)
+	}
+	if len(refs) == 1 {
+		ff.single = refs[0]
+		return ff, nil
+	}
+	ff.ordered = refs
+	ff.byName = make(map[string]string, len(refs))
+	for _, r := range refs {
+		ff.byName[filepath.Base(r)] = r
+	}
+	return ff, nil
+}
+
+// reference returns the reference for tile i of n, at path
+func (ff *flatField) reference(i, n int, path string) (string, error) {
+	if ff.single != "" {
+		return ff.single, nil
+	}
+	if r, ok := ff.byName[filepath.Base(path)]; ok {
+		return r, nil
+	}
+	if len(ff.ordered) == n {
+		return ff.ordered[i], nil
+	}
+	return "", fmt.Errorf("no flat-field reference named %s, and the %d references cannot be matched to %d tiles by order",
+		filepath.Base(path), len(ff.ordered), n)
+}
+
+// gain returns the per-pixel gain of reference ref, its mean divided by each
+// pixel, so that multiplying a tile by it flattens the illumination
+func (ff *flatField) gain(ref string) (flatGain, error) {
+	if g, ok := ff.gains[ref]; ok {
+		return g, nil
+	}
+	img, err := loadTIFF(ref, ff.client)
+	if err != nil {
+		return flatGain{}, fmt.Errorf("flat-field %w", err)
+	}
+	g := toGray16(img)
+	r := g.Bounds()
+	vals := make([]float64, 0, r.Dx()*r.Dy())
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := max(float64(g.Gray16At(x, y).Y), 1)
+			vals = append(vals, v)
+			sum += v
+		}
+	}
+	mean := sum / float64(len(vals))
+	for i, v := range vals {
+		vals[i] = mean / v
+	}
+	ff.gains[ref] = flatGain{vals, r}
+	slog.Debug("loaded flat-field reference", "path", ref, "mean", mean)
+	return ff.gains[ref], nil
+}
+
+// correct divides tile i of n, loaded from path, by its flat-field reference.
+// Grayscale tiles stay grayscale; colour tiles get the same gain on each channel.
+func (ff *flatField) correct(i, n int, path string, img image.Image) (image.Image, error) {
+	ref, err := ff.reference(i, n, path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := ff.gain(ref)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Size() != g.bounds.Size() {
+		return nil, fmt.Errorf("flat-field %s is %v but tile %s is %v", ref, g.bounds.Size(), path, b.Size())
+	}
+	return applyGain(img, g.vals), nil
+}
+
+// applyGain multiplies each pixel of img by its gain, given row-major over the
+// image. Grayscale images stay grayscale; colour images get the same gain on each
+// channel.
+func applyGain(img image.Image, gain []float64) image.Image {
+	b := img.Bounds()
+	w := b.Dx()
+	switch img.(type) {
+	case *image.Gray16, *image.Gray:
+		src := toGray16(img)
+		out := image.NewGray16(image.Rect(0, 0, w, b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < w; x++ {
+				v := float64(src.Gray16At(b.Min.X+x, b.Min.Y+y).Y)
+				out.SetGray16(x, y, color.Gray16{clamp16(v * gain[y*w+x])})
+			}
+		}
+		return out
+	}
+	out := image.NewRGBA64(image.Rect(0, 0, w, b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			px := color.RGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)
+			k := gain[y*w+x]
+			// keep premultiplied colour within alpha
+			px.R = min(clamp16(float64(px.R)*k), px.A)
+			px.G = min(clamp16(float64(px.G)*k), px.A)
+			px.B = min(clamp16(float64(px.B)*k), px.A)
+			out.SetRGBA64(x, y, px)
+		}
+	}
+	return out
+}
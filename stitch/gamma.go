@@ -0,0 +1,66 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// gammaCurve maps sample values through v' = 65535 * (v/65535)^exp. 8-bit samples
+// are promoted to 16 bits first, so dark 8-bit values are not crushed together by
+// an 8-bit table.
+type gammaCurve struct {
+	lut []uint16
+}
+
+// newGammaCurve returns the curve raising normalized samples to exp: the camera
+// gamma to linearize tiles with --input-gamma, and its inverse to re-encode the
+// mosaic with --output-gamma
+func newGammaCurve(exp float64) *gammaCurve {
+	c := &gammaCurve{lut: make([]uint16, 65536)}
+	for v := range c.lut {
+		c.lut[v] = uint16(math.Round(65535 * math.Pow(float64(v)/65535, exp)))
+	}
+	return c
+}
+
+// apply returns a copy of img with the curve applied to every colour sample, as a
+// Gray16 image for grayscale tiles and RGBA64 otherwise. Partially transparent
+// colour is unpremultiplied first, so the curve sees the colour rather than its
+// product with alpha.
+func (c *gammaCurve) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+	switch m := img.(type) {
+	case *image.Gray:
+		out := image.NewGray16(r)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				out.SetGray16(x, y, color.Gray16{c.lut[uint16(m.GrayAt(b.Min.X+x, b.Min.Y+y).Y)*0x101]})
+			}
+		}
+		return out
+	case *image.Gray16:
+		out := image.NewGray16(r)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				out.SetGray16(x, y, color.Gray16{c.lut[m.Gray16At(b.Min.X+x, b.Min.Y+y).Y]})
+			}
+		}
+		return out
+	}
+	out := image.NewRGBA64(r)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetRGBA64(x, y, c.rgba64(color.RGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)))
+		}
+	}
+	return out
+}
+
+// rgba64 applies the curve to the straight colour of px and premultiplies it again
+func (c *gammaCurve) rgba64(px color.RGBA64) color.RGBA64 {
+	r, g, bl := unpremultiply(px)
+	pre := func(v uint16) uint16 { return uint16(uint32(c.lut[v]) * uint32(px.A) / 0xffff) }
+	return color.RGBA64{pre(r), pre(g), pre(bl), px.A}
+}
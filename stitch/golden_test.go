@@ -0,0 +1,117 @@
+package stitch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	gotLines, wantLines := strings.Split(string(got), "\n"), strings.Split(string(want), "\n")
+	for i := range max(len(gotLines), len(wantLines)) {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			t.Fatalf("%s differs from line %d:\n got: %s\nwant: %s\n(rerun with -update if the change is intended)", path, i+1, g, w)
+		}
+	}
+}
+
+// TestUsageGolden pins the usage text of the command line, so that reorganizing
+// the flags cannot drop or reword one unnoticed
+func TestUsageGolden(t *testing.T) {
+	savedFlags, savedName := flag.CommandLine, os.Args[0]
+	defer func() { flag.CommandLine, os.Args[0] = savedFlags, savedName }()
+	var buf bytes.Buffer
+	flag.CommandLine = flag.NewFlagSet("stitchr", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(&buf)
+	os.Args[0] = "stitchr"
+	if err := run([]string{"-h"}, true); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("got error %v, want the help request", err)
+	}
+	checkGolden(t, "usage.golden", buf.Bytes())
+}
+
+// TestMosaicGolden stitches the synthetic grid through the command line with a
+// range of flag combinations and pins a hash of every file each run writes
+func TestMosaicGolden(t *testing.T) {
+	dir := t.TempDir()
+	writeSyntheticTiles(t, dir, synthScene(), "vertical", false)
+	cases := []struct {
+		name string
+		out  string
+		args []string
+	}{
+		{"sum", "mosaic.tif", nil},
+		{"average", "mosaic.tif", []string{"--blend", "average", "--compression", "none"}},
+		{"feather", "mosaic.tif", []string{"--blend", "feather", "--feather-width", "4", "--weightmap", "{out}/weights.tif", "--seam-mask", "{out}/seams.png"}},
+		{"taper", "mosaic.tif", []string{"--accumulate", "float", "--sum-taper", "4"}},
+		{"horizontal", "mosaic.tif", []string{"--snake", "horizontal", "--row-start", "right", "--blend", "none"}},
+		{"scaled", "mosaic.png", []string{"--output-scale", "0.5", "--bitdepth", "8", "--dither", "ordered"}},
+		{"downsampled", "mosaic.npy", []string{"--downsample", "2", "--histogram", "{out}/hist.csv", "--histogram-bins", "16"}},
+		{"oriented", "mosaic.tif", []string{"--out-rotate", "90", "--out-flip", "--align", "64", "--output-gamma", "2.2"}},
+		{"rows", "mosaic.tif", []string{"--export-rows", "{out}/rows", "--force-square-canvas", "center"}},
+		{"checkerboard", "mosaic.jpg", []string{"--qc", "checkerboard", "--quality", "80"}},
+	}
+	var got bytes.Buffer
+	for _, tc := range cases {
+		out := t.TempDir()
+		args := synthArgs(dir, filepath.Join(out, tc.out))
+		for _, a := range tc.args {
+			// side outputs go next to the mosaic
+			args = append(args, strings.ReplaceAll(a, "{out}", out))
+		}
+		if err := run(args, false); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err := filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(out, path)
+			fmt.Fprintf(&got, "%s %s %x\n", tc.name, filepath.ToSlash(rel), sha256.Sum256(data))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkGolden(t, "mosaics.golden", got.Bytes())
+}
@@ -0,0 +1,100 @@
+package stitch
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gridHints are grid settings found in a tile's metadata; zero rows or cols and
+// negative overlaps are absent
+type gridHints struct {
+	rows, cols         int
+	overlapX, overlapY int
+}
+
+// parseImageJGrid extracts grid hints from an ImageJ ImageDescription, which holds
+// one key=value pair per line after a leading "ImageJ=<version>" line. Keys are
+// matched ignoring case, underscores and dots: rows (or grid_rows, grid_size_y),
+// cols (columns, grid_cols, grid_size_x) and overlapX, overlapY or overlap for both,
+// in pixels. ok is false when desc is not ImageJ metadata or carries no hints.
+func parseImageJGrid(desc string) (h gridHints, ok bool) {
+	h = gridHints{overlapX: -1, overlapY: -1}
+	if !strings.HasPrefix(desc, "ImageJ=") {
+		return h, false
+	}
+	for _, line := range strings.Split(desc, "\n") {
+		key, val, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		key = strings.NewReplacer("_", "", ".", "", " ", "").Replace(strings.ToLower(key))
+		var dst []*int
+		switch key {
+		case "rows", "gridrows", "gridsizey":
+			dst = []*int{&h.rows}
+		case "cols", "columns", "gridcols", "gridcolumns", "gridsizex":
+			dst = []*int{&h.cols}
+		case "overlapx":
+			dst = []*int{&h.overlapX}
+		case "overlapy":
+			dst = []*int{&h.overlapY}
+		case "overlap":
+			dst = []*int{&h.overlapX, &h.overlapY}
+		default:
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || v < 0 {
+			slog.Debug("ignoring ImageJ grid hint", "key", key, "value", val)
+			continue
+		}
+		for _, d := range dst {
+			*d = v
+		}
+		ok = true
+	}
+	return h, ok
+}
+
+// imageJGrid reads the grid hints in the ImageJ metadata of the TIFF at path
+func imageJGrid(path string) (gridHints, bool) {
+	sr, f, err := openTIFF(path)
+	if err != nil {
+		return gridHints{}, false
+	}
+	defer f.Close()
+	d, err := readIFD(sr)
+	if err != nil {
+		return gridHints{}, false
+	}
+	desc, ok, err := d.text(tagDescription)
+	if !ok || err != nil {
+		return gridHints{}, false
+	}
+	return parseImageJGrid(desc)
+}
+
+// firstTile returns the first tile that --list, or --dir filtered by --regex,
+// selects, or "" when there is none or it is a URL. Listing errors are left for
+// the listing proper to report.
+func firstTile(dir, listFile, regexStr string) string {
+	var paths []string
+	if listFile != "" {
+		paths, _ = loadListFile(listFile)
+	} else if dir != "" {
+		var regex *regexp.Regexp
+		if regexStr != "" {
+			var err error
+			if regex, err = regexp.Compile(regexStr); err != nil {
+				return ""
+			}
+		}
+		paths, _ = getImagePaths(dir, regex)
+	}
+	if len(paths) == 0 || isURL(paths[0]) {
+		return ""
+	}
+	return paths[0]
+}
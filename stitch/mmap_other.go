@@ -0,0 +1,15 @@
+//go:build !unix
+
+package stitch
+
+import "errors"
+
+// mmapScratch is only available on unix systems
+func mmapScratch(dir string, size int) ([]byte, error) {
+	return nil, errors.New("--mmap-dir is not supported on this platform")
+}
+
+// munmap is only available on unix systems
+func munmap(b []byte) error {
+	return nil
+}
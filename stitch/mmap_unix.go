@@ -0,0 +1,35 @@
+//go:build unix
+
+package stitch
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapScratch maps size bytes of a new scratch file in dir, so the kernel can page
+// them out to disk. The file is unlinked straight away and its space is freed once
+// munmap releases the mapping.
+func mmapScratch(dir string, size int) ([]byte, error) {
+	f, err := os.CreateTemp(dir, "stitchr-*.canvas")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if err := f.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %v", f.Name(), err)
+	}
+	return b, nil
+}
+
+// munmap releases a mapping made by mmapScratch
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
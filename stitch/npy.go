@@ -0,0 +1,79 @@
+package stitch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// encodeNPY writes img as a NumPy .npy array (format version 1.0). Grayscale
+// images become (height, width) arrays and colour images (height, width, 3) RGB
+// arrays, or (height, width, 4) RGBA with straight alpha when not every pixel is
+// opaque, of uint16 for 16-bit images and uint8 for 8-bit ones.
+func encodeNPY(w io.Writer, img image.Image, _ EncodeOptions) error {
+	b := img.Bounds()
+	descr, channels := "<u2", 3
+	switch img.(type) {
+	case *image.Gray16:
+		channels = 1
+	case *image.Gray:
+		descr, channels = "|u1", 1
+	case *image.RGBA, *image.NRGBA:
+		descr = "|u1"
+	}
+	if o, ok := img.(interface{ Opaque() bool }); channels == 3 && (!ok || !o.Opaque()) {
+		channels = 4
+	}
+
+	shape := fmt.Sprintf("(%d, %d, %d)", b.Dy(), b.Dx(), channels)
+	if channels == 1 {
+		shape = fmt.Sprintf("(%d, %d)", b.Dy(), b.Dx())
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': %s, }", descr, shape)
+	// magic, version and length take 10 bytes; the header ends in a newline and the
+	// data starts on a 64-byte boundary
+	pad := 64 - (10+len(header)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	header += strings.Repeat(" ", pad) + "\n"
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(bw, binary.LittleEndian, uint16(len(header)))
+	bw.WriteString(header)
+
+	var buf [2]byte
+	put := func(v uint16) {
+		if descr == "|u1" {
+			bw.WriteByte(uint8(v >> 8))
+			return
+		}
+		binary.LittleEndian.PutUint16(buf[:], v)
+		bw.Write(buf[:])
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if channels == 1 {
+				put(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+				continue
+			}
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			put(c.R)
+			put(c.G)
+			put(c.B)
+			if channels == 4 {
+				put(c.A)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func init() {
+	RegisterEncoder("npy", EncoderFunc(encodeNPY), ".npy")
+}
@@ -0,0 +1,80 @@
+package stitch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// TestEncodeNPY reads back the header of the .npy written for each image type and
+// checks its dtype and shape, and that the data fills exactly that array
+func TestEncodeNPY(t *testing.T) {
+	const w, h = 5, 3
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = 0xff
+	}
+	translucent := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	for i := range translucent.Pix {
+		translucent.Pix[i] = 0xff
+	}
+	translucent.SetNRGBA64(2, 1, color.NRGBA64{R: 0x8000, G: 0x4000, B: 0x2000, A: 0x8000})
+	tests := []struct {
+		name  string
+		img   image.Image
+		descr string
+		shape string
+	}{
+		{"gray8", image.NewGray(image.Rect(0, 0, w, h)), "|u1", "(3, 5)"},
+		{"gray16", image.NewGray16(image.Rect(0, 0, w, h)), "<u2", "(3, 5)"},
+		{"rgb", rgba, "|u1", "(3, 5, 3)"},
+		{"rgba64 with alpha", translucent, "<u2", "(3, 5, 4)"},
+	}
+	header := regexp.MustCompile(`^\{'descr': '([^']+)', 'fortran_order': False, 'shape': (\([0-9, ]+\)), \} *\n$`)
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := encodeNPY(&buf, tt.img, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if string(data[:8]) != "\x93NUMPY\x01\x00" {
+			t.Fatalf("%s: bad magic %q", tt.name, data[:8])
+		}
+		n := int(binary.LittleEndian.Uint16(data[8:]))
+		if (10+n)%64 != 0 {
+			t.Errorf("%s: data starts at %d, not on a 64-byte boundary", tt.name, 10+n)
+		}
+		m := header.FindStringSubmatch(string(data[10 : 10+n]))
+		if m == nil {
+			t.Fatalf("%s: unexpected header %q", tt.name, data[10:10+n])
+		}
+		if m[1] != tt.descr || m[2] != tt.shape {
+			t.Errorf("%s: dtype %s shape %s, want %s %s", tt.name, m[1], m[2], tt.descr, tt.shape)
+		}
+		size, _ := strconv.Atoi(tt.descr[2:])
+		for _, d := range regexp.MustCompile(`\d+`).FindAllString(m[2], -1) {
+			v, _ := strconv.Atoi(d)
+			size *= v
+		}
+		if got := len(data) - 10 - n; got != size {
+			t.Errorf("%s: %d data bytes, want %d", tt.name, got, size)
+		}
+	}
+
+	// the translucent pixel keeps its straight colour next to its alpha
+	var buf bytes.Buffer
+	if err := encodeNPY(&buf, translucent, EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	px := data[10+int(binary.LittleEndian.Uint16(data[8:]))+(1*w+2)*4*2:]
+	for i, want := range []uint16{0x8000, 0x4000, 0x2000, 0x8000} {
+		if got := binary.LittleEndian.Uint16(px[2*i:]); got != want {
+			t.Errorf("channel %d of the translucent pixel is %#x, want %#x", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// bayer8 is the 8x8 ordered-dither threshold matrix
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// reduceDepth converts a 16-bit mosaic to 8 bits per channel.
+// dither selects none (rounding), floyd (Floyd–Steinberg) or ordered (Bayer 8x8).
+func reduceDepth(img image.Image, dither string) (image.Image, error) {
+	switch dither {
+	case "none", "floyd", "ordered":
+	default:
+		return nil, fmt.Errorf("invalid dither mode: %s (use none, floyd or ordered)", dither)
+	}
+
+	b := img.Bounds()
+	if src, ok := img.(*image.Gray16); ok {
+		dst := image.NewGray(b)
+		quantizePlane(b, dither,
+			func(x, y int) uint16 { return src.Gray16At(x, y).Y },
+			func(x, y int, v uint8) { dst.Pix[dst.PixOffset(x, y)] = v })
+		return dst, nil
+	}
+
+	src, ok := img.(*image.RGBA64)
+	if !ok {
+		src = image.NewRGBA64(b)
+		draw.Draw(src, b, img, b.Min, draw.Src)
+	}
+	dst := image.NewRGBA(b)
+	for c := 0; c < 4; c++ {
+		quantizePlane(b, dither,
+			func(x, y int) uint16 {
+				i := src.PixOffset(x, y) + 2*c
+				return uint16(src.Pix[i])<<8 | uint16(src.Pix[i+1])
+			},
+			func(x, y int, v uint8) { dst.Pix[dst.PixOffset(x, y)+c] = v })
+	}
+	return dst, nil
+}
+
+// quantizePlane reduces one 16-bit plane read through get to 8 bits written through set
+func quantizePlane(b image.Rectangle, dither string, get func(x, y int) uint16, set func(x, y int, v uint8)) {
+	quantize := func(v float64) uint8 {
+		q := v/257 + 0.5
+		if q <= 0 {
+			return 0
+		}
+		if q >= 255 {
+			return 255
+		}
+		return uint8(q)
+	}
+
+	switch dither {
+	case "none":
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				set(x, y, quantize(float64(get(x, y))))
+			}
+		}
+
+	case "ordered":
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				// shift by up to half an 8-bit step either way
+				offset := ((bayer8[(y-b.Min.Y)%8][(x-b.Min.X)%8]+0.5)/64 - 0.5) * 257
+				set(x, y, quantize(float64(get(x, y))+offset))
+			}
+		}
+
+	case "floyd":
+		// error carried into the current and next row, padded by one pixel each side
+		w := b.Dx()
+		cur := make([]float64, w+2)
+		next := make([]float64, w+2)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for i := 0; i < w; i++ {
+				x := b.Min.X + i
+				v := float64(get(x, y)) + cur[i+1]
+				q := quantize(v)
+				set(x, y, q)
+				e := v - float64(q)*257
+				cur[i+2] += e * 7 / 16
+				next[i] += e * 3 / 16
+				next[i+1] += e * 5 / 16
+				next[i+2] += e * 1 / 16
+			}
+			cur, next = next, cur
+			for i := range next {
+				next[i] = 0
+			}
+		}
+	}
+}
+
+// orient rotates img clockwise by rotate degrees (0, 90, 180 or 270) and, with flip,
+// then mirrors it left to right. Grayscale mosaics stay grayscale.
+func orient(img image.Image, rotate int, flip bool) (image.Image, error) {
+	switch rotate {
+	case 0, 90, 180, 270:
+	default:
+		return nil, fmt.Errorf("invalid rotation: %d (use 90, 180 or 270)", rotate)
+	}
+	if rotate == 0 && !flip {
+		return img, nil
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	r := image.Rect(0, 0, w, h)
+	if rotate == 90 || rotate == 270 {
+		r = image.Rect(0, 0, h, w)
+	}
+	var out draw.Image
+	if _, ok := img.(*image.Gray16); ok {
+		out = image.NewGray16(r)
+	} else {
+		out = image.NewRGBA64(r)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch rotate {
+			case 0:
+				dx, dy = x, y
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			if flip {
+				dx = r.Dx() - 1 - dx
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out, nil
+}
+
+// padSquare pads img with black to a square as wide as its longer side, keeping
+// it centred or, with anchor "top-left", in the top-left corner. Square images
+// are returned as they are.
+func padSquare(img image.Image, anchor string) image.Image {
+	b := img.Bounds()
+	if b.Dx() == b.Dy() {
+		return img
+	}
+	side := max(b.Dx(), b.Dy())
+	var off image.Point
+	if anchor == "center" {
+		off = image.Pt((side-b.Dx())/2, (side-b.Dy())/2)
+	}
+	// cropping past the image's edges leaves the new pixels black
+	at := b.Min.Sub(off)
+	return cropImage(img, image.Rectangle{Min: at, Max: at.Add(image.Pt(side, side))})
+}
+
+// padAlign pads img with black on the right and bottom to the next multiple of n
+// in each dimension, keeping the image in the top-left corner so that a viewer's
+// n x n tiles line up with it. Images already a multiple of n are returned as they are.
+func padAlign(img image.Image, n int) image.Image {
+	b := img.Bounds()
+	size := image.Pt((b.Dx()+n-1)/n*n, (b.Dy()+n-1)/n*n)
+	if size == b.Size() {
+		return img
+	}
+	return cropImage(img, image.Rectangle{Min: b.Min, Max: b.Min.Add(size)})
+}
+
+// parseSharpen parses an unsharp mask specification "amount,radius", e.g. "0.8,1.5"
+func parseSharpen(s string) (amount, radius float64, err error) {
+	a, r, ok := strings.Cut(s, ",")
+	if ok {
+		amount, err = strconv.ParseFloat(strings.TrimSpace(a), 64)
+		if err == nil {
+			radius, err = strconv.ParseFloat(strings.TrimSpace(r), 64)
+		}
+	}
+	if !ok || err != nil || amount <= 0 || radius <= 0 {
+		return 0, 0, fmt.Errorf("invalid sharpen %q (use amount,radius with both > 0)", s)
+	}
+	return amount, radius, nil
+}
+
+// gaussianKernel returns a normalized 1-D Gaussian with standard deviation sigma
+func gaussianKernel(sigma float64) []float64 {
+	half := int(math.Ceil(3 * sigma))
+	k := make([]float64, 2*half+1)
+	var sum float64
+	for i := range k {
+		d := float64(i - half)
+		k[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += k[i]
+	}
+	for i := range k {
+		k[i] /= sum
+	}
+	return k
+}
+
+// blurPlane applies a separable Gaussian blur to a w x h plane, clamping at the edges
+func blurPlane(p []float64, w, h int, k []float64) []float64 {
+	half := len(k) / 2
+	tmp := make([]float64, len(p))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var v float64
+			for i, kv := range k {
+				sx := min(max(x+i-half, 0), w-1)
+				v += kv * p[y*w+sx]
+			}
+			tmp[y*w+x] = v
+		}
+	}
+	out := make([]float64, len(p))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var v float64
+			for i, kv := range k {
+				sy := min(max(y+i-half, 0), h-1)
+				v += kv * tmp[sy*w+x]
+			}
+			out[y*w+x] = v
+		}
+	}
+	return out
+}
+
+// sharpen applies an unsharp mask, adding amount times the difference between each
+// pixel and its Gaussian blur of the given radius. Values are clamped to 16 bits and
+// grayscale mosaics stay grayscale; alpha is left unchanged.
+func sharpen(img image.Image, amount, radius float64) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	k := gaussianKernel(radius)
+	mask := func(get func(x, y int) uint16, set func(x, y int, v uint16)) {
+		p := make([]float64, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				p[y*w+x] = float64(get(x, y))
+			}
+		}
+		blurred := blurPlane(p, w, h, k)
+		for i, v := range p {
+			set(i%w, i/w, clamp16(v+amount*(v-blurred[i])))
+		}
+	}
+
+	if g, ok := img.(*image.Gray16); ok {
+		out := image.NewGray16(image.Rect(0, 0, w, h))
+		mask(func(x, y int) uint16 { return g.Gray16At(b.Min.X+x, b.Min.Y+y).Y },
+			func(x, y int, v uint16) { out.SetGray16(x, y, color.Gray16{v}) })
+		return out
+	}
+	src := image.NewRGBA64(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	out := image.NewRGBA64(src.Bounds())
+	copy(out.Pix, src.Pix)
+	for c := 0; c < 3; c++ {
+		mask(func(x, y int) uint16 { return channel16(src.RGBA64At(x, y), c) },
+			func(x, y int, v uint16) {
+				px := out.RGBA64At(x, y)
+				// keep premultiplied colour within alpha
+				v = min(v, px.A)
+				switch c {
+				case 0:
+					px.R = v
+				case 1:
+					px.G = v
+				default:
+					px.B = v
+				}
+				out.SetRGBA64(x, y, px)
+			})
+	}
+	return out
+}
+
+// autocropBounds returns the smallest rectangle holding every pixel of imgs with
+// a sample above threshold (in 16-bit units). When coverage is given, pixels it
+// shows no tile reached are skipped without being read. The rectangle is empty
+// when no pixel qualifies.
+func autocropBounds(imgs []image.Image, coverage *image.Gray16, threshold float64) image.Rectangle {
+	var r image.Rectangle
+	for _, img := range imgs {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if coverage != nil && coverage.Gray16At(x, y).Y == 0 {
+					continue
+				}
+				if image.Pt(x, y).In(r) {
+					continue
+				}
+				var v uint16
+				if g, ok := img.(*image.Gray16); ok {
+					v = g.Gray16At(x, y).Y
+				} else {
+					c := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+					v = max(c.R, c.G, c.B)
+				}
+				if float64(v) > threshold {
+					r = r.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+	}
+	return r
+}
+
+// cropImage copies the r part of img into a new image of the same kind with its
+// origin at 0,0
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	var dst draw.Image
+	switch img.(type) {
+	case *image.Gray16:
+		dst = image.NewGray16(image.Rect(0, 0, r.Dx(), r.Dy()))
+	case *image.Gray:
+		dst = image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+	default:
+		dst = image.NewRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	}
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// imageStats returns the minimum, maximum and mean sample of img in its own bit
+// depth. Colour images are measured over their red, green and blue samples.
+func imageStats(img image.Image) (lo, hi int, mean float64) {
+	b := img.Bounds()
+	lo = math.MaxInt
+	var sum float64
+	n := 0
+	add := func(v int) {
+		lo, hi = min(lo, v), max(hi, v)
+		sum += float64(v)
+		n++
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch m := img.(type) {
+			case *image.Gray16:
+				add(int(m.Gray16At(x, y).Y))
+			case *image.Gray:
+				add(int(m.GrayAt(x, y).Y))
+			case *image.RGBA:
+				px := m.RGBAAt(x, y)
+				add(int(px.R))
+				add(int(px.G))
+				add(int(px.B))
+			default:
+				px := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+				add(int(px.R))
+				add(int(px.G))
+				add(int(px.B))
+			}
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return lo, hi, sum / float64(n)
+}
+
+// channel16 returns the red, green or blue component (c = 0, 1, 2) of px
+func channel16(px color.RGBA64, c int) uint16 {
+	switch c {
+	case 0:
+		return px.R
+	case 1:
+		return px.G
+	}
+	return px.B
+}
+
+// fitDownsample returns the smallest downsample factor at which a rows x cols grid
+// of w x h tiles overlapping by overlapX, overlapY pixels makes a mosaic whose
+// long edge is at most maxDim pixels. Sizes and overlaps are rounded as loadTiles
+// rounds them.
+func fitDownsample(w, h, overlapX, overlapY, rows, cols, maxDim int) (int, error) {
+	for ds := 1; ds <= min(w, h); ds++ {
+		tw, th, ox, oy := scaledPx(w, ds), scaledPx(h, ds), scaledPx(overlapX, ds), scaledPx(overlapY, ds)
+		cw, ch := cols*(tw-ox)+ox, rows*(th-oy)+oy
+		if max(cw, ch) <= maxDim {
+			return ds, nil
+		}
+	}
+	return 0, fmt.Errorf("no downsample factor fits the %dx%d grid of %dx%d tiles in %d pixels", rows, cols, w, h, maxDim)
+}
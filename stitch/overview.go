@@ -0,0 +1,162 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/nfnt/resize"
+)
+
+// overviewMinNCC is the match score below which a tile's overview placement is
+// reported as unreliable
+const overviewMinNCC = 0.5
+
+// grayPlane is a grayscale image as float samples, row-major
+type grayPlane struct {
+	w, h int
+	p    []float64
+}
+
+// newGrayPlane converts img to a grayPlane
+func newGrayPlane(img image.Image) grayPlane {
+	g := toGray16(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	p := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p[y*w+x] = float64(g.Gray16At(x, y).Y)
+		}
+	}
+	return grayPlane{w, h, p}
+}
+
+// shrink box-averages the plane by an integer factor
+func (g grayPlane) shrink(f int) grayPlane {
+	if f <= 1 {
+		return g
+	}
+	w, h := g.w/f, g.h/f
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			for dy := 0; dy < f; dy++ {
+				for dx := 0; dx < f; dx++ {
+					sum += g.p[(y*f+dy)*g.w+x*f+dx]
+				}
+			}
+			out[y*w+x] = sum / float64(f*f)
+		}
+	}
+	return grayPlane{w, h, out}
+}
+
+// ncc returns the normalized cross-correlation of tmpl with the window of g whose
+// top-left corner is (x0, y0); flat windows or templates score 0
+func (g grayPlane) ncc(tmpl grayPlane, x0, y0 int) float64 {
+	var sa, sb, saa, sbb, sab float64
+	for y := 0; y < tmpl.h; y++ {
+		row := (y0+y)*g.w + x0
+		for x := 0; x < tmpl.w; x++ {
+			a, b := g.p[row+x], tmpl.p[y*tmpl.w+x]
+			sa += a
+			sb += b
+			saa += a * a
+			sbb += b * b
+			sab += a * b
+		}
+	}
+	n := float64(tmpl.w * tmpl.h)
+	cov := sab - sa*sb/n
+	va, vb := saa-sa*sa/n, sbb-sb*sb/n
+	if va <= 0 || vb <= 0 {
+		return 0
+	}
+	return cov / math.Sqrt(va*vb)
+}
+
+// bestMatch searches the windows of g with top-left corners in r for the best
+// correlation with tmpl
+func (g grayPlane) bestMatch(tmpl grayPlane, r image.Rectangle) (image.Point, float64) {
+	r = r.Intersect(image.Rect(0, 0, g.w-tmpl.w+1, g.h-tmpl.h+1))
+	best, score := r.Min, math.Inf(-1)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if s := g.ncc(tmpl, x, y); s > score {
+				best, score = image.Pt(x, y), s
+			}
+		}
+	}
+	return best, score
+}
+
+// matchOverview finds where tile lies in the overview, which has scale overview
+// pixels per tile pixel. The tile is searched for at a coarse resolution over the
+// whole overview and then refined at full overview resolution. It returns the
+// tile's top-left corner in tile pixels and the correlation of the match. filter
+// shrinks the tile to the overview scale.
+func matchOverview(overview grayPlane, tile image.Image, scale float64, filter resize.InterpolationFunction) (position, float64, error) {
+	b := tile.Bounds()
+	tw := int(math.Round(float64(b.Dx()) * scale))
+	th := int(math.Round(float64(b.Dy()) * scale))
+	if tw < 4 || th < 4 {
+		return position{}, 0, fmt.Errorf("the %v tile is only %dx%d pixels at the overview scale", b.Size(), tw, th)
+	}
+	if tw > overview.w || th > overview.h {
+		return position{}, 0, fmt.Errorf("the tile (%dx%d at the overview scale) is larger than the %dx%d overview", tw, th, overview.w, overview.h)
+	}
+	tmpl := newGrayPlane(resize.Resize(uint(tw), uint(th), tile, filter))
+
+	// keep the coarse template at about 16 pixels across
+	f := max(min(tw, th)/16, 1)
+	coarse, _ := overview.shrink(f).bestMatch(tmpl.shrink(f), image.Rect(0, 0, overview.w, overview.h))
+	at := coarse.Mul(f)
+	pt, score := overview.bestMatch(tmpl, image.Rect(at.X-f, at.Y-f, at.X+f+1, at.Y+f+1))
+	x := float64(pt.X) + overview.peakOffset(tmpl, pt, image.Pt(1, 0), score)
+	y := float64(pt.Y) + overview.peakOffset(tmpl, pt, image.Pt(0, 1), score)
+	return position{x / scale, y / scale}, score, nil
+}
+
+// peakOffset refines a correlation peak at pt along the unit step d to sub-pixel
+// precision by fitting a parabola through it and its two neighbours
+func (g grayPlane) peakOffset(tmpl grayPlane, pt, d image.Point, peak float64) float64 {
+	lo, hi := pt.Sub(d), pt.Add(d)
+	if lo.X < 0 || lo.Y < 0 || hi.X > g.w-tmpl.w || hi.Y > g.h-tmpl.h {
+		return 0
+	}
+	a, c := g.ncc(tmpl, lo.X, lo.Y), g.ncc(tmpl, hi.X, hi.Y)
+	den := a - 2*peak + c
+	if den >= 0 {
+		return 0
+	}
+	return max(-0.5, min(0.5, (a-c)/(2*den)))
+}
+
+// overviewPositions places each tile by matching it against the overview image at
+// path. Tiles are downsampled by downsample, so positions are returned in input
+// pixels; overviewScale is overview pixels per input pixel. filter resamples the
+// tiles to the overview scale. A remote overview is fetched through client.
+func overviewPositions(imgs []image.Image, paths []string, path string, overviewScale float64, downsample int, filter resize.InterpolationFunction, client *http.Client) ([]position, error) {
+	img, err := loadTIFF(path, client)
+	if err != nil {
+		return nil, fmt.Errorf("overview %w", err)
+	}
+	overview := newGrayPlane(img)
+	scale := overviewScale * float64(downsample)
+	pos := make([]position, len(imgs))
+	for i, tile := range imgs {
+		p, score, err := matchOverview(overview, tile, scale, filter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", paths[i], err)
+		}
+		pos[i] = position{p.X * float64(downsample), p.Y * float64(downsample)}
+		slog.Debug("matched tile to overview", "path", paths[i], "x", pos[i].X, "y", pos[i].Y, "ncc", score)
+		if score < overviewMinNCC {
+			slog.Warn("weak overview match", "path", paths[i], "ncc", score, "x", pos[i].X, "y", pos[i].Y)
+		}
+	}
+	return pos, nil
+}
@@ -0,0 +1,71 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// defaultCellRegex matches a grid cell encoded in a tile name as r<row>c<col>,
+// e.g. "scan_r02_c03.tif" or "r2c3.tif"
+const defaultCellRegex = `(?i)r(\d+)[_-]?c(\d+)`
+
+// cellsFromNames reads each tile's (col,row) cell from its base name with re, whose
+// groups named row and col, or else its first and second groups, hold the indices
+// counted from base. Every name must match, and the cells must be distinct and
+// inside the rows x cols grid.
+func cellsFromNames(paths []string, re *regexp.Regexp, base, rows, cols int) ([]image.Point, error) {
+	rowGroup, colGroup := re.SubexpIndex("row"), re.SubexpIndex("col")
+	if rowGroup < 0 || colGroup < 0 {
+		if re.NumSubexp() < 2 {
+			return nil, fmt.Errorf("cell regex %q needs a row and a column group", re)
+		}
+		rowGroup, colGroup = 1, 2
+	}
+	cells := make([]image.Point, len(paths))
+	seen := make(map[image.Point]string)
+	for i, p := range paths {
+		name := filepath.Base(p)
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			return nil, fmt.Errorf("%s: name does not match the cell regex %q", p, re)
+		}
+		r, errR := strconv.Atoi(m[rowGroup])
+		c, errC := strconv.Atoi(m[colGroup])
+		if errR != nil || errC != nil {
+			return nil, fmt.Errorf("%s: invalid cell %q, %q", p, m[rowGroup], m[colGroup])
+		}
+		cell := image.Pt(c-base, r-base)
+		if cell.X < 0 || cell.X >= cols || cell.Y < 0 || cell.Y >= rows {
+			return nil, fmt.Errorf("%w: %s names row %d, col %d outside the %dx%d grid", ErrGridMismatch, p, r, c, rows, cols)
+		}
+		if other, dup := seen[cell]; dup {
+			return nil, fmt.Errorf("%w: %s and %s both name row %d, col %d", ErrGridMismatch, other, p, r, c)
+		}
+		seen[cell] = p
+		cells[i] = cell
+	}
+	return cells, nil
+}
+
+// fillGrid extends the cells of the tiles present with the grid's empty cells, in
+// row-major order, and reports which of the returned cells have no tile
+func fillGrid(cells []image.Point, rows, cols int) ([]image.Point, []bool) {
+	taken := make(map[image.Point]bool, len(cells))
+	for _, c := range cells {
+		taken[c] = true
+	}
+	all := append([]image.Point(nil), cells...)
+	missing := make([]bool, len(cells), rows*cols)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			if c := image.Pt(x, y); !taken[c] {
+				all = append(all, c)
+				missing = append(missing, true)
+			}
+		}
+	}
+	return all, missing
+}
@@ -0,0 +1,241 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// position is a tile's top-left corner in input (full-resolution) pixels
+type position struct {
+	X, Y float64
+}
+
+// loadPositions reads tile placements from a text file with one "<file> <x> <y>"
+// entry per line, or from a Fiji TileConfiguration.txt with "<file>; ; (x, y)"
+// entries. Coordinates may be negative or fractional; a Fiji z coordinate is
+// ignored. Blank lines, lines starting with # and Fiji's "dim = n" are ignored.
+func loadPositions(filename string) (map[string]position, error) {
+	names, pos, err := loadPlacements(filename)
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[string]position, len(names))
+	for i, name := range names {
+		positions[name] = pos[i]
+	}
+	return positions, nil
+}
+
+// loadPlacements reads a positions file like loadPositions, keeping the entries
+// in file order
+func loadPlacements(filename string) ([]string, []position, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	var positions []position
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, _, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "dim" {
+			continue
+		}
+		if strings.Contains(line, ";") {
+			name, p, err := parseFijiEntry(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+			}
+			names, positions = append(names, name), append(positions, p)
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, nil, fmt.Errorf("%s:%d: expected \"<file> <x> <y>\"", filename, lineNo)
+		}
+		// the coordinates are the last two fields so file names may contain spaces
+		x, errX := strconv.ParseFloat(fields[len(fields)-2], 64)
+		y, errY := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if errX != nil || errY != nil {
+			return nil, nil, fmt.Errorf("%s:%d: invalid coordinates %q %q", filename, lineNo, fields[len(fields)-2], fields[len(fields)-1])
+		}
+		name := strings.Join(fields[:len(fields)-2], " ")
+		names, positions = append(names, name), append(positions, position{x, y})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return names, positions, nil
+}
+
+// loadTileFile reads the tiles and their positions from a --tiles file, laid out
+// like a positions file, in file order. Relative paths are resolved against the
+// file's directory, as Fiji does for TileConfiguration.txt. A tile may be listed
+// only once.
+func loadTileFile(filename string) ([]string, []position, error) {
+	names, pos, err := loadPlacements(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no tiles listed in %s", filename)
+	}
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if !isURL(name) && !filepath.IsAbs(name) {
+			names[i] = filepath.Join(filepath.Dir(filename), name)
+		}
+		if seen[names[i]] {
+			return nil, nil, fmt.Errorf("%s: %s is listed more than once", filename, name)
+		}
+		seen[names[i]] = true
+	}
+	return names, pos, nil
+}
+
+// parseFijiEntry parses a TileConfiguration.txt line "<file>; <series>; (x, y[, z])"
+func parseFijiEntry(line string) (string, position, error) {
+	parts := strings.Split(line, ";")
+	if len(parts) != 3 {
+		return "", position{}, fmt.Errorf("expected \"<file>; ; (x, y)\"")
+	}
+	name := strings.TrimSpace(parts[0])
+	coords := strings.TrimSpace(parts[2])
+	if name == "" || !strings.HasPrefix(coords, "(") || !strings.HasSuffix(coords, ")") {
+		return "", position{}, fmt.Errorf("expected \"<file>; ; (x, y)\"")
+	}
+	xyz := strings.Split(coords[1:len(coords)-1], ",")
+	if len(xyz) != 2 && len(xyz) != 3 {
+		return "", position{}, fmt.Errorf("invalid coordinates %s", coords)
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(xyz[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(xyz[1]), 64)
+	if errX != nil || errY != nil {
+		return "", position{}, fmt.Errorf("invalid coordinates %s", coords)
+	}
+	return name, position{x, y}, nil
+}
+
+// writeTileConfig writes placements as a Fiji TileConfiguration.txt, naming each
+// tile by its base name so the file can sit next to the tiles
+func writeTileConfig(filename string, paths []string, pos []position) error {
+	return writeOutput(filename, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		fmt.Fprintln(w, "# Define the number of dimensions we are working on")
+		fmt.Fprintln(w, "dim = 2")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "# Define the image coordinates")
+		// Fiji writes coordinates as decimals, e.g. 921.0
+		coord := func(v float64) string {
+			s := strconv.FormatFloat(v, 'f', -1, 64)
+			if !strings.Contains(s, ".") {
+				s += ".0"
+			}
+			return s
+		}
+		for i, p := range paths {
+			fmt.Fprintf(w, "%s; ; (%s, %s)\n", filepath.Base(p), coord(pos[i].X), coord(pos[i].Y))
+		}
+		return w.Flush()
+	})
+}
+
+// lookupPosition finds the position of path by full path, then by base name
+func lookupPosition(positions map[string]position, path string) (position, bool) {
+	if p, ok := positions[path]; ok {
+		return p, true
+	}
+	p, ok := positions[filepath.Base(path)]
+	return p, ok
+}
+
+// scalePositions converts positions to pixel offsets in tiles downsampled by factor
+func scalePositions(pos []position, factor int) []image.Point {
+	pts := make([]image.Point, len(pos))
+	for i, p := range pos {
+		pts[i] = image.Pt(int(math.Round(p.X/float64(factor))), int(math.Round(p.Y/float64(factor))))
+	}
+	return pts
+}
+
+// loadPixelSizes reads per-tile pixel sizes in micrometres from a text file with one
+// "<file> <size>" entry per line. Blank lines and lines starting with # are ignored.
+func loadPixelSizes(filename string) (map[string]float64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sizes := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<file> <pixel size>\"", filename, lineNo)
+		}
+		// the size is the last field so file names may contain spaces
+		s, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil || s <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid pixel size %q", filename, lineNo, fields[len(fields)-1])
+		}
+		sizes[strings.Join(fields[:len(fields)-1], " ")] = s
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// physicalToPixels converts positions given in micrometres to pixels of the given size
+func physicalToPixels(pos []position, pixelSizeUM float64) []position {
+	out := make([]position, len(pos))
+	for i, p := range pos {
+		out[i] = position{p.X / pixelSizeUM, p.Y / pixelSizeUM}
+	}
+	return out
+}
+
+// rescaleTiles resamples each tile whose pixel size differs from the canvas pixel
+// size so that all tiles share the canvas resolution. Tiles missing from sizes are
+// taken to be at the canvas resolution.
+func rescaleTiles(imgs []image.Image, paths []string, sizes map[string]float64, canvasUM float64, filter resize.InterpolationFunction) {
+	for i, img := range imgs {
+		s, ok := sizes[paths[i]]
+		if !ok {
+			s, ok = sizes[filepath.Base(paths[i])]
+		}
+		if !ok || s == canvasUM {
+			continue
+		}
+		f := s / canvasUM
+		b := img.Bounds()
+		w := max(uint(math.Round(float64(b.Dx())*f)), 1)
+		h := max(uint(math.Round(float64(b.Dy())*f)), 1)
+		slog.Debug("rescaling tile to canvas resolution", "path", paths[i], "pixelsize", s, "from", b.Size(), "to", image.Pt(int(w), int(h)))
+		imgs[i] = resize.Resize(w, h, img, filter)
+	}
+}
@@ -0,0 +1,333 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// toGray16 converts img to a 16-bit grayscale image with bounds starting at (0,0)
+func toGray16(img image.Image) *image.Gray16 {
+	if g, ok := img.(*image.Gray16); ok && g.Rect.Min == (image.Point{}) {
+		return g
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray16(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray.Set(x, y, color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)))
+		}
+	}
+	return gray
+}
+
+// resampleFilters are the interpolation filters accepted by --input-filter,
+// --output-filter and --register-filter
+var resampleFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// parseFilter looks up a resampling filter by name
+func parseFilter(name string) (resize.InterpolationFunction, error) {
+	f, ok := resampleFilters[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid filter %q (use nearest, bilinear, bicubic, mitchell, lanczos2 or lanczos3)", name)
+	}
+	return f, nil
+}
+
+// parsePercentiles parses a "low,high" percentile window such as "1,99"
+func parsePercentiles(s string) (low, high float64, err error) {
+	lo, hi, ok := strings.Cut(s, ",")
+	if ok {
+		low, err = strconv.ParseFloat(strings.TrimSpace(lo), 64)
+		if err == nil {
+			high, err = strconv.ParseFloat(strings.TrimSpace(hi), 64)
+		}
+	}
+	if !ok || err != nil || low < 0 || high > 100 || low >= high {
+		return 0, 0, fmt.Errorf("invalid percentile window %q (use low,high with 0 <= low < high <= 100)", s)
+	}
+	return low, high, nil
+}
+
+// percentiles returns the pixel values of img at the low and high percentiles
+func percentiles(img *image.Gray16, low, high float64) (float64, float64) {
+	var hist [65536]int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[img.Gray16At(x, y).Y]++
+		}
+	}
+	total := b.Dx() * b.Dy()
+	at := func(p float64) float64 {
+		target := int(p / 100 * float64(total-1))
+		count := 0
+		for v, n := range hist {
+			count += n
+			if count > target {
+				return float64(v)
+			}
+		}
+		return 65535
+	}
+	return at(low), at(high)
+}
+
+// normalizeTiles rescales each tile linearly so its low/high percentiles land on
+// the mean percentile values across all tiles, evening out brightness between
+// tiles before blending. The percentiles of colour tiles are taken from their
+// luminance and the same mapping is applied to each channel, so colour is kept.
+// Tiles with skip[i] set are left untouched.
+func normalizeTiles(imgs []image.Image, skip map[int]bool, low, high float64) {
+	type window struct{ lo, hi float64 }
+	windows := make([]window, len(imgs))
+	var target window
+	count := 0
+	for i, img := range imgs {
+		if skip[i] {
+			continue
+		}
+		g := toGray16(img)
+		if _, ok := img.(*image.Gray); ok {
+			imgs[i] = g
+		}
+		lo, hi := percentiles(g, low, high)
+		windows[i] = window{lo, hi}
+		target.lo += lo
+		target.hi += hi
+		count++
+	}
+	if count == 0 {
+		return
+	}
+	target.lo /= float64(count)
+	target.hi /= float64(count)
+
+	for i, img := range imgs {
+		if skip[i] {
+			continue
+		}
+		w := windows[i]
+		if w.hi <= w.lo {
+			continue // flat tile, nothing to stretch
+		}
+		scale := (target.hi - target.lo) / (w.hi - w.lo)
+		stretch := func(v uint16) uint16 { return clamp16((float64(v)-w.lo)*scale + target.lo + 0.5) }
+		if g, ok := img.(*image.Gray16); ok {
+			b := g.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					g.SetGray16(x, y, color.Gray16{stretch(g.Gray16At(x, y).Y)})
+				}
+			}
+			continue
+		}
+		// the straight colour is stretched and premultiplied again, as for --input-gamma
+		b := img.Bounds()
+		out := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				px := color.RGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)
+				r, g, bl := unpremultiply(px)
+				pre := func(v uint16) uint16 { return uint16(uint32(stretch(v)) * uint32(px.A) / 0xffff) }
+				out.SetRGBA64(x, y, color.RGBA64{pre(r), pre(g), pre(bl), px.A})
+			}
+		}
+		imgs[i] = out
+	}
+}
+
+// clamp16 clamps v to the uint16 range
+func clamp16(v float64) uint16 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 65535 {
+		return 65535
+	}
+	return uint16(v)
+}
+
+// tileDepth returns the bits per channel of a decoded tile
+func tileDepth(img image.Image) int {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// toWorkingDepth promotes an 8-bit tile to the 16-bit working depth, keeping it
+// grayscale or colour as decoded. The pixel values do not change: color.Gray16Model
+// already maps 8-bit full scale onto 16-bit full scale, so this only gives every
+// tile the same image type.
+func toWorkingDepth(img image.Image) image.Image {
+	if tileDepth(img) == 16 {
+		return img
+	}
+	switch img.(type) {
+	case *image.Gray:
+		return toGray16(img)
+	}
+	b := img.Bounds()
+	out := image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// checkDepths detects tiles whose decoded depths differ. A mix is an error unless
+// promote is set, when it is reported and the 8-bit tiles are promoted to the
+// 16-bit working depth. Tiles with skip[i] set are ignored.
+func checkDepths(imgs []image.Image, depths []int, paths []string, skip map[int]bool, promote bool) error {
+	byDepth := make(map[int][]string)
+	for i := range imgs {
+		if !skip[i] {
+			byDepth[depths[i]] = append(byDepth[depths[i]], paths[i])
+		}
+	}
+	if len(byDepth) < 2 {
+		return nil
+	}
+	if !promote {
+		return fmt.Errorf("tiles mix bit depths: %d are 8-bit (first %s), %d are 16-bit (first %s); convert them to one depth, or add --promote-depth to promote the 8-bit tiles to 16-bit",
+			len(byDepth[8]), byDepth[8][0], len(byDepth[16]), byDepth[16][0])
+	}
+	slog.Warn("tiles mix bit depths; promoting 8-bit tiles to 16-bit", "8bit", len(byDepth[8]), "16bit", len(byDepth[16]),
+		"first_8bit", byDepth[8][0], "first_16bit", byDepth[16][0])
+	for _, p := range byDepth[8] {
+		slog.Debug("8-bit tile", "path", p)
+	}
+	for i, img := range imgs {
+		if !skip[i] {
+			imgs[i] = toWorkingDepth(img)
+		}
+	}
+	return nil
+}
+
+// denoiseSpec is a per-tile denoising filter: a median over a size x size window,
+// or a Gaussian blur with standard deviation size
+type denoiseSpec struct {
+	kind string // median or gaussian
+	size float64
+}
+
+// parseDenoise parses --denoise, e.g. "median:3" or "gaussian:1.0"
+func parseDenoise(s string) (denoiseSpec, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	size, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+	switch {
+	case kind == "median" && err == nil && size >= 3 && size == float64(int(size)) && int(size)%2 == 1:
+	case kind == "gaussian" && err == nil && size > 0:
+	default:
+		return denoiseSpec{}, fmt.Errorf("invalid denoise %q (use median:N with odd N >= 3, or gaussian:sigma with sigma > 0)", s)
+	}
+	return denoiseSpec{kind, size}, nil
+}
+
+// apply filters img, keeping its bit depth: 16-bit and 8-bit grayscale tiles stay
+// as they are and colour tiles are filtered per channel with alpha unchanged
+func (d denoiseSpec) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	filter := func(p []float64) []float64 {
+		if d.kind == "median" {
+			return medianPlane(p, w, h, int(d.size)/2)
+		}
+		return blurPlane(p, w, h, gaussianKernel(d.size))
+	}
+	// plane filters the values get returns for tile-relative coordinates
+	plane := func(get func(x, y int) float64) []float64 {
+		p := make([]float64, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				p[y*w+x] = get(x, y)
+			}
+		}
+		return filter(p)
+	}
+
+	r := image.Rect(0, 0, w, h)
+	switch src := img.(type) {
+	case *image.Gray16:
+		p := plane(func(x, y int) float64 { return float64(src.Gray16At(b.Min.X+x, b.Min.Y+y).Y) })
+		out := image.NewGray16(r)
+		for i, v := range p {
+			out.SetGray16(i%w, i/w, color.Gray16{clamp16(v + 0.5)})
+		}
+		return out
+	case *image.Gray:
+		p := plane(func(x, y int) float64 { return float64(src.GrayAt(b.Min.X+x, b.Min.Y+y).Y) })
+		out := image.NewGray(r)
+		for i, v := range p {
+			out.SetGray(i%w, i/w, color.Gray{uint8(min(clamp16(v+0.5), 255))})
+		}
+		return out
+	}
+	rgba := image.NewRGBA64(r)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			rgba.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	out := image.NewRGBA64(r)
+	copy(out.Pix, rgba.Pix)
+	for c := 0; c < 3; c++ {
+		p := plane(func(x, y int) float64 { return float64(channel16(rgba.RGBA64At(x, y), c)) })
+		for i, v := range p {
+			px := out.RGBA64At(i%w, i/w)
+			// keep premultiplied colour within alpha
+			v := min(clamp16(v+0.5), px.A)
+			switch c {
+			case 0:
+				px.R = v
+			case 1:
+				px.G = v
+			default:
+				px.B = v
+			}
+			out.SetRGBA64(i%w, i/w, px)
+		}
+	}
+	return out
+}
+
+// medianPlane replaces each pixel of a w x h plane by the median of the
+// (2*radius+1)² window around it, clamping at the edges
+func medianPlane(p []float64, w, h, radius int) []float64 {
+	out := make([]float64, len(p))
+	win := make([]float64, 0, (2*radius+1)*(2*radius+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			win = win[:0]
+			for dy := -radius; dy <= radius; dy++ {
+				sy := min(max(y+dy, 0), h-1)
+				for dx := -radius; dx <= radius; dx++ {
+					sx := min(max(x+dx, 0), w-1)
+					win = append(win, p[sy*w+sx])
+				}
+			}
+			slices.Sort(win)
+			out[y*w+x] = win[len(win)/2]
+		}
+	}
+	return out
+}
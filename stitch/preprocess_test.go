@@ -0,0 +1,49 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMixedDepths checks that a grid mixing 8-bit and 16-bit tiles fails by
+// default, and that with promoteDepth the 8-bit tiles load as 16-bit with the
+// same full-scale values they already had
+func TestMixedDepths(t *testing.T) {
+	dir := t.TempDir()
+	gray8 := image.NewGray(image.Rect(0, 0, 8, 6))
+	gray16 := image.NewGray16(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			gray8.SetGray(x, y, color.Gray{100})
+			gray16.SetGray16(x, y, color.Gray16{100 * 0x101})
+		}
+	}
+	paths := []string{filepath.Join(dir, "tile-1_a.tif"), filepath.Join(dir, "tile-2_a.tif")}
+	for i, img := range []image.Image{gray16, gray8} {
+		if err := encodeFile(paths[i], encoders["tiff"], img, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := loadTiles(paths, loadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "tiles mix bit depths") || !strings.Contains(err.Error(), "--promote-depth") {
+		t.Errorf("by default: got error %v, want the mix reported with the remedy", err)
+	}
+
+	imgs, err := loadTiles(paths, loadOptions{promoteDepth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, img := range imgs {
+		g, ok := img.(*image.Gray16)
+		if !ok {
+			t.Fatalf("tile %d loaded as %T, want *image.Gray16", i, img)
+		}
+		if v := g.Gray16At(3, 3).Y; v != 100*0x101 {
+			t.Errorf("tile %d: pixel is %d, want %d", i, v, 100*0x101)
+		}
+	}
+}
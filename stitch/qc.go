@@ -0,0 +1,302 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+)
+
+// seamScore describes how well two neighbouring tiles agree in their overlap
+type seamScore struct {
+	a, b int    // tile indices
+	axis string // x for a left/right seam, y for top/bottom
+	ncc  float64
+	mad  float64
+}
+
+// seamNCC returns the normalized cross-correlation of the overlapping strips of two
+// neighbouring tiles, laid out as for overlapStrip. Flat strips have no defined
+// correlation and score 1 when identical and 0 otherwise.
+func seamNCC(a, b *image.Gray16, overlap int, horizontal bool) float64 {
+	var sa, sb, saa, sbb, sab, n float64
+	overlapStrip(a, b, overlap, horizontal, func(va, vb float64) {
+		sa += va
+		sb += vb
+		saa += va * va
+		sbb += vb * vb
+		sab += va * vb
+		n++
+	})
+	if n == 0 {
+		return 0
+	}
+	cov := sab - sa*sb/n
+	varA := saa - sa*sa/n
+	varB := sbb - sb*sb/n
+	if varA <= 0 || varB <= 0 {
+		if seamMismatch(a, b, overlap, horizontal) == 0 {
+			return 1
+		}
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
+
+// seamScores scores every seam between neighbouring cells. An axis whose overlap
+// is zero has no strip to compare and is skipped.
+func seamScores(tiles []*image.Gray16, cells []image.Point, overlapX, overlapY int) []seamScore {
+	var scores []seamScore
+	for _, axis := range []struct {
+		name       string
+		overlap    int
+		horizontal bool
+	}{{"x", overlapX, true}, {"y", overlapY, false}} {
+		if axis.overlap <= 0 {
+			continue
+		}
+		for _, p := range neighbourPairs(cells, axis.horizontal) {
+			a, b := tiles[p[0]], tiles[p[1]]
+			scores = append(scores, seamScore{
+				a: p[0], b: p[1], axis: axis.name,
+				ncc: seamNCC(a, b, axis.overlap, axis.horizontal),
+				mad: seamMismatch(a, b, axis.overlap, axis.horizontal),
+			})
+		}
+	}
+	return scores
+}
+
+// writeSeamReport writes one tab-separated line per seam: both tile names, the
+// axis, the correlation and the mean absolute difference
+func writeSeamReport(path string, paths []string, scores []seamScore) error {
+	return writeOutput(path, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		fmt.Fprintln(w, "# tile_a\ttile_b\taxis\tncc\tmad")
+		for _, s := range scores {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.4f\t%.1f\n", filepath.Base(paths[s.a]), filepath.Base(paths[s.b]), s.axis, s.ncc, s.mad)
+		}
+		return w.Flush()
+	})
+}
+
+// seamMask marks with 255 every pixel of a w x h mosaic that two or more of the
+// tile rectangles cover, and leaves the rest 0
+func seamMask(rects []image.Rectangle, w, h int) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, w, h))
+	// counts saturate at 2; only whether a pixel is shared matters
+	count := make([]uint8, w*h)
+	for _, r := range rects {
+		r = r.Intersect(m.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if i := y*w + x; count[i] < 2 {
+					count[i]++
+					if count[i] == 2 {
+						m.Pix[y*m.Stride+x] = 255
+					}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// reportSeams scores the seams of a grid of tiles, logs the worst one and, when
+// report is set, writes every score to it. It fails when a seam correlates below
+// minNCC, after all seams have been reported.
+func reportSeams(imgs []image.Image, paths []string, cells []image.Point, overlapX, overlapY int, report string, minNCC float64) error {
+	tiles := make([]*image.Gray16, len(imgs))
+	for i, img := range imgs {
+		tiles[i] = toGray16(img)
+	}
+	scores := seamScores(tiles, cells, overlapX, overlapY)
+	if len(scores) == 0 {
+		slog.Warn("no overlapping seams to score")
+		return nil
+	}
+	worst := scores[0]
+	failed := 0
+	for _, s := range scores {
+		slog.Debug("seam score", "a", paths[s.a], "b", paths[s.b], "axis", s.axis, "ncc", s.ncc, "mad", s.mad)
+		if s.ncc < worst.ncc {
+			worst = s
+		}
+		if s.ncc < minNCC {
+			slog.Warn("seam below quality threshold", "a", paths[s.a], "b", paths[s.b], "axis", s.axis, "ncc", s.ncc, "min", minNCC)
+			failed++
+		}
+	}
+	slog.Info("seam quality", "seams", len(scores), "worst_ncc", worst.ncc, "worst_a", paths[worst.a], "worst_b", paths[worst.b])
+	if report != "" {
+		if err := writeSeamReport(report, paths, scores); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d seams correlate below %g", failed, len(scores), minNCC)
+	}
+	return nil
+}
+
+// diffStats summarises the per-pixel differences between two images, in 16-bit
+// units; colour pixels differ by their largest channel difference
+type diffStats struct {
+	mean, rms, max float64
+	changed, n     int
+}
+
+// diffImages compares img with ref pixel by pixel and returns the statistics and
+// a map of the absolute difference of each pixel. The images must be the same size.
+func diffImages(img, ref image.Image) (diffStats, *image.Gray16, error) {
+	a, b := img.Bounds(), ref.Bounds()
+	if a.Size() != b.Size() {
+		return diffStats{}, nil, fmt.Errorf("the mosaic is %v but the reference is %v", a.Size(), b.Size())
+	}
+	heat := image.NewGray16(image.Rect(0, 0, a.Dx(), a.Dy()))
+	var s diffStats
+	var sum, sum2 float64
+	for y := 0; y < a.Dy(); y++ {
+		for x := 0; x < a.Dx(); x++ {
+			p := color.RGBA64Model.Convert(img.At(a.Min.X+x, a.Min.Y+y)).(color.RGBA64)
+			q := color.RGBA64Model.Convert(ref.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)
+			d := max(absDiff(p.R, q.R), absDiff(p.G, q.G), absDiff(p.B, q.B), absDiff(p.A, q.A))
+			heat.SetGray16(x, y, color.Gray16{d})
+			if d != 0 {
+				s.changed++
+			}
+			sum += float64(d)
+			sum2 += float64(d) * float64(d)
+			s.max = max(s.max, float64(d))
+		}
+	}
+	s.n = a.Dx() * a.Dy()
+	if s.n > 0 {
+		s.mean, s.rms = sum/float64(s.n), math.Sqrt(sum2/float64(s.n))
+	}
+	return s, heat, nil
+}
+
+// absDiff returns |a - b|
+func absDiff(a, b uint16) uint16 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// reportDiff compares the finished mosaic with the reference TIFF at refPath and
+// logs the difference statistics. With heatmap set the absolute difference of each
+// pixel is written there as a 16-bit image. A remote reference is fetched through
+// client.
+func reportDiff(img image.Image, refPath, heatmap string, client *http.Client) error {
+	ref, err := loadTIFF(refPath, client)
+	if err != nil {
+		return fmt.Errorf("reference %w", err)
+	}
+	s, heat, err := diffImages(img, ref)
+	if err != nil {
+		return fmt.Errorf("--diff %s: %v", refPath, err)
+	}
+	slog.Info("difference from reference", "reference", refPath, "mean_abs", s.mean, "rms", s.rms, "max_abs", s.max,
+		"changed_pixels", s.changed, "changed_fraction", float64(s.changed)/float64(max(s.n, 1)))
+	if heatmap == "" {
+		return nil
+	}
+	_, enc, err := lookupEncoder("", heatmap)
+	if err != nil {
+		return err
+	}
+	if err := encodeFile(heatmap, enc, heat, EncodeOptions{}); err != nil {
+		return err
+	}
+	slog.Info("difference heatmap saved", "path", heatmap)
+	return nil
+}
+
+// histogram counts the samples of img in bins equal bins spanning its bit depth,
+// one row of counts per channel (red, green and blue for colour images). It also
+// returns the full-scale value and how many samples sit at 0 and at full scale.
+func histogram(img image.Image, bins int) (counts [][]int, full, atZero, atFull int) {
+	full = 65535
+	channels := 3
+	switch img.(type) {
+	case *image.Gray16:
+		channels = 1
+	case *image.Gray:
+		channels, full = 1, 255
+	case *image.RGBA:
+		full = 255
+	}
+	counts = make([][]int, channels)
+	for c := range counts {
+		counts[c] = make([]int, bins)
+	}
+	add := func(c, v int) {
+		counts[c][v*bins/(full+1)]++
+		switch v {
+		case 0:
+			atZero++
+		case full:
+			atFull++
+		}
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch m := img.(type) {
+			case *image.Gray16:
+				add(0, int(m.Gray16At(x, y).Y))
+			case *image.Gray:
+				add(0, int(m.GrayAt(x, y).Y))
+			case *image.RGBA:
+				px := m.RGBAAt(x, y)
+				add(0, int(px.R))
+				add(1, int(px.G))
+				add(2, int(px.B))
+			default:
+				px := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+				add(0, int(px.R))
+				add(1, int(px.G))
+				add(2, int(px.B))
+			}
+		}
+	}
+	return counts, full, atZero, atFull
+}
+
+// writeHistogram writes the histogram of img with the given number of bins to path
+// as CSV, one line per bin with its first and last value and a count per channel,
+// and logs how many samples are clipped at either end
+func writeHistogram(img image.Image, path string, bins int) error {
+	counts, full, atZero, atFull := histogram(img, bins)
+	err := writeOutput(path, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		if len(counts) == 1 {
+			fmt.Fprintln(w, "bin_start,bin_end,count")
+		} else {
+			fmt.Fprintln(w, "bin_start,bin_end,red,green,blue")
+		}
+		// value v falls in bin v*bins/(full+1), so bin i starts at the first v reaching i
+		start := func(i int) int { return (i*(full+1) + bins - 1) / bins }
+		for i := 0; i < bins; i++ {
+			fmt.Fprintf(w, "%d,%d", start(i), start(i+1)-1)
+			for _, c := range counts {
+				fmt.Fprintf(w, ",%d", c[i])
+			}
+			fmt.Fprintln(w)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	n := img.Bounds().Dx() * img.Bounds().Dy() * len(counts)
+	slog.Info("histogram saved", "path", path, "bins", bins, "samples", n, "at_zero", atZero, "at_full_scale", atFull)
+	return nil
+}
@@ -0,0 +1,115 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"path/filepath"
+)
+
+// seamShift is the measured offset of tile b from its nominal grid position next
+// to tile a, and the correlation of the match
+type seamShift struct {
+	a, b   int
+	axis   string
+	dx, dy float64
+	ncc    float64
+}
+
+// estimateShift measures how far tile b sits from its nominal place next to a,
+// laid out as for overlapStrip. The centre of b's overlap strip is searched for in
+// a within a quarter of the overlap of the nominal position. ok is false when the
+// overlap is too narrow to search.
+func estimateShift(a, b *image.Gray16, overlap int, horizontal bool) (dx, dy, ncc float64, ok bool) {
+	pa, pb := newGrayPlane(a), newGrayPlane(b)
+	m := overlap / 4
+	// the template is b's overlap strip less a margin of m, and nominal is where
+	// its corner falls in a when b is exactly on the grid
+	tmplRect := image.Rect(m, m, overlap-m, pb.h-m)
+	nominal := image.Pt(pa.w-overlap+m, m)
+	if !horizontal {
+		tmplRect = image.Rect(m, m, pb.w-m, overlap-m)
+		nominal = image.Pt(m, pa.h-overlap+m)
+	}
+	if m < 1 || tmplRect.Dx() < 4 || tmplRect.Dy() < 4 {
+		return 0, 0, 0, false
+	}
+	tmpl := grayPlane{w: tmplRect.Dx(), h: tmplRect.Dy(), p: make([]float64, tmplRect.Dx()*tmplRect.Dy())}
+	for y := 0; y < tmpl.h; y++ {
+		for x := 0; x < tmpl.w; x++ {
+			tmpl.p[y*tmpl.w+x] = pb.p[(tmplRect.Min.Y+y)*pb.w+tmplRect.Min.X+x]
+		}
+	}
+	pt, score := pa.bestMatch(tmpl, image.Rect(nominal.X-m, nominal.Y-m, nominal.X+m+1, nominal.Y+m+1))
+	if math.IsInf(score, -1) {
+		return 0, 0, 0, false
+	}
+	// b's content appears in a displaced by just as much as b is from the grid
+	dx = float64(pt.X-nominal.X) + pa.peakOffset(tmpl, pt, image.Pt(1, 0), score)
+	dy = float64(pt.Y-nominal.Y) + pa.peakOffset(tmpl, pt, image.Pt(0, 1), score)
+	return dx, dy, score, true
+}
+
+// registerSeams measures the shift of every seam between neighbouring cells,
+// skipping axes without overlap and seams too narrow to search
+func registerSeams(tiles []*image.Gray16, cells []image.Point, overlapX, overlapY int) []seamShift {
+	var shifts []seamShift
+	for _, axis := range []struct {
+		name       string
+		overlap    int
+		horizontal bool
+	}{{"x", overlapX, true}, {"y", overlapY, false}} {
+		if axis.overlap <= 0 {
+			continue
+		}
+		for _, p := range neighbourPairs(cells, axis.horizontal) {
+			dx, dy, ncc, ok := estimateShift(tiles[p[0]], tiles[p[1]], axis.overlap, axis.horizontal)
+			if !ok {
+				continue
+			}
+			shifts = append(shifts, seamShift{a: p[0], b: p[1], axis: axis.name, dx: dx, dy: dy, ncc: ncc})
+		}
+	}
+	return shifts
+}
+
+// reportRegistration measures the seam shifts of a grid of tiles without applying
+// them, logs a summary and writes one tab-separated line per seam to report. The
+// shifts are scaled by downsample back to input pixels.
+func reportRegistration(imgs []image.Image, paths []string, cells []image.Point, overlapX, overlapY, downsample int, report string) error {
+	tiles := make([]*image.Gray16, len(imgs))
+	for i, img := range imgs {
+		tiles[i] = toGray16(img)
+	}
+	shifts := registerSeams(tiles, cells, overlapX, overlapY)
+	var worst, sum float64
+	for i := range shifts {
+		s := &shifts[i]
+		s.dx *= float64(downsample)
+		s.dy *= float64(downsample)
+		d := math.Hypot(s.dx, s.dy)
+		sum += d
+		worst = max(worst, d)
+		slog.Debug("seam shift", "a", paths[s.a], "b", paths[s.b], "axis", s.axis, "dx", s.dx, "dy", s.dy, "ncc", s.ncc)
+	}
+	err := writeOutput(report, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		fmt.Fprintln(w, "# tile_a\ttile_b\taxis\tdx\tdy\tncc")
+		for _, s := range shifts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%.2f\t%.4f\n", filepath.Base(paths[s.a]), filepath.Base(paths[s.b]), s.axis, s.dx, s.dy, s.ncc)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if len(shifts) == 0 {
+		slog.Warn("no seams wide enough to measure a registration shift", "report", report)
+		return nil
+	}
+	slog.Info("registration shifts (not applied)", "seams", len(shifts), "mean", sum/float64(len(shifts)), "max", worst, "report", report)
+	return nil
+}
@@ -0,0 +1,115 @@
+package stitch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// minDPI and maxDPI bound the resolution every output format can record. JFIF
+// stores whole dots per inch in 16 bits, the tightest of the three, so a JPEG
+// would record 0 below minDPI.
+const minDPI, maxDPI = 0.5, math.MaxUint16
+
+// checkDPI reports a resolution outside minDPI..maxDPI
+func checkDPI(dpi float64) error {
+	if !(dpi >= minDPI && dpi <= maxDPI) {
+		return fmt.Errorf("invalid dpi: %g (must be from %g to %d)", dpi, minDPI, maxDPI)
+	}
+	return nil
+}
+
+// resolutionRational returns dpi as a TIFF RATIONAL numerator and denominator,
+// exact for whole numbers and to four decimals otherwise
+func resolutionRational(dpi float64) [2]uint32 {
+	if dpi == math.Trunc(dpi) {
+		return [2]uint32{uint32(dpi), 1}
+	}
+	return [2]uint32{uint32(math.Round(dpi * 10000)), 10000}
+}
+
+// setTIFFResolution rewrites the XResolution and YResolution fields of the first
+// IFD of the TIFF in buf to dpi and its ResolutionUnit to inches, in place. The
+// fields must already be present, as they are in every TIFF the tiff package
+// writes.
+func setTIFFResolution(buf []byte, dpi float64) error {
+	if len(buf) < 8 {
+		return errors.New("TIFF too short to set its resolution")
+	}
+	bo, err := tiffByteOrder(buf)
+	if err != nil {
+		return err
+	}
+	off := int(bo.Uint32(buf[4:]))
+	if off+2 > len(buf) {
+		return errors.New("TIFF IFD offset is out of range")
+	}
+	r := resolutionRational(dpi)
+	found := 0
+	n := int(bo.Uint16(buf[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + 12*i
+		if e+12 > len(buf) {
+			return errors.New("TIFF IFD is truncated")
+		}
+		switch bo.Uint16(buf[e:]) {
+		case 282, 283:
+			at := int(bo.Uint32(buf[e+8:]))
+			if bo.Uint16(buf[e+2:]) != 5 || at+8 > len(buf) {
+				return errors.New("TIFF resolution field is not a rational")
+			}
+			bo.PutUint32(buf[at:], r[0])
+			bo.PutUint32(buf[at+4:], r[1])
+			found++
+		case 296:
+			bo.PutUint16(buf[e+8:], 2) // inches
+		}
+	}
+	if found != 2 {
+		return errors.New("TIFF has no resolution fields to set")
+	}
+	return nil
+}
+
+// setPNGResolution returns the PNG in buf with a pHYs chunk giving dpi, inserted
+// after the IHDR chunk the png package always writes first
+func setPNGResolution(buf []byte, dpi float64) ([]byte, error) {
+	const ihdrEnd = 8 + 8 + 13 + 4 // signature, then IHDR's length, type, data and CRC
+	if len(buf) < ihdrEnd || string(buf[12:16]) != "IHDR" {
+		return nil, errors.New("PNG does not start with an IHDR chunk")
+	}
+	ppm := uint32(math.Round(dpi / 0.0254)) // pixels per metre
+	chunk := binary.BigEndian.AppendUint32(nil, 9)
+	chunk = append(chunk, "pHYs"...)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+	chunk = append(chunk, 1) // unit: metre
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	var out bytes.Buffer
+	out.Write(buf[:ihdrEnd])
+	out.Write(chunk)
+	out.Write(buf[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+// setJPEGResolution returns the JPEG in buf with a JFIF APP0 segment giving dpi,
+// rounded to whole dots per inch, inserted after the start-of-image marker. The
+// jpeg package writes no APP0 of its own.
+func setJPEGResolution(buf []byte, dpi float64) ([]byte, error) {
+	if len(buf) < 2 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return nil, errors.New("JPEG does not start with a start-of-image marker")
+	}
+	d := uint16(min(math.Round(dpi), math.MaxUint16))
+	app0 := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1} // JFIF 1.1, unit: inch
+	app0 = binary.BigEndian.AppendUint16(app0, d)
+	app0 = binary.BigEndian.AppendUint16(app0, d)
+	app0 = append(app0, 0, 0) // no thumbnail
+	var out bytes.Buffer
+	out.Write(buf[:2])
+	out.Write(app0)
+	out.Write(buf[2:])
+	return out.Bytes(), nil
+}
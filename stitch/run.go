@@ -0,0 +1,1663 @@
+package stitch
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// runOptions holds the flags of one run and the settings check derives from them
+type runOptions struct {
+	dir                string
+	rows               int
+	cols               int
+	grid               string
+	overlapX           int
+	overlapY           int
+	overlapTurn        int
+	downsample         int
+	downsampleInput    int
+	inFilterName       string
+	outFilterName      string
+	registerFilterName string
+	maxDim             int
+	outputScale        float64
+	listFile           string
+	excludeFile        string
+	httpTimeout        time.Duration
+	regexStr           string
+	output             string
+	format             string
+	quality            int
+	snake              string
+	colStart           string
+	rowStart           string
+	diffRef            string
+	diffHeatmap        string
+	histOut            string
+	histBins           int
+	exposureTag        int
+	exposuresFile      string
+	seamMaskOut        string
+	weightMapOut       string
+	weightsFile        string
+	timeout            time.Duration
+	skipErrors         bool
+	mmapDir            string
+	normalize          bool
+	normWindow         string
+	bitDepth           int
+	flat               bool
+	compression        string
+	channelOut         string
+	dither             string
+	scanRange          string
+	qcMode             string
+	seamReport         string
+	detect             bool
+	verifyOrder        string
+	stageTagsSpec      string
+	stageTolerance     float64
+	registerReport     string
+	seamMinNCC         float64
+	stackFile          string
+	sortOrder          string
+	tilesFile          string
+	positionsFile      string
+	overviewPath       string
+	overviewScale      float64
+	positionUnits      string
+	tileSizesFile      string
+	trim               bool
+	trimThreshold      float64
+	autocrop           bool
+	autocropThreshold  float64
+	originIndex        int
+	indexMapFile       string
+	requireExact       bool
+	fill               string
+	cellRegex          string
+	cellBase           int
+	blend              string
+	centerWeight       float64
+	featherW           int
+	accumulate         string
+	accumulateScale    string
+	sumTaper           int
+	featherAxis        string
+	colorMode          bool
+	blendSpace         string
+	splitChannels      bool
+	exportDir          string
+	nameTemplate       string
+	resume             bool
+	resumeValidate     bool
+	sharpenSpec        string
+	outRotate          int
+	outFlip            bool
+	dpi                float64
+	align              int
+	square             string
+	pixelSize          float64
+	scaleBarLen        string
+	scaleBarColor      string
+	scaleBarPos        string
+	exportRowsDir      string
+	svgOverlay         string
+	tileConfigOut      string
+	inputGamma         float64
+	outputGamma        float64
+	denoise            string
+	autoflat           bool
+	autoflatDegree     int
+	flatFieldPath      string
+	checkpointDir      string
+	watch              bool
+	watchInterval      time.Duration
+	dedup              bool
+	dedupDrop          bool
+	promoteDepth       bool
+	assign             string
+	channelGeom        string
+	logLevel           string
+	logJSON            bool
+	relativePaths      bool
+	quiet              bool
+	showVersion        bool
+	validateOnly       validateMode
+
+	set           map[string]bool // flags given on the command line
+	freePlacement bool            // tiles are placed by --positions, --overview or --tiles rather than on the grid
+	partial       bool            // --fill partial
+	snakeReverse  bool            // the snake starts from the far end of its first column or row
+	stageTags     [2]uint16
+	regex         *regexp.Regexp // compiled --regex; nil for none
+	cellRe        *regexp.Regexp // compiled --cell-regex, with --fill partial
+	channels      map[string]string
+
+	inFilter, outFilter, registerFilter resize.InterpolationFunction
+
+	denoiseSpec       *denoiseSpec
+	normLow, normHigh float64
+	trimBelow         float64
+
+	formatName                   string
+	enc                          Encoder
+	outDefault                   channelOutput
+	chOutputs                    map[string]channelOutput
+	sharpenAmount, sharpenRadius float64
+	bar                          scaleBar
+}
+
+// newRunOptions defines the flags of a run on fs
+func newRunOptions(fs *flag.FlagSet) *runOptions {
+	o := &runOptions{}
+	fs.StringVar(&o.dir, "dir", "", "Directory containing images (required unless using --list)")
+	fs.IntVar(&o.rows, "rows", 0, "Number of rows in mosaic")
+	fs.IntVar(&o.cols, "cols", 0, "Number of columns in mosaic")
+	fs.StringVar(&o.grid, "grid", "", "Grid size as ROWSxCOLS, e.g. 4x6; shorthand for --rows and --cols")
+	fs.IntVar(&o.overlapX, "overlapX", 0, "Overlap in X (pixels)")
+	fs.IntVar(&o.overlapY, "overlapY", 0, "Overlap in Y (pixels)")
+	fs.IntVar(&o.overlapTurn, "overlap-turn", -1, "Overlap (pixels) along the scan axis for the reversed rows (horizontal snake) or columns (vertical snake); default: --overlapX/--overlapY")
+	fs.IntVar(&o.downsample, "downsample", 1, "Downsample factor (integer >=1); alias of --downsample-input")
+	fs.IntVar(&o.downsampleInput, "downsample-input", 0, "Downsample factor applied to input tiles before stitching (integer >=1)")
+	fs.StringVar(&o.inFilterName, "input-filter", "lanczos3", "Filter for resampling tiles (--downsample, per-tile pixel sizes, --channel-geometry): nearest, bilinear, bicubic, mitchell, lanczos2 or lanczos3")
+	fs.StringVar(&o.outFilterName, "output-filter", "lanczos3", "Filter for --output-scale, from the same choices as --input-filter")
+	fs.StringVar(&o.registerFilterName, "register-filter", "bilinear", "Filter for shrinking tiles to the --overview scale while matching them, from the same choices as --input-filter")
+	fs.IntVar(&o.maxDim, "max-dimension", 0, "Choose the smallest downsample factor that keeps the mosaic's long edge at most this many pixels; 0 disables")
+	fs.Float64Var(&o.outputScale, "output-scale", 1, "Scale factor applied only to the final mosaic (e.g. 0.25)")
+	fs.StringVar(&o.listFile, "list", "", "Optional file containing list of images (local paths or http(s) URLs)")
+	fs.StringVar(&o.excludeFile, "exclude", "", "Optional file of tiles to leave out, one path or base name per line (# starts a comment); grid cells of excluded tiles stay black")
+	fs.DurationVar(&o.httpTimeout, "http-timeout", 60*time.Second, "Timeout for fetching each http(s) image")
+	fs.StringVar(&o.regexStr, "regex", "", "Optional regex to filter filenames in directory")
+	fs.StringVar(&o.output, "out", "mosaic.tiff", "Output file, or - for stdout; the format follows the extension unless --format is given")
+	fs.StringVar(&o.format, "format", "", "Output format: tiff, png, jpeg or npy (default: from --out extension)")
+	fs.IntVar(&o.quality, "quality", 90, "JPEG quality (1-100)")
+	fs.StringVar(&o.snake, "snake", "vertical", "Snake pattern direction: vertical (default) or horizontal")
+	fs.StringVar(&o.colStart, "col-start", "bottom", "Where the first column of a vertical snake starts: bottom or top")
+	fs.StringVar(&o.rowStart, "row-start", "left", "Where the first row of a horizontal snake starts: left or right")
+	fs.StringVar(&o.diffRef, "diff", "", "Optional reference mosaic TIFF of the same size to compare the output with, logging per-pixel difference statistics")
+	fs.StringVar(&o.diffHeatmap, "diff-heatmap", "", "With --diff, optional 16-bit image to write the absolute difference of each pixel to")
+	fs.StringVar(&o.histOut, "histogram", "", "Optional CSV file to write the intensity histogram of the final mosaic to, in its output bit depth")
+	fs.IntVar(&o.histBins, "histogram-bins", 256, "Number of equal-width --histogram bins spanning the output bit depth")
+	fs.IntVar(&o.exposureTag, "exposure-tag", 0, "TIFF tag number holding each tile's exposure time; tiles are scaled to the shortest exposure before blending")
+	fs.StringVar(&o.exposuresFile, "exposures", "", "Optional file of per-tile exposure times (\"<file> <time>\" per line); tiles are scaled to the shortest exposure before blending")
+	fs.StringVar(&o.seamMaskOut, "seam-mask", "", "Optional 8-bit image to write a mask of the overlap regions to: 255 where two or more tiles meet, 0 elsewhere")
+	fs.StringVar(&o.weightMapOut, "weightmap", "", "Optional 16-bit image to write the per-pixel blending weight (coverage when summing) to; 4096 = weight 1")
+	fs.StringVar(&o.weightsFile, "weights", "", "Optional file of per-tile weights (\"<file> <weight>\" per line) for weighted-average blending")
+	fs.DurationVar(&o.timeout, "timeout-per-tile", 0, "Abandon a tile whose decode takes longer than this (e.g. 30s); 0 disables")
+	fs.BoolVar(&o.skipErrors, "skip-errors", false, "Replace tiles that fail to load with blank tiles instead of aborting")
+	fs.StringVar(&o.mmapDir, "mmap-dir", "", "Optional directory for memory-mapped scratch files backing the output canvas and blending accumulators")
+	fs.BoolVar(&o.normalize, "normalize-tiles", false, "Rescale each tile to a common percentile window before blending")
+	fs.StringVar(&o.normWindow, "normalize-window", "1,99", "Percentile window (low,high) used by --normalize-tiles")
+	fs.IntVar(&o.bitDepth, "bitdepth", 16, "Output bit depth per channel: 16 (default) or 8")
+	fs.BoolVar(&o.flat, "flat", false, "Write the simplest TIFF: a single image directory holding one strip, without a predictor")
+	fs.StringVar(&o.compression, "compression", "deflate", "TIFF output compression: deflate or none")
+	fs.StringVar(&o.channelOut, "channel-output", "", "Per-channel output overrides for --split-channels, e.g. red:bitdepth=8;blue:compression=none")
+	fs.StringVar(&o.dither, "dither", "none", "Dithering when reducing to 8-bit output: none, floyd or ordered")
+	fs.StringVar(&o.scanRange, "scan-overlap", "", "Estimate the overlap by scanning a min:max range of pixels on a few tiles, then exit")
+	fs.StringVar(&o.qcMode, "qc", "", "Render a QC image instead of blending: checkerboard")
+	fs.StringVar(&o.seamReport, "seam-report", "", "Optional file to write a per-seam quality score (correlation and mean abs difference) to")
+	fs.BoolVar(&o.detect, "detect-order", false, "Score every snake and raster order against the stage coordinates and the seams of the top-left tiles, print the flags (or index map) of the best one and exit")
+	fs.StringVar(&o.verifyOrder, "verify-order", "", "Cross-check the grid order against stage coordinates in the TIFF tags: warn or error on mismatch")
+	fs.StringVar(&o.stageTagsSpec, "stage-tags", defaultStageTags, "TIFF tag numbers X,Y holding each tile's stage coordinates, for --verify-order")
+	fs.Float64Var(&o.stageTolerance, "stage-tolerance", 0.5, "How far (in tile steps) a tile may lie from its stage position before --verify-order reports it")
+	fs.StringVar(&o.registerReport, "register-report", "", "Optional file to write each seam's measured registration shift and its correlation to; tiles stay on the grid")
+	fs.Float64Var(&o.seamMinNCC, "seam-min-ncc", 0, "Fail when any seam's overlap correlation is below this (e.g. 0.8); 0 disables")
+	fs.StringVar(&o.stackFile, "stack", "", "Optional multi-page TIFF whose pages are the tiles in acquisition order; replaces --dir/--list")
+	fs.StringVar(&o.sortOrder, "sort", "name", "Tile order before the grid is applied: name, or time to order by the TIFF capture timestamp")
+	fs.StringVar(&o.tilesFile, "tiles", "", "Optional file of \"<path> <x> <y>\" lines giving the tiles, in order, and their positions; replaces --dir/--list and the grid")
+	fs.StringVar(&o.positionsFile, "positions", "", "Optional file of tile positions (\"<file> <x> <y>\" per line) used instead of the grid")
+	fs.StringVar(&o.overviewPath, "overview", "", "Optional low-resolution overview TIFF; each tile is placed where it best matches it instead of on the grid")
+	fs.Float64Var(&o.overviewScale, "overview-scale", 0, "Overview pixels per input tile pixel, e.g. 0.1 for a 10x lower resolution overview")
+	fs.StringVar(&o.positionUnits, "positions-units", "px", "Units of --positions coordinates: px, or um placed at --pixelsize")
+	fs.StringVar(&o.tileSizesFile, "tile-pixelsizes", "", "Optional file of per-tile pixel sizes in micrometres (\"<file> <size>\" per line) for --positions-units um")
+	fs.BoolVar(&o.trim, "trim-edges", false, "Drop outer rows/columns of tiles that are mostly background")
+	fs.Float64Var(&o.trimThreshold, "trim-threshold", 0.02, "Mean intensity (fraction of full scale) below which --trim-edges treats a tile as background")
+	fs.BoolVar(&o.autocrop, "autocrop", false, "Crop the mosaic to the bounding box of pixels brighter than --autocrop-threshold")
+	fs.Float64Var(&o.autocropThreshold, "autocrop-threshold", 0, "Intensity (fraction of full scale) that --autocrop treats as background, and anything at or below it")
+	fs.IntVar(&o.originIndex, "origin-index", -1, "Reverse the tile list along the snake: the position in the sorted list of the tile at grid cell (0,0), which must be the snake start counted from the end; no other position is accepted (default: the snake's own start)")
+	fs.StringVar(&o.indexMapFile, "index-map", "", "Optional file giving the \"<row> <col>\" cell of each tile in sorted order, overriding --snake")
+	fs.BoolVar(&o.requireExact, "require-exact", false, "Fail unless exactly rows*cols images are matched")
+	fs.StringVar(&o.fill, "fill", "full", "Grid filling: full (rows*cols tiles in snake order) or partial (each tile at the cell in its name, empty cells black)")
+	fs.StringVar(&o.cellRegex, "cell-regex", defaultCellRegex, "With --fill partial, regex reading the row and column from a tile name (groups row and col, or the first two)")
+	fs.IntVar(&o.cellBase, "cell-base", 0, "With --fill partial, the index of the first row and column in tile names")
+	fs.StringVar(&o.blend, "blend", "", "Overlap blending: sum, average, feather, none to let later tiles overwrite, or a registered blend (default: sum, or average with --weights)")
+	fs.Float64Var(&o.centerWeight, "center-weight", 0, "Strength (0-1) of a radial weight favouring tile centres in averaged or feathered overlaps; 0 disables")
+	fs.IntVar(&o.featherW, "feather-width", -1, "Width in pixels of the --blend feather band, centred in the overlap (default: the whole overlap)")
+	fs.StringVar(&o.accumulate, "accumulate", "int", "Sum blend accumulation: int clamps each sum at 65535; float sums in float32 and rescales once with --accumulate-scale")
+	fs.StringVar(&o.accumulateScale, "accumulate-scale", "linear", "Rescale of --accumulate float to 16 bits: linear (divide by a common factor when the peak exceeds 65535) or log")
+	fs.IntVar(&o.sumTaper, "sum-taper", 0, "With the sum blend, ramp each tile's contribution over this many pixels of every overlap it shares, so seams brighten gradually; 0 disables")
+	fs.StringVar(&o.featherAxis, "feather-axis", "both", "Axis the --blend feather ramps along: x, y or both; the other axis's overlaps are averaged evenly")
+	fs.BoolVar(&o.colorMode, "color", false, "Stitch colour tiles in colour instead of converting them to grayscale")
+	fs.StringVar(&o.blendSpace, "blend-space", "rgb", "Colour space for blending with --color: rgb or lab")
+	fs.BoolVar(&o.splitChannels, "split-channels", false, "Stitch the red, green and blue channels of colour tiles into separate grayscale outputs <out>_r, _g and _b")
+	fs.Var(&o.validateOnly, "validate-only", "Check that every selected tile's header reads and gives the expected size, then exit without stitching; --validate-only=deep decodes every tile in full")
+	fs.StringVar(&o.exportDir, "export-tiles", "", "Write each loaded and preprocessed tile to this directory instead of stitching")
+	fs.StringVar(&o.nameTemplate, "name-template", "", "File names for --export-tiles, e.g. slide01_r{row}_c{col}_{channel}.tif; placeholders {row}, {col}, {index}, {channel}, {base}")
+	fs.BoolVar(&o.resume, "resume", false, "With --export-tiles, skip tiles already recorded as exported")
+	fs.BoolVar(&o.resumeValidate, "resume-validate", false, "With --resume, re-export recorded tiles whose output no longer decodes")
+	fs.StringVar(&o.sharpenSpec, "sharpen", "", "Unsharp mask \"amount,radius\" applied to the final mosaic, e.g. 0.8,1.5")
+	fs.IntVar(&o.outRotate, "out-rotate", 0, "Rotate the final mosaic clockwise by 90, 180 or 270 degrees")
+	fs.BoolVar(&o.outFlip, "out-flip", false, "Mirror the final mosaic left to right (after --out-rotate)")
+	fs.Float64Var(&o.dpi, "dpi", 0, "Resolution in dots per inch to record in TIFF, PNG and JPEG outputs, for display only (independent of --pixelsize)")
+	fs.IntVar(&o.align, "align", 0, "Pad the final mosaic with black on the right and bottom to a multiple of this many pixels in each dimension; 0 disables")
+	fs.StringVar(&o.square, "force-square-canvas", "", "Pad the final mosaic with black to a square, keeping it at the center or top-left")
+	fs.Float64Var(&o.pixelSize, "pixelsize", 0, "Input pixel size in micrometres (needed by --scalebar and --positions-units um)")
+	fs.StringVar(&o.scaleBarLen, "scalebar", "", "Draw a labelled scale bar of this length, e.g. 100um or 1mm")
+	fs.StringVar(&o.scaleBarColor, "scalebar-color", "white", "Scale bar colour: a name such as white or black, or #rrggbb")
+	fs.StringVar(&o.scaleBarPos, "scalebar-position", "bottom-right", "Scale bar corner: top-left, top-right, bottom-left or bottom-right")
+	fs.StringVar(&o.exportRowsDir, "export-rows", "", "Optional directory to also write each composited grid row to, as row-NNN.tif")
+	fs.StringVar(&o.svgOverlay, "svg-overlay", "", "Optional SVG file to draw the tile rectangles, indices and seams to, over the saved mosaic")
+	fs.StringVar(&o.tileConfigOut, "write-tileconfig", "", "Optional file to write the tile placements to as a Fiji TileConfiguration.txt, in input pixels")
+	fs.Float64Var(&o.inputGamma, "input-gamma", 1, "Linearize each tile as loaded by raising its normalized values to this power, e.g. 2.2 to undo a camera's display gamma; 1 leaves tiles unchanged")
+	fs.Float64Var(&o.outputGamma, "output-gamma", 1, "Re-encode the mosaic for display by raising its normalized values to 1/G, e.g. 2.2; 1 leaves it linear")
+	fs.StringVar(&o.denoise, "denoise", "", "Denoise each tile after loading: median:N (odd window size) or gaussian:sigma")
+	fs.BoolVar(&o.autoflat, "autoflat-overlaps", false, "Estimate the illumination profile shared by all tiles from the grid overlaps and flatten it before blending")
+	fs.IntVar(&o.autoflatDegree, "autoflat-degree", 4, "Polynomial degree (1-6) of the --autoflat-overlaps log illumination profile")
+	fs.StringVar(&o.flatFieldPath, "flatfield", "", "Flat-field reference TIFF, or a directory of per-tile references matched by file name or tile order")
+	fs.StringVar(&o.checkpointDir, "checkpoint", "", "Optional directory to keep the decoded and corrected tiles in, reused by later runs whose inputs and corrections are unchanged")
+	fs.BoolVar(&o.watch, "watch", false, "Keep polling --dir and restitch whenever a full grid of tiles is present and has settled")
+	fs.DurationVar(&o.watchInterval, "watch-interval", 2*time.Second, "With --watch, how often to poll; tiles must be unchanged for one interval before stitching")
+	fs.BoolVar(&o.dedup, "dedup", false, "Decode every tile first and warn about tiles whose pixels duplicate an earlier tile")
+	fs.BoolVar(&o.dedupDrop, "dedup-drop", false, "Like --dedup, but also drop the duplicates before tiles are assigned to the grid")
+	fs.BoolVar(&o.promoteDepth, "promote-depth", false, "Promote 8-bit tiles to 16-bit when tiles mix 8-bit and 16-bit depths, instead of failing")
+	fs.StringVar(&o.assign, "assign", "", "Optional channel mapping for a colour composite, e.g. red=*_DAPI*,green=*_GFP*")
+	fs.StringVar(&o.channelGeom, "channel-geometry", "", "Per-channel overrides for --assign, e.g. green:overlapX=25,overlapY=25;blue:downsample=2")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.BoolVar(&o.logJSON, "log-json", false, "Write logs as JSON lines")
+	fs.BoolVar(&o.relativePaths, "relative-paths", false, "Log tile paths relative to --dir, so that logs from different machines compare equal")
+	fs.BoolVar(&o.quiet, "quiet", false, "Don't print the mosaic summary at the end")
+	fs.BoolVar(&o.showVersion, "version", false, "Print stitchr version and exit")
+	return o
+}
+
+// run parses args and stitches the mosaic. A standalone run uses the process
+// command line flags and configures logging and HTTP from them; batch jobs parse
+// their own flag set and share the settings of the batch.
+//
+// A run goes through four stages: check validates the flags, listInputs and
+// arrange find the tiles and put them in grid order, compose stitches them and
+// writeOutputs saves the mosaic and its side outputs. --validate-only,
+// --export-tiles, --scan-overlap and --detect-order stop after the tiles are found.
+func run(args []string, standalone bool) error {
+	fs := flag.CommandLine
+	if !standalone {
+		// parse errors are returned to the batch instead of printing usage
+		fs = flag.NewFlagSet("stitchr", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+	}
+	o := newRunOptions(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return UsageError{err}
+	}
+	start := time.Now()
+
+	// Handle --version first
+	if o.showVersion {
+		fmt.Printf("stitchr version %s\n", version)
+		return nil
+	}
+
+	// If no flags were provided, show usage and exit
+	if fs.NFlag() == 0 {
+		return UsageError{errors.New("no options given")}
+	}
+
+	if standalone {
+		relTo := ""
+		if o.relativePaths {
+			relTo = o.dir
+		}
+		if err := setupLogging(o.logLevel, o.logJSON, relTo); err != nil {
+			return UsageError{err}
+		}
+	}
+	// every run, batch jobs included, fetches remote tiles through its own client
+	client := &http.Client{Timeout: o.httpTimeout}
+	// the recommendations of --scan-overlap and --detect-order go to stderr with
+	// the logs, leaving stdout to the mosaic of --out -
+	var report io.Writer = os.Stderr
+
+	o.set = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { o.set[f.Name] = true })
+	if err := o.check(); err != nil {
+		return UsageError{err}
+	}
+	if o.watch {
+		return watchDir(o.dir, o.regex, o.rows*o.cols, o.watchInterval, watchArgs(fs))
+	}
+
+	in, err := listInputs(o)
+	if err != nil {
+		return err
+	}
+	if o.stackFile != "" {
+		defer forgetStack(in.paths)
+	}
+	if err := in.arrange(o, client); err != nil {
+		return err
+	}
+	loadOpts, err := o.loadOptions(in.paths, client)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case o.validateOnly != "":
+		return runValidate(o, in, client)
+	case o.exportDir != "":
+		return runExport(o, in, loadOpts)
+	case o.scanRange != "":
+		return runScanOverlap(o, in, loadOpts, report)
+	case o.detect:
+		return runDetectOrder(o, in, loadOpts, client, report)
+	}
+
+	// With --mmap-dir the canvases and blending accumulators live in disk-backed
+	// memory instead of on the heap, until the run returns
+	var canvases *scratch
+	if o.mmapDir != "" {
+		canvases = &scratch{dir: o.mmapDir}
+		defer canvases.release()
+	}
+	c, err := compose(o, in, loadOpts, canvases, client)
+	if err != nil {
+		return err
+	}
+	if o.autocrop {
+		c.crop(o.autocropThreshold)
+	}
+	return writeOutputs(o, c, client, start)
+}
+
+// check validates the flags and their combinations, and derives the settings the
+// later stages use. ImageJ metadata in the first tile fills in the grid flags
+// left unset. Its errors are usage errors.
+func (o *runOptions) check() error {
+	if o.relativePaths && o.dir == "" {
+		return errors.New("--relative-paths needs --dir")
+	}
+	if err := checkPlacementModes(o.set, o.fill == "partial"); err != nil {
+		return err
+	}
+	o.freePlacement = o.positionsFile != "" || o.overviewPath != "" || o.tilesFile != ""
+	inUse := map[string]bool{
+		"--dir":                 o.dir != "",
+		"--list":                o.listFile != "",
+		"--stack":               o.stackFile != "",
+		"--tiles":               o.tilesFile != "",
+		"--positions":           o.positionsFile != "",
+		"--overview":            o.overviewPath != "",
+		"--index-map":           o.indexMapFile != "",
+		"--fill partial":        o.fill == "partial",
+		"--origin-index":        o.originIndex >= 0,
+		"--overlap-turn":        o.overlapTurn >= 0,
+		"--sort time":           o.sortOrder == "time",
+		"--assign":              o.assign != "",
+		"--channel-geometry":    o.channelGeom != "",
+		"--color":               o.colorMode,
+		"--split-channels":      o.splitChannels,
+		"--blend feather":       o.blend == "feather",
+		"--sum-taper":           o.sumTaper > 0,
+		"--accumulate float":    o.accumulate == "float",
+		"--qc checkerboard":     o.qcMode == "checkerboard",
+		"--normalize-tiles":     o.normalize,
+		"--autoflat-overlaps":   o.autoflat,
+		"--trim-edges":          o.trim,
+		"--max-dimension":       o.maxDim > 0,
+		"--export-tiles":        o.exportDir != "",
+		"--export-rows":         o.exportRowsDir != "",
+		"--watch":               o.watch,
+		"--scan-overlap":        o.scanRange != "",
+		"--detect-order":        o.detect,
+		"--verify-order":        o.verifyOrder != "",
+		"--seam-report":         o.seamReport != "",
+		"--seam-min-ncc":        o.seamMinNCC != 0,
+		"--register-report":     o.registerReport != "",
+		"--weightmap":           o.weightMapOut != "",
+		"--seam-mask":           o.seamMaskOut != "",
+		"--histogram":           o.histOut != "",
+		"--diff":                o.diffRef != "",
+		"--write-tileconfig":    o.tileConfigOut != "",
+		"--svg-overlay":         o.svgOverlay != "",
+		"--out-rotate":          o.outRotate != 0,
+		"--out-flip":            o.outFlip,
+		"--force-square-canvas": o.square != "",
+		"--align":               o.align > 0,
+		// placed tiles are simply dropped, so only grid cells are blanked
+		"--exclude": o.excludeFile != "" && !o.freePlacement && o.fill != "partial",
+	}
+	if err := checkFlagConflicts(inUse); err != nil {
+		return err
+	}
+	if o.overviewPath != "" && o.overviewScale <= 0 {
+		return errors.New("--overview needs --overview-scale > 0")
+	}
+	if o.splitChannels && o.output == "-" {
+		return errors.New("--split-channels writes three files and cannot write to stdout")
+	}
+	if o.blendSpace != "rgb" && !o.colorMode {
+		return errors.New("--blend-space requires --color")
+	}
+	if o.blendSpace == "lab" && o.blend != "average" && o.blend != "feather" && o.weightsFile == "" {
+		return errors.New("--blend-space lab needs an averaging blend; add --blend average or feather")
+	}
+	if o.blend != "" && o.blend != "average" && o.blend != "feather" && o.weightsFile != "" {
+		return errors.New("--weights needs --blend average")
+	}
+	if o.verifyOrder != "" || o.detect {
+		if o.verifyOrder != "" && o.verifyOrder != "warn" && o.verifyOrder != "error" {
+			return fmt.Errorf("invalid --verify-order: %s (use warn or error)", o.verifyOrder)
+		}
+		tags, err := parseStageTags(o.stageTagsSpec)
+		if err != nil {
+			return err
+		}
+		o.stageTags = tags
+		if o.stageTolerance <= 0 {
+			return errors.New("stage tolerance must be positive")
+		}
+	}
+	switch o.positionUnits {
+	case "px":
+		if o.tileSizesFile != "" {
+			return errors.New("--tile-pixelsizes needs --positions-units um")
+		}
+	case "um":
+		if o.positionsFile == "" || o.pixelSize <= 0 {
+			return errors.New("--positions-units um needs --positions and --pixelsize")
+		}
+	default:
+		return fmt.Errorf("invalid positions units: %s (use px or um)", o.positionUnits)
+	}
+	switch o.fill {
+	case "full":
+	case "partial":
+		o.partial = true
+		re, err := regexp.Compile(o.cellRegex)
+		if err != nil {
+			return fmt.Errorf("invalid cell regex: %v", err)
+		}
+		o.cellRe = re
+	default:
+		return fmt.Errorf("invalid fill: %s (use full or partial)", o.fill)
+	}
+	if o.autoflat && (o.autoflatDegree < 1 || o.autoflatDegree > 6) {
+		return fmt.Errorf("invalid autoflat degree: %d (use 1 to 6)", o.autoflatDegree)
+	}
+	switch o.qcMode {
+	case "", "checkerboard":
+	default:
+		return fmt.Errorf("invalid QC mode: %s (use checkerboard)", o.qcMode)
+	}
+	if o.weightMapOut != "" {
+		if name, _, err := lookupEncoder("", o.weightMapOut); err != nil || name == "jpeg" {
+			return errors.New("--weightmap needs a 16-bit format: use a .tif or .png file")
+		}
+	}
+	if o.exposureTag < 0 || o.exposureTag > 65535 {
+		return fmt.Errorf("invalid --exposure-tag %d", o.exposureTag)
+	}
+	if o.exposureTag != 0 && o.exposuresFile != "" {
+		return errors.New("--exposure-tag and --exposures both give exposure times; use one")
+	}
+	if o.bitDepth != 8 && o.bitDepth != 16 {
+		return errors.New("bitdepth must be 8 or 16")
+	}
+	if o.histOut != "" {
+		if o.histBins < 1 || o.histBins > 65536 || (o.bitDepth == 8 && o.histBins > 256) {
+			return fmt.Errorf("--histogram-bins must be between 1 and %d for %d-bit output", 1<<o.bitDepth, o.bitDepth)
+		}
+	}
+	if o.seamMaskOut != "" {
+		if name, _, err := lookupEncoder("", o.seamMaskOut); err != nil || name == "jpeg" {
+			return errors.New("--seam-mask needs a lossless format: use a .tif or .png file")
+		}
+	}
+	if o.diffHeatmap != "" && o.diffRef == "" {
+		return errors.New("--diff-heatmap needs --diff")
+	}
+	if o.diffRef != "" {
+		if name, _, err := lookupEncoder("", o.diffHeatmap); o.diffHeatmap != "" && (err != nil || name == "jpeg") {
+			return errors.New("--diff-heatmap needs a 16-bit format: use a .tif or .png file")
+		}
+	}
+	if o.colStart != "bottom" && o.colStart != "top" {
+		return fmt.Errorf("invalid column start: %s (use bottom or top)", o.colStart)
+	}
+	if o.rowStart != "left" && o.rowStart != "right" {
+		return fmt.Errorf("invalid row start: %s (use left or right)", o.rowStart)
+	}
+	// only the start flag of the chosen snake direction applies
+	o.snakeReverse = o.colStart == "top"
+	if o.snake == "horizontal" {
+		o.snakeReverse = o.rowStart == "right"
+	}
+	if o.nameTemplate != "" && o.exportDir == "" {
+		return errors.New("--name-template needs --export-tiles")
+	}
+	if o.centerWeight < 0 || o.centerWeight > 1 {
+		return errors.New("--center-weight must be between 0 and 1")
+	}
+	if o.centerWeight > 0 && o.blend != "average" && o.blend != "feather" && o.weightsFile == "" {
+		return errors.New("--center-weight needs an averaging blend; add --blend average or feather")
+	}
+	if o.featherW >= 0 && o.blend != "feather" {
+		return errors.New("--feather-width needs --blend feather")
+	}
+	if o.sumTaper < 0 {
+		return errors.New("--sum-taper must be >= 0")
+	}
+	if o.sumTaper > 0 && ((o.blend != "" && o.blend != "sum") || o.weightsFile != "") {
+		return errors.New("--sum-taper needs the sum blend")
+	}
+	switch o.accumulate {
+	case "int":
+	case "float":
+		if (o.blend != "" && o.blend != "sum") || o.weightsFile != "" {
+			return errors.New("--accumulate float needs the sum blend")
+		}
+	default:
+		return fmt.Errorf("invalid --accumulate: %s (use int or float)", o.accumulate)
+	}
+	if o.accumulateScale != "linear" && o.accumulateScale != "log" {
+		return fmt.Errorf("invalid --accumulate-scale: %s (use linear or log)", o.accumulateScale)
+	}
+	if o.accumulateScale != "linear" && o.accumulate != "float" {
+		return errors.New("--accumulate-scale needs --accumulate float")
+	}
+	switch o.featherAxis {
+	case "both":
+	case "x", "y":
+		if o.blend != "feather" {
+			return errors.New("--feather-axis needs --blend feather")
+		}
+	default:
+		return fmt.Errorf("invalid --feather-axis %q (use x, y or both)", o.featherAxis)
+	}
+	if o.grid != "" {
+		r, c, err := parseGrid(o.grid)
+		if err != nil {
+			return err
+		}
+		if o.rows != 0 && o.rows != r {
+			return fmt.Errorf("--grid %s has %d rows but --rows is %d", o.grid, r, o.rows)
+		}
+		if o.cols != 0 && o.cols != c {
+			return fmt.Errorf("--grid %s has %d columns but --cols is %d", o.grid, c, o.cols)
+		}
+		o.rows, o.cols = r, c
+	}
+	if !o.freePlacement {
+		o.fillFromImageJ()
+	}
+	if !o.freePlacement && o.exportDir == "" && (o.rows <= 0 || o.cols <= 0) {
+		return errors.New("rows and cols must be > 0")
+	}
+	if o.downsampleInput != 0 {
+		if o.downsample != 1 && o.downsample != o.downsampleInput {
+			return errors.New("--downsample and --downsample-input disagree; use only --downsample-input")
+		}
+		o.downsample = o.downsampleInput
+	}
+	if o.downsample <= 0 {
+		return errors.New("downsample factor must be >= 1")
+	}
+	var err error
+	if o.inFilter, err = parseFilter(o.inFilterName); err != nil {
+		return fmt.Errorf("--input-filter: %v", err)
+	}
+	if o.outFilter, err = parseFilter(o.outFilterName); err != nil {
+		return fmt.Errorf("--output-filter: %v", err)
+	}
+	if o.registerFilter, err = parseFilter(o.registerFilterName); err != nil {
+		return fmt.Errorf("--register-filter: %v", err)
+	}
+	if o.maxDim < 0 {
+		return errors.New("--max-dimension must be >= 0")
+	}
+	if o.maxDim > 0 && o.downsample != 1 {
+		return errors.New("--max-dimension chooses the downsample factor; drop --downsample")
+	}
+	if o.formatName, o.enc, err = lookupEncoder(o.format, o.output); err != nil {
+		return err
+	}
+	if _, err := tiffCompression(o.compression); err != nil {
+		return err
+	}
+	if o.flat && o.formatName != "tiff" {
+		return fmt.Errorf("--flat applies to TIFF output, not %s", o.formatName)
+	}
+	o.outDefault = channelOutput{o.bitDepth, o.compression}
+	if o.channelOut != "" {
+		if !o.splitChannels {
+			return errors.New("--channel-output needs --split-channels")
+		}
+		if o.chOutputs, err = parseChannelOutput(o.channelOut, o.outDefault); err != nil {
+			return err
+		}
+	}
+	if o.outputScale <= 0 {
+		return errors.New("output scale must be > 0")
+	}
+	if o.sharpenSpec != "" {
+		if o.sharpenAmount, o.sharpenRadius, err = parseSharpen(o.sharpenSpec); err != nil {
+			return err
+		}
+	}
+	switch o.outRotate {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("invalid rotation: %d (use 90, 180 or 270)", o.outRotate)
+	}
+	if o.set["dpi"] {
+		if err := checkDPI(o.dpi); err != nil {
+			return err
+		}
+	}
+	switch o.square {
+	case "", "center", "top-left":
+	default:
+		return fmt.Errorf("invalid square canvas placement: %s (use center or top-left)", o.square)
+	}
+	if o.align < 0 {
+		return fmt.Errorf("invalid align: %d (must be positive, or 0 to disable)", o.align)
+	}
+
+	if o.scaleBarLen != "" {
+		if o.pixelSize <= 0 {
+			return errors.New("--scalebar needs --pixelsize")
+		}
+		if o.bar.lengthUM, err = parseLength(o.scaleBarLen); err != nil {
+			return err
+		}
+		if o.bar.color, err = parseColor(o.scaleBarColor); err != nil {
+			return err
+		}
+		switch o.scaleBarPos {
+		case "top-left", "top-right", "bottom-left", "bottom-right":
+		default:
+			return fmt.Errorf("invalid scale bar position: %s", o.scaleBarPos)
+		}
+		o.bar.position = o.scaleBarPos
+		o.bar.label = strings.Replace(o.scaleBarLen, "um", "µm", 1)
+	}
+
+	switch o.sortOrder {
+	case "name":
+	case "time":
+	default:
+		return fmt.Errorf("invalid sort order: %s (use name or time)", o.sortOrder)
+	}
+	if o.regexStr != "" {
+		if o.regex, err = regexp.Compile(o.regexStr); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+
+	if o.watch {
+		if o.dir == "" || o.listFile != "" {
+			return errors.New("--watch needs --dir")
+		}
+		if o.output == "-" {
+			return errors.New("--watch cannot write to stdout")
+		}
+		if o.watchInterval <= 0 {
+			return errors.New("--watch-interval must be > 0")
+		}
+	}
+
+	if o.assign != "" {
+		if o.channels, err = parseAssign(o.assign); err != nil {
+			return err
+		}
+	}
+	if o.denoise != "" {
+		d, err := parseDenoise(o.denoise)
+		if err != nil {
+			return err
+		}
+		o.denoiseSpec = &d
+	}
+	if o.inputGamma <= 0 || o.outputGamma <= 0 {
+		return errors.New("--input-gamma and --output-gamma must be positive")
+	}
+	if o.normalize {
+		if o.normLow, o.normHigh, err = parsePercentiles(o.normWindow); err != nil {
+			return err
+		}
+	}
+	if o.trim {
+		if o.trimThreshold <= 0 || o.trimThreshold >= 1 {
+			return errors.New("trim threshold must be between 0 and 1")
+		}
+		o.trimBelow = o.trimThreshold * 65535
+	}
+	if o.autocrop && (o.autocropThreshold < 0 || o.autocropThreshold >= 1) {
+		return errors.New("autocrop threshold must be at least 0 and below 1")
+	}
+	return nil
+}
+
+// fillFromImageJ fills in the grid size and overlaps the flags leave unset from
+// the ImageJ metadata of the first tile
+func (o *runOptions) fillFromImageJ() {
+	h, ok := imageJGrid(firstTile(o.dir, o.listFile, o.regexStr))
+	if !ok {
+		return
+	}
+	var used []any
+	if o.rows == 0 && o.cols == 0 && h.rows > 0 && h.cols > 0 {
+		o.rows, o.cols = h.rows, h.cols
+		used = append(used, "rows", h.rows, "cols", h.cols)
+	}
+	if !o.set["overlapX"] && h.overlapX >= 0 {
+		o.overlapX = h.overlapX
+		used = append(used, "overlapX", h.overlapX)
+	}
+	if !o.set["overlapY"] && h.overlapY >= 0 {
+		o.overlapY = h.overlapY
+		used = append(used, "overlapY", h.overlapY)
+	}
+	if len(used) > 0 {
+		slog.Info("using grid settings from the ImageJ metadata", used...)
+	}
+}
+
+// gridOrder returns the grid layout of the run, with the cells of --fill partial
+// or --index-map when given
+func (o *runOptions) gridOrder(cells []image.Point) gridOrder {
+	return gridOrder{o.rows, o.cols, o.snake, o.snakeReverse, cells}
+}
+
+// loadOptions returns how the tiles at paths are read and preprocessed, loading
+// the flat-field references and exposure times they need
+func (o *runOptions) loadOptions(paths []string, client *http.Client) (loadOptions, error) {
+	opts := loadOptions{downsample: o.downsample, filter: o.inFilter, timeout: o.timeout, skipErrors: o.skipErrors,
+		normalize: o.normalize, normLow: o.normLow, normHigh: o.normHigh, promoteDepth: o.promoteDepth,
+		denoise: o.denoiseSpec, client: client}
+	var err error
+	if o.flatFieldPath != "" {
+		if opts.flat, err = loadFlatField(o.flatFieldPath, client); err != nil {
+			return opts, err
+		}
+	}
+	if o.inputGamma != 1 {
+		opts.gamma = newGammaCurve(o.inputGamma)
+	}
+	if o.checkpointDir != "" {
+		// the per-tile settings, downsampling, exposure and flat-field reference,
+		// go into each tile's key
+		opts.checkpoint = &checkpoint{dir: o.checkpointDir, settings: fmt.Sprintf("filter=%s\ndenoise=%s\ngamma=%g", o.inFilterName, o.denoise, o.inputGamma)}
+	}
+	if o.exposureTag != 0 || o.exposuresFile != "" {
+		var exposures map[string]float64
+		if o.exposuresFile != "" {
+			if exposures, err = loadWeights(o.exposuresFile); err != nil {
+				return opts, err
+			}
+		}
+		if opts.exposure, err = exposureScales(paths, exposures, uint16(o.exposureTag)); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// inputs are the tiles of a run
+type inputs struct {
+	paths     []string
+	positions map[string]position // placement of each --tiles entry by path
+	excluded  []bool              // grid tiles left out by --exclude, whose cells stay blank; nil for none
+	cells     []image.Point       // cell of each tile from --fill partial or --index-map; nil to follow the snake
+}
+
+// listInputs lists the tiles given by --tiles, --stack, --list or --dir. The pages
+// of a --stack stay registered until the caller passes the listed paths to
+// forgetStack.
+func listInputs(o *runOptions) (*inputs, error) {
+	in := &inputs{}
+	var err error
+	switch {
+	case o.tilesFile != "":
+		var pos []position
+		if in.paths, pos, err = loadTileFile(o.tilesFile); err != nil {
+			return nil, err
+		}
+		in.positions = make(map[string]position, len(in.paths))
+		for i, p := range in.paths {
+			in.positions[p] = pos[i]
+		}
+	case o.stackFile != "":
+		if in.paths, err = listStack(o.stackFile); err != nil {
+			return nil, err
+		}
+		if len(in.paths) == 0 {
+			return nil, fmt.Errorf("%w: %s has no pages", ErrNoImages, o.stackFile)
+		}
+		slog.Info("reading tiles from stack pages", "stack", o.stackFile, "pages", len(in.paths))
+	case o.listFile != "":
+		if in.paths, err = loadListFile(o.listFile); err != nil {
+			return nil, err
+		}
+		if len(in.paths) == 0 {
+			return nil, fmt.Errorf("%w: %s lists none", ErrNoImages, o.listFile)
+		}
+	default:
+		if o.dir == "" {
+			return nil, UsageError{errors.New("one of --dir, --list, --stack or --tiles must be specified")}
+		}
+		if in.paths, err = getImagePaths(o.dir, o.regex); err != nil {
+			return nil, err
+		}
+		if len(in.paths) == 0 {
+			if o.regex == nil {
+				return nil, fmt.Errorf("%w: no .tif/.tiff files found in %s", ErrNoImages, o.dir)
+			}
+			all, err := getImagePaths(o.dir, nil)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: no .tif/.tiff files in %s match --regex %q (%d TIFF files there in total)", ErrNoImages, o.dir, o.regexStr, len(all))
+		}
+	}
+	return in, nil
+}
+
+// arrange orders the listed tiles, drops duplicates and excluded tiles, and reads
+// the grid cells of --fill partial and --index-map. With --max-dimension it also
+// picks the downsample factor from the first tile.
+func (in *inputs) arrange(o *runOptions, client *http.Client) error {
+	var err error
+	if o.sortOrder == "time" {
+		in.paths = sortByTime(in.paths)
+	}
+	if o.originIndex >= 0 {
+		order, err := gridCells(o.rows, o.cols, o.snake, o.snakeReverse)
+		if err != nil {
+			return UsageError{err}
+		}
+		if in.paths, err = applyOriginIndex(in.paths, order, o.originIndex); err != nil {
+			return err
+		}
+	}
+	if o.dedup || o.dedupDrop {
+		in.paths = dedupTiles(in.paths, o.timeout, o.dedupDrop, client)
+	}
+	// excluded tiles are dropped where tiles are placed by name or position; grid
+	// tiles keep their cells, which are left blank
+	if o.excludeFile != "" {
+		ex, err := loadExcludeList(o.excludeFile)
+		if err != nil {
+			return err
+		}
+		in.excluded = ex.mark(in.paths)
+		if o.freePlacement || o.partial {
+			in.paths, in.excluded = without(in.paths, in.excluded), nil
+			if len(in.paths) == 0 {
+				return fmt.Errorf("%w: every tile is excluded by %s", ErrNoImages, o.excludeFile)
+			}
+		}
+	}
+	if o.maxDim > 0 && len(in.paths) > 0 {
+		cfg, err := tiffConfig(in.paths[0], client)
+		if err != nil {
+			return fmt.Errorf("%s: %v", in.paths[0], err)
+		}
+		if o.downsample, err = fitDownsample(cfg.Width, cfg.Height, o.overlapX, o.overlapY, o.rows, o.cols, o.maxDim); err != nil {
+			return err
+		}
+		slog.Info("downsampling to fit --max-dimension", "factor", o.downsample, "max_dimension", o.maxDim)
+	}
+	if !o.freePlacement && o.exportDir == "" {
+		checkTransposed(in.paths, o.rows, o.cols)
+	}
+
+	if o.partial {
+		if in.cells, err = cellsFromNames(in.paths, o.cellRe, o.cellBase, o.rows, o.cols); err != nil {
+			return err
+		}
+	}
+	if o.indexMapFile != "" {
+		if in.cells, err = loadIndexMap(o.indexMapFile); err != nil {
+			return err
+		}
+		if err := checkCells(in.cells, o.rows, o.cols); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runValidate checks the headers, or with --validate-only=deep the pixels, of the
+// tiles the run would stitch
+func runValidate(o *runOptions, in *inputs, client *http.Client) error {
+	deep := o.validateOnly == "deep"
+	n := o.rows * o.cols
+	switch {
+	case o.freePlacement || o.exportDir != "":
+		// positioned and exported tiles may differ in size
+		return validateTiles(in.paths, false, deep, o.timeout, client)
+	case o.assign != "":
+		for _, name := range channelOrder {
+			if pattern, ok := o.channels[name]; ok {
+				chPaths, err := selectTiles(filterGlob(in.paths, pattern), n, o.requireExact, fmt.Sprintf("%s (%s)", name, pattern))
+				if err != nil {
+					return err
+				}
+				if err := validateTiles(chPaths, true, deep, o.timeout, client); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	}
+	paths := in.paths
+	if !o.partial {
+		var err error
+		if paths, err = selectTiles(paths, n, o.requireExact, ""); err != nil {
+			return err
+		}
+	}
+	return validateTiles(paths, true, deep, o.timeout, client)
+}
+
+// runExport writes the loaded and preprocessed tiles to --export-tiles
+func runExport(o *runOptions, in *inputs, load loadOptions) error {
+	opts := exportOptions{dir: o.exportDir, resume: o.resume, validate: o.resumeValidate, template: o.nameTemplate, channel: o.regex}
+	needsCell, err := checkTemplate(o.nameTemplate)
+	if err != nil {
+		return UsageError{err}
+	}
+	paths := in.paths
+	if needsCell {
+		// {row} and {col} place the tiles on the grid, so export only the grid's tiles
+		if o.rows <= 0 || o.cols <= 0 {
+			return UsageError{errors.New("{row} and {col} in --name-template need --rows and --cols")}
+		}
+		if paths, err = selectTiles(paths, o.rows*o.cols, o.requireExact, ""); err != nil {
+			return err
+		}
+		if opts.cells, err = o.gridOrder(in.cells).cellList(); err != nil {
+			return err
+		}
+	}
+	return exportTiles(paths, load, opts)
+}
+
+// runScanOverlap scores the overlaps of --scan-overlap on the seams of a few tiles
+// and writes the best ones to w as flags
+func runScanOverlap(o *runOptions, in *inputs, load loadOptions, w io.Writer) error {
+	lo, hi, err := parseRange(o.scanRange)
+	if err != nil {
+		return err
+	}
+	paths, err := selectTiles(in.paths, o.rows*o.cols, o.requireExact, "")
+	if err != nil {
+		return err
+	}
+	cells, err := gridCells(o.rows, o.cols, o.snake, o.snakeReverse)
+	if err != nil {
+		return err
+	}
+	pairsX := scanPairs(cells, true)
+	pairsY := scanPairs(cells, false)
+
+	// load only the tiles taking part in a scanned seam, at full resolution
+	needed := make(map[int]bool)
+	for _, p := range append(pairsX, pairsY...) {
+		needed[p[0]], needed[p[1]] = true, true
+	}
+	scanOpts := load
+	scanOpts.downsample = 1
+	tiles := make(map[int]*image.Gray16)
+	for i := range needed {
+		imgs, err := loadTiles(paths[i:i+1], scanOpts)
+		if err != nil {
+			return err
+		}
+		tiles[i] = toGray16(imgs[0])
+	}
+
+	recommended := ""
+	if best, score, ok := scanOverlap(tiles, pairsX, lo, hi, true); ok {
+		slog.Info("best overlap", "axis", "x", "overlap", best, "mismatch", score, "pairs", len(pairsX))
+		recommended += fmt.Sprintf(" --overlapX %d", best)
+	} else {
+		slog.Warn("no horizontal neighbours to score", "axis", "x")
+	}
+	if best, score, ok := scanOverlap(tiles, pairsY, lo, hi, false); ok {
+		slog.Info("best overlap", "axis", "y", "overlap", best, "mismatch", score, "pairs", len(pairsY))
+		recommended += fmt.Sprintf(" --overlapY %d", best)
+	} else {
+		slog.Warn("no vertical neighbours to score", "axis", "y")
+	}
+	if recommended != "" {
+		fmt.Fprintf(w, "Recommended:%s\n", recommended)
+	}
+	return nil
+}
+
+// runDetectOrder scores the tile orders of the grid and writes the best to w
+func runDetectOrder(o *runOptions, in *inputs, load loadOptions, client *http.Client, w io.Writer) error {
+	paths, err := selectTiles(in.paths, o.rows*o.cols, o.requireExact, "")
+	if err != nil {
+		return err
+	}
+	cfg, err := tiffConfig(paths[0], client)
+	if err != nil {
+		return fmt.Errorf("%s: %v", paths[0], err)
+	}
+	step := image.Pt(cfg.Width-o.overlapX, cfg.Height-o.overlapY)
+	return detectOrder(paths, o.rows, o.cols, o.stageTags, step, o.stageTolerance, scaledPx(o.overlapX, o.downsample), scaledPx(o.overlapY, o.downsample), load, w)
+}
+
+// composition is a stitched mosaic and what was recorded while stitching it
+type composition struct {
+	outs      []image.Image // the mosaic, or its three planes with --split-channels
+	kind      string
+	tiles     int           // tiles stitched, over all channels
+	layout    []tileLayout  // where the tiles landed, for --svg-overlay
+	weightMap *image.Gray16 // blending weights of the first stitch, for --weightmap
+	seams     *image.Gray   // seam mask of the first stitch, for --seam-mask
+	cropAt    image.Point   // where the autocropped mosaic starts on the stitched canvas
+}
+
+// composer stitches the tiles of a run
+type composer struct {
+	o        *runOptions
+	in       *inputs
+	load     loadOptions
+	weights  map[string]float64 // per-tile --weights; nil to sum overlaps
+	canvases *scratch
+	client   *http.Client
+}
+
+// compose loads the tiles and stitches them: each channel of --assign on the
+// grid, at the positions of --positions, --overview or --tiles, or on the grid
+func compose(o *runOptions, in *inputs, load loadOptions, canvases *scratch, client *http.Client) (*composition, error) {
+	cp := composer{o: o, in: in, load: load, canvases: canvases, client: client}
+	if o.weightsFile != "" {
+		var err error
+		if cp.weights, err = loadWeights(o.weightsFile); err != nil {
+			return nil, err
+		}
+	}
+	c := &composition{kind: "grayscale"}
+	var err error
+	switch {
+	case o.assign != "":
+		err = cp.channels(c)
+	case o.freePlacement:
+		err = cp.placed(c)
+	default:
+		err = cp.grid(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// weightsFor returns nil when no weights file was given so mosaic sums overlaps
+func (cp *composer) weightsFor(paths []string) []float64 {
+	if cp.weights == nil {
+		return nil
+	}
+	return tileWeights(paths, cp.weights)
+}
+
+// recorders returns the mosaic callbacks keeping the weight map and seam mask of
+// the first stitch in c, or nil where they are not wanted; colour planes share
+// one geometry
+func (cp *composer) recorders(c *composition) (onWeightMap func(*image.Gray16), onSeamMask func(*image.Gray)) {
+	if cp.o.weightMapOut != "" {
+		onWeightMap = func(m *image.Gray16) {
+			if c.weightMap == nil {
+				c.weightMap = m
+			}
+		}
+	}
+	if cp.o.seamMaskOut != "" {
+		onSeamMask = func(m *image.Gray) {
+			if c.seams == nil {
+				c.seams = m
+			}
+		}
+	}
+	return onWeightMap, onSeamMask
+}
+
+// stitchTiles runs stitch on the tiles directly, or on each colour plane in
+// --color and --split-channels modes, and sets the outputs and their kind in c.
+// --split-channels yields the three planes as separate outputs.
+func (cp *composer) stitchTiles(c *composition, imgs []image.Image, stitch func([]image.Image) (*image.Gray16, error)) error {
+	o := cp.o
+	if !o.colorMode && !o.splitChannels {
+		out, err := stitch(imgs)
+		c.outs, c.kind = []image.Image{out}, "grayscale"
+		return err
+	}
+	planeTiles, alphaTiles, err := splitPlanes(imgs, o.blendSpace)
+	if err != nil {
+		return err
+	}
+	var planes [3]*image.Gray16
+	for i := range planes {
+		if planes[i], err = stitch(planeTiles[i]); err != nil {
+			return err
+		}
+	}
+	var alpha *image.Gray16
+	if alphaTiles != nil {
+		if alpha, err = stitch(alphaTiles); err != nil {
+			return err
+		}
+	}
+	if o.splitChannels {
+		if alpha != nil {
+			unpremultiplyPlanes(planes, alpha)
+		}
+		c.outs, c.kind = []image.Image{planes[0], planes[1], planes[2]}, "grayscale"
+		return nil
+	}
+	out, err := mergePlanes(planes, alpha, o.blendSpace)
+	c.outs, c.kind = []image.Image{out}, "RGBA"
+	return err
+}
+
+// channels stitches the tiles of each --assign channel on the grid with its own
+// --channel-geometry and composites the planes
+func (cp *composer) channels(c *composition) error {
+	o := cp.o
+	geoms, err := parseChannelGeometry(o.channelGeom, channelGeometry{o.overlapX, o.overlapY, o.downsample})
+	if err != nil {
+		return UsageError{err}
+	}
+	planes := make(map[string]*image.Gray16)
+	var ref image.Rectangle // canvas of the first channel using the global geometry
+	for _, name := range channelOrder {
+		pattern, ok := o.channels[name]
+		if !ok {
+			continue
+		}
+		g, overridden := geoms[name]
+		if !overridden {
+			g = channelGeometry{o.overlapX, o.overlapY, o.downsample}
+		}
+		chPaths, err := selectTiles(filterGlob(cp.in.paths, pattern), o.rows*o.cols, o.requireExact, fmt.Sprintf("%s (%s)", name, pattern))
+		if err != nil {
+			return err
+		}
+		chOpts := cp.load
+		chOpts.downsample = g.downsample
+		imgs, err := loadTiles(chPaths, chOpts)
+		if err != nil {
+			return err
+		}
+		c.tiles += len(imgs)
+		logOverlaps(g.overlapX, g.overlapY, o.overlapTurn, g.downsample, "channel", name)
+		plane, err := mosaic(imgs, o.rows, o.cols, mosaicOptions{
+			overlapX:     scaledPx(g.overlapX, g.downsample),
+			overlapY:     scaledPx(g.overlapY, g.downsample),
+			snake:        o.snake,
+			snakeReverse: o.snakeReverse,
+			cells:        cp.in.cells,
+			blend:        o.blend,
+			featherWidth: scaledOrUnset(o.featherW, g.downsample),
+			featherAxis:  o.featherAxis,
+			sumTaper:     scaledPx(o.sumTaper, g.downsample),
+			centerWeight: o.centerWeight,
+			overlapTurn:  scaledOrUnset(o.overlapTurn, g.downsample),
+			weights:      cp.weightsFor(chPaths),
+			names:        chPaths,
+			checkerboard: o.qcMode == "checkerboard",
+			trimBelow:    o.trimBelow,
+			scratch:      cp.canvases,
+		})
+		if err != nil {
+			return err
+		}
+		planes[name] = plane
+		if ref.Empty() && !overridden {
+			ref = plane.Bounds()
+		}
+	}
+	// Channels stitched with their own geometry share logical positions, so
+	// resample them onto the reference canvas.
+	for _, name := range channelOrder {
+		plane, ok := planes[name]
+		if !ok {
+			continue
+		}
+		if ref.Empty() {
+			ref = plane.Bounds()
+		}
+		if _, overridden := geoms[name]; overridden && plane.Bounds() != ref {
+			slog.Info("resampling channel plane", "channel", name, "from", plane.Bounds().Size(), "to", ref.Size())
+			planes[name] = resize.Resize(uint(ref.Dx()), uint(ref.Dy()), plane, cp.load.filter).(*image.Gray16)
+		}
+	}
+	out, err := composite(planes)
+	if err != nil {
+		return err
+	}
+	c.outs, c.kind = []image.Image{out}, "RGBA"
+	return nil
+}
+
+// placed stitches the tiles at the positions of --tiles, --positions or --overview
+func (cp *composer) placed(c *composition) error {
+	o, paths := cp.o, cp.in.paths
+	placed := paths
+	var pos []position
+	if cp.in.positions != nil {
+		for _, p := range paths {
+			pos = append(pos, cp.in.positions[p])
+		}
+	}
+	if o.positionsFile != "" {
+		positions, err := loadPositions(o.positionsFile)
+		if err != nil {
+			return err
+		}
+		placed = nil
+		for _, p := range paths {
+			if pt, ok := lookupPosition(positions, p); ok {
+				placed = append(placed, p)
+				pos = append(pos, pt)
+			}
+		}
+		if len(placed) == 0 {
+			return fmt.Errorf("none of the %d images have an entry in %s", len(paths), o.positionsFile)
+		}
+		if skipped := len(paths) - len(placed); skipped > 0 {
+			slog.Warn("ignoring images without a position", "count", skipped, "positions", o.positionsFile)
+		}
+	}
+	imgs, err := loadTiles(placed, cp.load)
+	if err != nil {
+		return err
+	}
+	c.tiles = len(imgs)
+	if o.overviewPath != "" {
+		if pos, err = overviewPositions(imgs, placed, o.overviewPath, o.overviewScale, o.downsample, o.registerFilter, cp.client); err != nil {
+			return err
+		}
+	}
+	// Physical positions are placed on a canvas at --pixelsize; tiles acquired at
+	// other pixel sizes are resampled onto it first.
+	if o.positionUnits == "um" {
+		pos = physicalToPixels(pos, o.pixelSize)
+		if o.tileSizesFile != "" {
+			sizes, err := loadPixelSizes(o.tileSizesFile)
+			if err != nil {
+				return err
+			}
+			rescaleTiles(imgs, placed, sizes, o.pixelSize, cp.load.filter)
+		}
+	}
+	if o.tileConfigOut != "" {
+		if err := writeTileConfig(o.tileConfigOut, placed, pos); err != nil {
+			return err
+		}
+	}
+	pts := scalePositions(pos, o.downsample)
+	if o.svgOverlay != "" {
+		c.layout = positionedLayout(imgs, placed, pts)
+	}
+	onWeightMap, onSeamMask := cp.recorders(c)
+	return cp.stitchTiles(c, imgs, func(imgs []image.Image) (*image.Gray16, error) {
+		return composeAt(imgs, pts, mosaicOptions{
+			blend:           o.blend,
+			accumulate:      o.accumulate,
+			accumulateScale: o.accumulateScale,
+			centerWeight:    o.centerWeight,
+			weights:         cp.weightsFor(placed),
+			onWeightMap:     onWeightMap,
+			onSeamMask:      onSeamMask,
+			scratch:         cp.canvases,
+		})
+	})
+}
+
+// grid stitches the tiles on the grid, writing the seam and registration reports
+// and the per-row exports along the way
+func (cp *composer) grid(c *composition) error {
+	o, in := cp.o, cp.in
+	n := o.rows * o.cols
+	paths, cells, excluded := in.paths, in.cells, in.excluded
+	var missing []bool
+	var err error
+	if o.partial {
+		slog.Info("filling the grid partially", "tiles", len(paths), "cells", n)
+		cells, missing = fillGrid(cells, o.rows, o.cols)
+	} else if paths, err = selectTiles(paths, n, o.requireExact, ""); err != nil {
+		return err
+	}
+	order := o.gridOrder(cells)
+	if o.verifyOrder != "" {
+		orderCells, err := order.cellList()
+		if err != nil {
+			return err
+		}
+		cfg, err := tiffConfig(paths[0], cp.client)
+		if err != nil {
+			return fmt.Errorf("%s: %v", paths[0], err)
+		}
+		step := image.Pt(cfg.Width-o.overlapX, cfg.Height-o.overlapY)
+		if err := checkStageOrder(paths, orderCells, o.stageTags, step, o.stageTolerance, o.verifyOrder == "error"); err != nil {
+			return err
+		}
+	}
+	loadPaths := paths
+	if excluded != nil {
+		excluded = excluded[:len(paths)]
+		if loadPaths = without(paths, excluded); len(loadPaths) == 0 {
+			return fmt.Errorf("%w: every tile of the grid is excluded by %s", ErrNoImages, o.excludeFile)
+		}
+	}
+	imgs, err := loadTiles(loadPaths, cp.load)
+	if err != nil {
+		return err
+	}
+	c.tiles = len(imgs)
+	if excluded != nil {
+		imgs, missing = withPlaceholders(imgs, excluded), excluded
+	}
+	if o.partial {
+		for range missing[len(imgs):] {
+			imgs = append(imgs, image.NewGray16(imgs[0].Bounds()))
+		}
+	}
+	overlapX, overlapY := scaledPx(o.overlapX, o.downsample), scaledPx(o.overlapY, o.downsample)
+	// the blank cells of a partial grid are too dark to count
+	if o.autoflat {
+		if err := flattenFromOverlaps(imgs, order, overlapX, overlapY, o.autoflatDegree); err != nil {
+			return err
+		}
+	}
+	if o.seamReport != "" || o.seamMinNCC != 0 {
+		seamCells, err := order.cellList()
+		if err != nil {
+			return err
+		}
+		if err := reportSeams(imgs, paths, seamCells, overlapX, overlapY, o.seamReport, o.seamMinNCC); err != nil {
+			return err
+		}
+	}
+	if o.registerReport != "" {
+		regCells, err := order.cellList()
+		if err != nil {
+			return err
+		}
+		if err := reportRegistration(imgs, paths, regCells, overlapX, overlapY, o.downsample, o.registerReport); err != nil {
+			return err
+		}
+	}
+	// placedAt records each placed tile's canvas position; colour planes place
+	// the tiles identically
+	var placedAt map[int]image.Point
+	var onPlace func(int, image.Point)
+	if o.tileConfigOut != "" || o.exportRowsDir != "" || o.svgOverlay != "" {
+		placedAt = make(map[int]image.Point)
+		onPlace = func(idx int, pt image.Point) { placedAt[idx] = pt }
+	}
+	onWeightMap, onSeamMask := cp.recorders(c)
+	logOverlaps(o.overlapX, o.overlapY, o.overlapTurn, o.downsample)
+	err = cp.stitchTiles(c, imgs, func(imgs []image.Image) (*image.Gray16, error) {
+		return mosaic(imgs, o.rows, o.cols, mosaicOptions{
+			overlapX:        overlapX,
+			overlapY:        overlapY,
+			snake:           o.snake,
+			snakeReverse:    o.snakeReverse,
+			cells:           cells,
+			missing:         missing,
+			blend:           o.blend,
+			featherWidth:    scaledOrUnset(o.featherW, o.downsample),
+			featherAxis:     o.featherAxis,
+			sumTaper:        scaledPx(o.sumTaper, o.downsample),
+			accumulate:      o.accumulate,
+			accumulateScale: o.accumulateScale,
+			centerWeight:    o.centerWeight,
+			overlapTurn:     scaledOrUnset(o.overlapTurn, o.downsample),
+			weights:         cp.weightsFor(paths),
+			names:           paths,
+			onWeightMap:     onWeightMap,
+			onSeamMask:      onSeamMask,
+			onPlace:         onPlace,
+			checkerboard:    o.qcMode == "checkerboard",
+			trimBelow:       o.trimBelow,
+			scratch:         cp.canvases,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if o.svgOverlay != "" {
+		for i, p := range paths {
+			if pt, ok := placedAt[i]; ok {
+				c.layout = append(c.layout, tileLayout{i, p, image.Rectangle{Min: pt, Max: pt.Add(imgs[i].Bounds().Size())}})
+			}
+		}
+	}
+	if o.tileConfigOut != "" {
+		var placed []string
+		var pos []position
+		for i, p := range paths {
+			if pt, ok := placedAt[i]; ok {
+				placed = append(placed, p)
+				pos = append(pos, position{float64(pt.X * o.downsample), float64(pt.Y * o.downsample)})
+			}
+		}
+		if err := writeTileConfig(o.tileConfigOut, placed, pos); err != nil {
+			return err
+		}
+	}
+	if o.exportRowsDir != "" {
+		rowCells, err := order.cellList()
+		if err != nil {
+			return err
+		}
+		suffixes := []string{""}
+		if o.splitChannels {
+			suffixes = []string{"_r", "_g", "_b"}
+		}
+		if err := exportRows(o.exportRowsDir, c.outs, suffixes, rowBands(imgs, rowCells, placedAt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaledOrUnset divides a pixel count by the downsample factor ds, keeping -1 (unset)
+func scaledOrUnset(v, ds int) int {
+	if v < 0 {
+		return -1
+	}
+	return scaledPx(v, ds)
+}
+
+// crop cuts the outputs, weight map and seam mask down to the bounding box of the
+// pixels above threshold, a fraction of full scale
+func (c *composition) crop(threshold float64) {
+	// the weight map, when kept, already says which pixels no tile reached
+	r := autocropBounds(c.outs, c.weightMap, threshold*65535)
+	if r.Empty() {
+		slog.Warn("autocrop found no pixels above the threshold; keeping the whole mosaic", "threshold", threshold)
+		return
+	}
+	if r == c.outs[0].Bounds() {
+		return
+	}
+	c.cropAt = r.Min
+	slog.Info("autocropped mosaic", "x", r.Min.X, "y", r.Min.Y, "width", r.Dx(), "height", r.Dy(),
+		"from", c.outs[0].Bounds().Size())
+	for i := range c.outs {
+		c.outs[i] = cropImage(c.outs[i], r)
+	}
+	if c.weightMap != nil {
+		c.weightMap = cropImage(c.weightMap, r).(*image.Gray16)
+	}
+	if c.seams != nil {
+		c.seams = cropImage(c.seams, r).(*image.Gray)
+	}
+}
+
+// writeOutputs saves the mosaic, or each of its --split-channels planes, then the
+// SVG overlay, weight map and seam mask
+func writeOutputs(o *runOptions, c *composition, client *http.Client, start time.Time) error {
+	names := []string{o.output}
+	settings := []channelOutput{o.outDefault}
+	if o.splitChannels {
+		names = channelPaths(o.output, "r", "g", "b")
+		settings = nil
+		for _, name := range channelOrder {
+			ch, ok := o.chOutputs[name]
+			if !ok {
+				ch = o.outDefault
+			}
+			settings = append(settings, ch)
+		}
+	}
+	for i, out := range c.outs {
+		if err := saveMosaic(o, c, out, names[i], settings[i], client, start); err != nil {
+			return err
+		}
+	}
+	if o.svgOverlay != "" {
+		if err := saveSVGOverlay(o.svgOverlay, names[0], image.Rectangle{Min: c.cropAt, Max: c.cropAt.Add(c.outs[0].Bounds().Size())}, o.outputScale, c.layout); err != nil {
+			return err
+		}
+	}
+	if c.weightMap != nil {
+		if err := saveGeometry(o, c.weightMap, o.weightMapOut, resize.Bilinear); err != nil {
+			return err
+		}
+		slog.Info("weight map saved", "path", o.weightMapOut, "scale", weightMapScale)
+	}
+	if c.seams != nil {
+		// nearest-neighbour scaling keeps the mask binary
+		if err := saveGeometry(o, c.seams, o.seamMaskOut, resize.NearestNeighbor); err != nil {
+			return err
+		}
+		slog.Info("seam mask saved", "path", o.seamMaskOut)
+	}
+	return nil
+}
+
+// saveMosaic applies the output scaling, annotations and bit depth ch to one
+// stitched image and encodes it to path, then compares it with --diff and writes
+// its --histogram
+func saveMosaic(o *runOptions, c *composition, out image.Image, path string, ch channelOutput, client *http.Client, start time.Time) error {
+	var err error
+	if o.outputScale != 1 {
+		w := uint(float64(out.Bounds().Dx())*o.outputScale + 0.5)
+		h := uint(float64(out.Bounds().Dy())*o.outputScale + 0.5)
+		if w == 0 || h == 0 {
+			return fmt.Errorf("output scale %g reduces the %v mosaic to nothing", o.outputScale, out.Bounds().Size())
+		}
+		out = resize.Resize(w, h, out, o.outFilter)
+	}
+
+	if o.sharpenSpec != "" {
+		out = sharpen(out, o.sharpenAmount, o.sharpenRadius)
+	}
+
+	if out, err = orient(out, o.outRotate, o.outFlip); err != nil {
+		return err
+	}
+	if o.square != "" {
+		out = padSquare(out, o.square)
+	}
+	if o.align > 0 {
+		out = padAlign(out, o.align)
+	}
+
+	if o.outputGamma != 1 {
+		out = newGammaCurve(1 / o.outputGamma).apply(out)
+	}
+
+	if o.scaleBarLen != "" {
+		// pixels in the output are larger than input pixels by the total reduction
+		outPixel := o.pixelSize * float64(o.downsample) / o.outputScale
+		if out, err = drawScaleBar(out, o.bar, outPixel); err != nil {
+			return err
+		}
+	}
+
+	if ch.bitDepth == 8 {
+		if out, err = reduceDepth(out, o.dither); err != nil {
+			return err
+		}
+	}
+
+	// "-" streams the encoded image to stdout; everything else goes to stderr
+	encOpts := EncodeOptions{Quality: o.quality, Compression: ch.compression, Flat: o.flat, DPI: o.dpi}
+	if path == "-" {
+		err = o.enc.Encode(os.Stdout, out, encOpts)
+	} else {
+		err = encodeFile(path, o.enc, out, encOpts)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("mosaic saved", "path", path, "bitdepth", ch.bitDepth, "kind", c.kind, "format", o.formatName,
+		"width", out.Bounds().Dx(), "height", out.Bounds().Dy())
+	// the mosaic is kept even when it cannot be compared with the reference
+	if o.diffRef != "" {
+		if err := reportDiff(out, o.diffRef, o.diffHeatmap, client); err != nil {
+			return err
+		}
+	}
+	if o.histOut != "" {
+		if err := writeHistogram(out, o.histOut, o.histBins); err != nil {
+			return err
+		}
+	}
+	// the summary is one plain line on stderr whatever --log-level and --log-json say
+	if !o.quiet {
+		lo, hi, mean := imageStats(out)
+		fmt.Fprintf(os.Stderr, "summary: %s %dx%d %d-bit %s, min %d, max %d, mean %.1f, %d tiles, %s\n",
+			path, out.Bounds().Dx(), out.Bounds().Dy(), ch.bitDepth, c.kind, lo, hi, mean, c.tiles,
+			time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// saveGeometry writes the weight map or seam mask m to path. It follows the
+// geometry of the mosaic, scaled with interp, but none of its annotations.
+func saveGeometry(o *runOptions, m image.Image, path string, interp resize.InterpolationFunction) error {
+	if o.outputScale != 1 {
+		m = resize.Resize(uint(float64(m.Bounds().Dx())*o.outputScale+0.5), uint(float64(m.Bounds().Dy())*o.outputScale+0.5), m, interp)
+	}
+	m, err := orient(m, o.outRotate, o.outFlip)
+	if err != nil {
+		return err
+	}
+	if o.square != "" {
+		m = padSquare(m, o.square)
+	}
+	if o.align > 0 {
+		m = padAlign(m, o.align)
+	}
+	_, enc, _ := lookupEncoder("", path)
+	return encodeFile(path, enc, m, EncodeOptions{Flat: o.flat, DPI: o.dpi})
+}
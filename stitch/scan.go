@@ -0,0 +1,131 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxScanPairs bounds how many neighbouring tile pairs --scan-overlap compares per axis
+const maxScanPairs = 4
+
+// parseRange parses an inclusive "min:max" integer range
+func parseRange(s string) (lo, hi int, err error) {
+	a, b, ok := strings.Cut(s, ":")
+	if ok {
+		lo, err = strconv.Atoi(strings.TrimSpace(a))
+		if err == nil {
+			hi, err = strconv.Atoi(strings.TrimSpace(b))
+		}
+	}
+	if !ok || err != nil || lo < 0 || hi < lo {
+		return 0, 0, fmt.Errorf("invalid range %q (use min:max with 0 <= min <= max)", s)
+	}
+	return lo, hi, nil
+}
+
+// overlapStrip calls fn with each pair of co-located pixels in the overlapping strips
+// of two neighbouring tiles. With horizontal set, a's right edge is paired with b's
+// left edge, otherwise a's bottom edge with b's top edge.
+func overlapStrip(a, b *image.Gray16, overlap int, horizontal bool, fn func(va, vb float64)) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if horizontal {
+		h := min(ab.Dy(), bb.Dy())
+		for y := 0; y < h; y++ {
+			for x := 0; x < overlap; x++ {
+				fn(float64(a.Gray16At(ab.Max.X-overlap+x, ab.Min.Y+y).Y), float64(b.Gray16At(bb.Min.X+x, bb.Min.Y+y).Y))
+			}
+		}
+		return
+	}
+	w := min(ab.Dx(), bb.Dx())
+	for y := 0; y < overlap; y++ {
+		for x := 0; x < w; x++ {
+			fn(float64(a.Gray16At(ab.Min.X+x, ab.Max.Y-overlap+y).Y), float64(b.Gray16At(bb.Min.X+x, bb.Min.Y+y).Y))
+		}
+	}
+}
+
+// seamMismatch returns the mean absolute difference between the overlapping strips
+// of two neighbouring tiles, laid out as for overlapStrip
+func seamMismatch(a, b *image.Gray16, overlap int, horizontal bool) float64 {
+	var sum float64
+	var n int
+	overlapStrip(a, b, overlap, horizontal, func(va, vb float64) {
+		sum += math.Abs(va - vb)
+		n++
+	})
+	if n == 0 {
+		return math.Inf(1)
+	}
+	return sum / float64(n)
+}
+
+// scanPairs returns up to maxScanPairs pairs of tile indices that are neighbours
+// along one axis, taken from the first row (horizontal) or first column
+func scanPairs(cells []image.Point, horizontal bool) [][2]int {
+	var pairs [][2]int
+	for _, p := range neighbourPairs(cells, horizontal) {
+		if c := cells[p[0]]; (horizontal && c.Y == 0) || (!horizontal && c.X == 0) {
+			pairs = append(pairs, p)
+		}
+	}
+	if len(pairs) > maxScanPairs {
+		pairs = pairs[:maxScanPairs]
+	}
+	return pairs
+}
+
+// neighbourPairs returns every pair of tile indices whose cells are adjacent along one
+// axis, left to right (horizontal) or top to bottom
+func neighbourPairs(cells []image.Point, horizontal bool) [][2]int {
+	index := make(map[image.Point]int, len(cells))
+	for i, c := range cells {
+		index[c] = i
+	}
+	var pairs [][2]int
+	for i, c := range cells {
+		next := image.Pt(c.X, c.Y+1)
+		if horizontal {
+			next = image.Pt(c.X+1, c.Y)
+		}
+		if j, ok := index[next]; ok {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	}
+	return pairs
+}
+
+// scanOverlap tries each overlap in [lo, hi] on the given tile pairs and returns the
+// one with the lowest mean seam mismatch. ok is false when no overlap could be scored.
+func scanOverlap(tiles map[int]*image.Gray16, pairs [][2]int, lo, hi int, horizontal bool) (best int, score float64, ok bool) {
+	score = math.Inf(1)
+	for o := lo; o <= hi; o++ {
+		if o == 0 {
+			continue
+		}
+		var total float64
+		valid := true
+		for _, p := range pairs {
+			a, b := tiles[p[0]], tiles[p[1]]
+			dim := min(a.Bounds().Dx(), b.Bounds().Dx())
+			if !horizontal {
+				dim = min(a.Bounds().Dy(), b.Bounds().Dy())
+			}
+			if o >= dim {
+				valid = false
+				break
+			}
+			total += seamMismatch(a, b, o, horizontal)
+		}
+		if !valid || len(pairs) == 0 {
+			continue
+		}
+		if m := total / float64(len(pairs)); m < score {
+			best, score, ok = o, m, true
+		}
+	}
+	return best, score, ok
+}
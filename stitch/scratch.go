@@ -0,0 +1,86 @@
+package stitch
+
+import (
+	"image"
+	"log/slog"
+	"sync"
+	"unsafe"
+)
+
+// scratch allocates the output canvases and blending accumulators of a run. With
+// a dir they live in memory-mapped scratch files there (--mmap-dir) instead of on
+// the heap. A nil *scratch allocates on the heap.
+type scratch struct {
+	dir string
+
+	mu   sync.Mutex
+	maps [][]byte
+}
+
+// alloc returns size zeroed bytes, mapped from a scratch file when s has a dir
+func (s *scratch) alloc(size int) ([]byte, bool, error) {
+	if s == nil || s.dir == "" || size == 0 {
+		return nil, false, nil
+	}
+	b, err := mmapScratch(s.dir, size)
+	if err != nil {
+		return nil, false, err
+	}
+	s.mu.Lock()
+	s.maps = append(s.maps, b)
+	s.mu.Unlock()
+	return b, true, nil
+}
+
+// gray16 returns a zeroed 16-bit canvas covering r
+func (s *scratch) gray16(r image.Rectangle) (*image.Gray16, error) {
+	pix, ok, err := s.alloc(2 * r.Dx() * r.Dy())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return image.NewGray16(r), nil
+	}
+	return &image.Gray16{Pix: pix, Stride: 2 * r.Dx(), Rect: r}, nil
+}
+
+// float64s returns n zeroed float64 values
+func (s *scratch) float64s(n int) ([]float64, error) {
+	b, ok, err := s.alloc(8 * n)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return make([]float64, n), nil
+	}
+	// mappings are page aligned, so the bytes can hold float64s
+	return unsafe.Slice((*float64)(unsafe.Pointer(unsafe.SliceData(b))), n), nil
+}
+
+// float32s returns n zeroed float32 values
+func (s *scratch) float32s(n int) ([]float32, error) {
+	b, ok, err := s.alloc(4 * n)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return make([]float32, n), nil
+	}
+	return unsafe.Slice((*float32)(unsafe.Pointer(unsafe.SliceData(b))), n), nil
+}
+
+// release unmaps every scratch file s has mapped. Nothing allocated from s may be
+// used afterwards.
+func (s *scratch) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.maps {
+		if err := munmap(b); err != nil {
+			slog.Warn("could not unmap scratch file", "err", err)
+		}
+	}
+	s.maps = nil
+}
@@ -0,0 +1,64 @@
+package stitch
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// tiffTimeLayout is the layout of the TIFF DateTime and EXIF DateTimeOriginal fields
+const tiffTimeLayout = "2006:01:02 15:04:05"
+
+// captureTime returns when the TIFF at path was acquired: its EXIF
+// DateTimeOriginal, or else its TIFF DateTime. ok is false when neither is present
+// and parses.
+func captureTime(path string) (t time.Time, ok bool) {
+	sr, f, err := openTIFF(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	d, err := readIFD(sr)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if exif, ok, err := d.sub(tagExifIFD); ok && err == nil {
+		if t, ok := parseTIFFTime(exif, tagDateTimeOrig); ok {
+			return t, true
+		}
+	}
+	return parseTIFFTime(d, tagDateTime)
+}
+
+// parseTIFFTime parses the date and time field tag of d
+func parseTIFFTime(d *tiffIFD, tag uint16) (time.Time, bool) {
+	s, ok, err := d.text(tag)
+	if !ok || err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(tiffTimeLayout, s)
+	return t, err == nil
+}
+
+// sortByTime orders paths by capture time, keeping the name order of tiles taken
+// in the same second. When any tile has no capture time the name order is kept
+// for all of them, with a warning naming the first such tile.
+func sortByTime(paths []string) []string {
+	if len(paths) == 0 {
+		return paths
+	}
+	times := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		t, ok := captureTime(p)
+		if !ok {
+			slog.Warn("tile has no capture time; keeping the name order", "path", p)
+			return paths
+		}
+		times[p] = t
+	}
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool { return times[sorted[i]].Before(times[sorted[j]]) })
+	slog.Info("tiles ordered by capture time", "tiles", len(sorted), "first", times[sorted[0]].Format(tiffTimeLayout),
+		"last", times[sorted[len(sorted)-1]].Format(tiffTimeLayout))
+	return sorted
+}
@@ -0,0 +1,179 @@
+package stitch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// stackPage locates one page of a multi-page TIFF read with --stack: the file and
+// the offset of the page's image file directory
+type stackPage struct {
+	file string
+	ifd  uint32
+}
+
+// stackPages maps the tile path of every --stack page, e.g. "scan.tif[3]", to
+// where the page lives, so tiles from a stack load like tiles from files. Batch
+// jobs run at the same time, so it is guarded by stackMu, and each page counts
+// the runs that listed it so forgetStack can drop it once none do.
+var (
+	stackMu    sync.RWMutex
+	stackPages = make(map[string]*stackEntry)
+)
+
+// stackEntry is a registered --stack page and the number of runs using it
+type stackEntry struct {
+	page stackPage
+	refs int
+}
+
+// lookupStackPage returns the --stack page registered for the tile path
+func lookupStackPage(path string) (stackPage, bool) {
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	e, ok := stackPages[path]
+	if !ok {
+		return stackPage{}, false
+	}
+	return e.page, true
+}
+
+// registerStackPage records where the --stack page with the tile path lives
+func registerStackPage(path string, page stackPage) {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+	if e, ok := stackPages[path]; ok {
+		e.page = page
+		e.refs++
+		return
+	}
+	stackPages[path] = &stackEntry{page, 1}
+}
+
+// forgetStack releases the pages listStack registered for one run
+func forgetStack(paths []string) {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+	for _, p := range paths {
+		if e, ok := stackPages[p]; ok {
+			if e.refs--; e.refs <= 0 {
+				delete(stackPages, p)
+			}
+		}
+	}
+}
+
+// listStack returns one tile path per page of the multi-page TIFF file, in page
+// order, and registers each in stackPages. The caller releases them with
+// forgetStack once the tiles are no longer read.
+func listStack(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hdr [8]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	bo, err := tiffByteOrder(hdr[:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var paths []string
+	var pages []stackPage
+	seen := make(map[uint32]bool)
+	for off := bo.Uint32(hdr[4:]); off != 0; {
+		if seen[off] {
+			return nil, fmt.Errorf("%s: image directories loop back to offset %d", file, off)
+		}
+		seen[off] = true
+		path := fmt.Sprintf("%s[%d]", file, len(paths))
+		paths = append(paths, path)
+		pages = append(pages, stackPage{file, off})
+
+		// the next directory's offset follows this one's entries
+		var cnt [2]byte
+		if _, err := f.ReadAt(cnt[:], int64(off)); err != nil {
+			return nil, fmt.Errorf("%s: page %d: %v", file, len(paths)-1, err)
+		}
+		var next [4]byte
+		if _, err := f.ReadAt(next[:], int64(off)+2+12*int64(bo.Uint16(cnt[:]))); err != nil {
+			return nil, fmt.Errorf("%s: page %d: %v", file, len(paths)-1, err)
+		}
+		off = bo.Uint32(next[:])
+	}
+	for i, p := range paths {
+		registerStackPage(p, pages[i])
+	}
+	return paths, nil
+}
+
+// tiffByteOrder returns the byte order a classic TIFF header declares
+func tiffByteOrder(hdr []byte) (binary.ByteOrder, error) {
+	var bo binary.ByteOrder
+	switch string(hdr[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	if bo.Uint16(hdr[2:]) != 42 {
+		return nil, fmt.Errorf("not a classic TIFF file")
+	}
+	return bo, nil
+}
+
+// pageReader reads a TIFF file as though the page whose directory is at ifd were
+// its first, by substituting that offset in the header
+type pageReader struct {
+	r   io.ReaderAt
+	ifd [4]byte
+}
+
+func (p pageReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	for i := max(off, 4); i < min(off+int64(n), 8); i++ {
+		b[i-off] = p.ifd[i-4]
+	}
+	return n, err
+}
+
+// openTIFF opens the local TIFF tile at path, which may be a --stack page, as a
+// reader whose first image file directory is the tile's. The caller closes f.
+func openTIFF(path string) (r *io.SectionReader, f *os.File, err error) {
+	page, isPage := lookupStackPage(path)
+	if isPage {
+		path = page.file
+	}
+	if f, err = os.Open(path); err != nil {
+		return nil, nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	var ra io.ReaderAt = f
+	if isPage {
+		var hdr [8]byte
+		if _, err := f.ReadAt(hdr[:], 0); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		bo, err := tiffByteOrder(hdr[:])
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		p := pageReader{r: f}
+		bo.PutUint32(p.ifd[:], page.ifd)
+		ra = p
+	}
+	return io.NewSectionReader(ra, 0, st.Size()), f, nil
+}
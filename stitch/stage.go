@@ -0,0 +1,157 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// defaultStageTags are the TIFF XPosition and YPosition tags
+const defaultStageTags = "286,287"
+
+// parseStageTags parses --stage-tags, the numbers of the TIFF tags holding a tile's
+// stage X and Y coordinate, e.g. 286,287
+func parseStageTags(s string) ([2]uint16, error) {
+	var tags [2]uint16
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return tags, fmt.Errorf("stage tags must be two tag numbers X,Y, got %q", s)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil {
+			return tags, fmt.Errorf("invalid stage tag %q", p)
+		}
+		tags[i] = uint16(v)
+	}
+	return tags, nil
+}
+
+// readTIFFTags returns the first value of each of the wanted numeric tags in the
+// first IFD of the TIFF file at path. Tags that are missing or not numeric are left
+// out of the result.
+func readTIFFTags(path string, wanted ...uint16) (map[uint16]float64, error) {
+	sr, f, err := openTIFF(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := readIFD(sr)
+	if err != nil {
+		return nil, err
+	}
+	vals := make(map[uint16]float64)
+	for _, tag := range wanted {
+		v, ok, err := d.floats(tag)
+		if err != nil {
+			return nil, err
+		}
+		// a rational with a zero denominator has no value
+		if ok && !math.IsInf(v[0], 0) && !math.IsNaN(v[0]) {
+			vals[tag] = v[0]
+		}
+	}
+	return vals, nil
+}
+
+// stageFit fits stage = offset + scale*grid along one axis by least squares, so
+// stage coordinates in any unit and direction can be compared with the grid
+type stageFit struct{ offset, scale float64 }
+
+// fitStage fits stage against grid along one axis. ok is false when every grid
+// value is the same.
+func fitStage(grid, stage []float64) (fit stageFit, ok bool) {
+	n := float64(len(grid))
+	var mg, ms float64
+	for i := range grid {
+		mg += grid[i]
+		ms += stage[i]
+	}
+	mg, ms = mg/n, ms/n
+	var cov, vg float64
+	for i := range grid {
+		cov += (grid[i] - mg) * (stage[i] - ms)
+		vg += (grid[i] - mg) * (grid[i] - mg)
+	}
+	if vg == 0 {
+		return stageFit{}, false
+	}
+	return stageFit{ms - cov/vg*mg, cov / vg}, true
+}
+
+// checkStageOrder compares the grid cell each tile was assigned with the stage
+// coordinates in its TIFF tags. Each axis of stage coordinates is fitted linearly
+// to the nominal grid positions, and tiles lying more than tolerance tile steps
+// from the fit are reported. step is the nominal distance between neighbouring
+// tiles in pixels. The mismatches are logged and, with fail, returned as an error.
+func checkStageOrder(paths []string, cells []image.Point, tags [2]uint16, step image.Point, tolerance float64, fail bool) error {
+	var idx []int
+	var gx, gy, sx, sy []float64
+	for i, p := range paths {
+		if i >= len(cells) {
+			break
+		}
+		if isURL(p) {
+			slog.Debug("stage tags are not read from URLs", "path", p)
+			continue
+		}
+		vals, err := readTIFFTags(p, tags[0], tags[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		x, okx := vals[tags[0]]
+		y, oky := vals[tags[1]]
+		if !okx || !oky {
+			slog.Debug("tile has no stage coordinates", "path", p, "tags", tags)
+			continue
+		}
+		idx = append(idx, i)
+		gx = append(gx, float64(cells[i].X*step.X))
+		gy = append(gy, float64(cells[i].Y*step.Y))
+		sx = append(sx, x)
+		sy = append(sy, y)
+	}
+	if len(idx) < 2 {
+		slog.Warn("too few tiles carry stage coordinates to verify the tile order", "tiles", len(idx), "tags", tags)
+		return nil
+	}
+
+	bad := 0
+	for _, axis := range []struct {
+		name        string
+		grid, stage []float64
+		step        int
+	}{{"x", gx, sx, step.X}, {"y", gy, sy, step.Y}} {
+		fit, ok := fitStage(axis.grid, axis.stage)
+		if !ok {
+			// a single row or column says nothing about this axis
+			continue
+		}
+		if fit.scale == 0 {
+			slog.Warn("stage coordinate does not follow the grid", "axis", axis.name)
+			bad++
+			continue
+		}
+		for k, i := range idx {
+			off := (axis.stage[k] - fit.offset - fit.scale*axis.grid[k]) / math.Abs(fit.scale)
+			if math.Abs(off) > tolerance*float64(axis.step) {
+				slog.Warn("tile is not where the stage put it", "path", paths[i], "axis", axis.name,
+					"row", cells[i].Y, "col", cells[i].X, "offset_px", math.Round(off), "stage", axis.stage[k])
+				bad++
+			}
+		}
+		slog.Debug("stage fit", "axis", axis.name, "units_per_px", fit.scale, "offset", fit.offset)
+	}
+	if bad == 0 {
+		slog.Info("tile order matches stage coordinates", "tiles", len(idx))
+		return nil
+	}
+	if fail {
+		return fmt.Errorf("tile order disagrees with the stage coordinates (%d mismatches); check --snake, --rows/--cols and the file sort order", bad)
+	}
+	slog.Warn("tile order disagrees with the stage coordinates; check --snake, --rows/--cols and the file sort order", "mismatches", bad)
+	return nil
+}
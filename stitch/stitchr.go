@@ -0,0 +1,1547 @@
+package stitch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/tiff"
+)
+
+var version = "dev" // default version, overridden at build time
+
+// isURL reports whether path names an HTTP(S) resource rather than a local file
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetchTIFF downloads and decodes a TIFF served over HTTP(S) through client
+func fetchTIFF(url string, client *http.Client) (image.Image, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	// the decoder needs random access, so buffer the whole body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return tiff.Decode(bytes.NewReader(data))
+}
+
+// loadTIFF loads a TIFF image from disk, from a --stack page, or over HTTP(S)
+// through client when path is a URL.
+// Failures are returned as a *TileError.
+func loadTIFF(path string, client *http.Client) (image.Image, error) {
+	if isURL(path) {
+		img, err := fetchTIFF(path, client)
+		if err != nil {
+			return nil, &TileError{path, err}
+		}
+		return img, nil
+	}
+	sr, f, err := openTIFF(path)
+	if err != nil {
+		return nil, &TileError{path, err}
+	}
+	defer f.Close()
+	img, err := tiff.Decode(sr)
+	if err != nil {
+		return nil, &TileError{path, err}
+	}
+	return img, nil
+}
+
+// getImagePaths returns TIFF files from dir, optionally filtered by regex
+func getImagePaths(dir string, regex *regexp.Regexp) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (filepath.Ext(path) == ".tif" || filepath.Ext(path) == ".tiff") {
+			if regex == nil || regex.MatchString(filepath.Base(path)) {
+				paths = append(paths, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort paths for consistent ordering
+	sort.Slice(paths, func(i, j int) bool {
+		return lessPath(paths[i], paths[j])
+	})
+
+	return paths, nil
+}
+
+var sortKeyRe = regexp.MustCompile(`-(\d+)_`)
+
+// sortKey returns the digits of the last "-<n>_" match in path with leading zeros
+// stripped, so keys of any length compare without overflowing an int.
+// ok is false when path carries no number.
+func sortKey(path string) (digits string, ok bool) {
+	nums := sortKeyRe.FindAllStringSubmatch(path, -1)
+	if len(nums) == 0 {
+		return "", false
+	}
+	digits = strings.TrimLeft(nums[len(nums)-1][1], "0") // last match
+	return digits, true
+}
+
+// lessPath orders paths by their numeric sort key, then by name.
+// Paths without a key sort after all numbered paths.
+func lessPath(a, b string) bool {
+	kA, okA := sortKey(a)
+	kB, okB := sortKey(b)
+	if okA != okB {
+		return okA
+	}
+	if len(kA) != len(kB) {
+		return len(kA) < len(kB)
+	}
+	if kA != kB {
+		return kA < kB
+	}
+	return a < b // fallback
+}
+
+// loadListFile returns images listed in a text file (one per line)
+func loadListFile(filename string) ([]string, error) {
+	var paths []string
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// sumImages adds src onto dst at position (x0,y0), summing RGB values
+// sumImagesGray16 adds src onto dst at position (x0, y0), summing pixel values
+func sumImages(dst *image.Gray16, src image.Image, x0, y0 int) {
+	bounds := src.Bounds()
+	// (x0, y0) is relative to the top-left corner of dst, wherever its bounds start
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			dstX := dst.Rect.Min.X + x0 + x
+			dstY := dst.Rect.Min.Y + y0 + y
+			if !(image.Point{dstX, dstY}.In(dst.Rect)) {
+				continue
+			}
+
+			// Convert source pixel to 16-bit grayscale
+			srcGray := color.Gray16Model.Convert(src.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+
+			// Get current destination pixel
+			dstGray := dst.Gray16At(dstX, dstY)
+
+			// Sum and clamp to 65535
+			sum := uint32(dstGray.Y) + uint32(srcGray.Y)
+			if sum > 65535 {
+				sum = 65535
+			}
+
+			dst.SetGray16(dstX, dstY, color.Gray16{uint16(sum)})
+		}
+	}
+}
+
+// weightedCanvas accumulates weighted pixel sums for weighted-average blending
+type weightedCanvas struct {
+	w, h   int
+	sum    []float64
+	weight []float64
+}
+
+func newWeightedCanvas(w, h int, s *scratch) (*weightedCanvas, error) {
+	sum, err := s.float64s(w * h)
+	if err != nil {
+		return nil, err
+	}
+	weight, err := s.float64s(w * h)
+	if err != nil {
+		return nil, err
+	}
+	return &weightedCanvas{w: w, h: h, sum: sum, weight: weight}, nil
+}
+
+// coverAlpha accumulates alpha(x, y), in tile coordinates, over the w x h footprint
+// of a tile at (x0, y0) without sampling it
+func (c *weightedCanvas) coverAlpha(x0, y0, w, h int, alpha func(x, y int) float64) {
+	for y := max(y0, 0); y < min(y0+h, c.h); y++ {
+		for x := max(x0, 0); x < min(x0+w, c.w); x++ {
+			c.weight[y*c.w+x] += alpha(x-x0, y-y0)
+		}
+	}
+}
+
+// add accumulates src at position (x0, y0) with the given weight
+func (c *weightedCanvas) add(src image.Image, x0, y0 int, weight float64) {
+	bounds := src.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			dstX := x0 + x
+			dstY := y0 + y
+			if dstX >= c.w || dstY >= c.h {
+				continue
+			}
+			srcGray := color.Gray16Model.Convert(src.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+			i := dstY*c.w + dstX
+			c.sum[i] += weight * float64(srcGray.Y)
+			c.weight[i] += weight
+		}
+	}
+}
+
+// addAlpha accumulates src at (x0, y0) like add, scaling the weight of each pixel
+// by alpha(x, y) in tile coordinates
+func (c *weightedCanvas) addAlpha(src image.Image, x0, y0 int, weight float64, alpha func(x, y int) float64) {
+	bounds := src.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			dstX := x0 + x
+			dstY := y0 + y
+			if dstX >= c.w || dstY >= c.h {
+				continue
+			}
+			srcGray := color.Gray16Model.Convert(src.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+			w := weight * alpha(x, y)
+			i := dstY*c.w + dstX
+			c.sum[i] += w * float64(srcGray.Y)
+			c.weight[i] += w
+		}
+	}
+}
+
+// minAlpha is the feather weight of pixels outside the blend band, kept above zero
+// so that tile edges covered by a single tile keep their value
+const minAlpha = 1e-6
+
+// featherRamp returns per-pixel alphas along one tile axis of length n. Alpha ramps
+// linearly from each end over width pixels, starting after a margin of (overlap-width)/2
+// pixels so that the blend is centred in the overlap. The margin is kept fractional
+// when overlap-width is odd, so the ramps of two neighbours still add up to 1.
+func featherRamp(n, overlap, width int) []float64 {
+	margin := float64(max(overlap-width, 0)) / 2
+	alpha := make([]float64, n)
+	for i := range alpha {
+		d := float64(min(i, n-1-i)) - margin
+		a := (d + 1) / float64(width+1)
+		alpha[i] = max(min(a, 1), minAlpha)
+	}
+	return alpha
+}
+
+// centerProfile returns a radial alpha for a w x h tile that is 1 at the centre
+// and falls by strength (0-1) towards the corners, favouring the sharp middle of
+// tiles affected by field curvature
+func centerProfile(w, h int, strength float64) func(x, y int) float64 {
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	return func(x, y int) float64 {
+		dx, dy := 0.0, 0.0
+		if cx > 0 {
+			dx = (float64(x) - cx) / cx
+		}
+		if cy > 0 {
+			dy = (float64(y) - cy) / cy
+		}
+		// r2 is 1 at the corners
+		r2 := (dx*dx + dy*dy) / 2
+		return max(1-strength*r2, minAlpha)
+	}
+}
+
+// featherWidth returns the blend band along an axis with the given overlap: the
+// requested width capped at the overlap, or the whole overlap when none is requested
+func featherWidth(overlap, requested int) int {
+	if requested < 0 {
+		return overlap
+	}
+	return min(overlap, requested)
+}
+
+// cover accumulates weight over the w x h footprint of a tile at (x0, y0) without
+// sampling it, tracking coverage for blends that do not average
+func (c *weightedCanvas) cover(x0, y0, w, h int, weight float64) {
+	for y := max(y0, 0); y < min(y0+h, c.h); y++ {
+		for x := max(x0, 0); x < min(x0+w, c.w); x++ {
+			c.weight[y*c.w+x] += weight
+		}
+	}
+}
+
+// weightMapScale is the 16-bit weight map value of a pixel with total weight 1
+const weightMapScale = 4096
+
+// weightMap returns the accumulated weight of every pixel as a 16-bit image in units
+// of 1/weightMapScale, so a pixel covered by two tiles of weight 1 reads 8192
+func (c *weightedCanvas) weightMap() *image.Gray16 {
+	out := image.NewGray16(image.Rect(0, 0, c.w, c.h))
+	clamped := 0
+	for i, w := range c.weight {
+		v := w*weightMapScale + 0.5
+		if v > 65535 {
+			v = 65535
+			clamped++
+		}
+		out.SetGray16(i%c.w, i/c.w, color.Gray16{uint16(v)})
+	}
+	if clamped > 0 {
+		slog.Warn("weight map clamped", "pixels", clamped, "max_weight", 65535.0/weightMapScale)
+	}
+	return out
+}
+
+// writeTo stores the weighted average of everything added so far in out, starting
+// at its top-left corner. Pixels with no accumulated weight are left black.
+func (c *weightedCanvas) writeTo(out *image.Gray16) {
+	for i, w := range c.weight {
+		if w <= 0 {
+			continue
+		}
+		v := c.sum[i]/w + 0.5
+		if v > 65535 {
+			v = 65535
+		}
+		out.SetGray16(out.Rect.Min.X+i%c.w, out.Rect.Min.Y+i/c.w, color.Gray16{uint16(v)})
+	}
+}
+
+// loadWeights reads per-tile weights from a text file with one "<file> <weight>" pair
+// per line. Blank lines and lines starting with # are ignored.
+func loadWeights(filename string) (map[string]float64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	weights := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<file> <weight>\"", filename, lineNo)
+		}
+		// the weight is the last field so file names may contain spaces
+		w, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %q", filename, lineNo, fields[len(fields)-1])
+		}
+		name := strings.TrimSpace(strings.TrimSuffix(line, fields[len(fields)-1]))
+		weights[name] = w
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// tileWeights looks up the weight of each path by full path, then by base name.
+// Tiles not listed get a weight of 1.
+func tileWeights(paths []string, weights map[string]float64) []float64 {
+	out := make([]float64, len(paths))
+	for i, p := range paths {
+		out[i] = 1
+		if w, ok := weights[p]; ok {
+			out[i] = w
+		} else if w, ok := weights[filepath.Base(p)]; ok {
+			out[i] = w
+		}
+	}
+	return out
+}
+
+// parseGrid parses a grid size "ROWSxCOLS" such as "4x6"
+func parseGrid(s string) (rows, cols int, err error) {
+	r, c, ok := strings.Cut(strings.ToLower(s), "x")
+	if ok {
+		rows, err = strconv.Atoi(strings.TrimSpace(r))
+		if err == nil {
+			cols, err = strconv.Atoi(strings.TrimSpace(c))
+		}
+	}
+	if !ok || err != nil || rows <= 0 || cols <= 0 {
+		return 0, 0, fmt.Errorf("invalid grid %q (use ROWSxCOLS, e.g. 4x6)", s)
+	}
+	return rows, cols, nil
+}
+
+// gridOrder describes how tiles fill a rows x cols grid: in a vertical or
+// horizontal snake, or at the explicit cells of an index map
+type gridOrder struct {
+	rows, cols int
+	snake      string
+	reverse    bool          // start the snake bottom → top (vertical) or right → left (horizontal) instead
+	cells      []image.Point // explicit (col,row) cell per tile, overriding snake
+}
+
+// check reports an unknown snake mode or an invalid index map
+func (o gridOrder) check() error {
+	if o.cells != nil {
+		return checkCells(o.cells, o.rows, o.cols)
+	}
+	switch o.snake {
+	case "horizontal", "vertical", "":
+		return nil
+	}
+	return fmt.Errorf("invalid snake mode: %s (use 'vertical' or 'horizontal')", o.snake)
+}
+
+// tiles yields each tile index with its grid cell (column, row), in acquisition
+// order. The first column of a vertical snake runs bottom → top and the first row
+// of a horizontal snake left → right; reverse starts the other way. The order
+// must pass check first.
+func (o gridOrder) tiles() iter.Seq2[int, image.Point] {
+	return func(yield func(int, image.Point) bool) {
+		if o.cells != nil {
+			for i, c := range o.cells {
+				if !yield(i, c) {
+					return
+				}
+			}
+			return
+		}
+		i := 0
+		// outer steps through the rows (horizontal) or columns (vertical); inner runs
+		// along them, flipping direction on every other line
+		outer, inner := o.cols, o.rows
+		if o.snake == "horizontal" {
+			outer, inner = o.rows, o.cols
+		}
+		for a := 0; a < outer; a++ {
+			// even lines run left → right (horizontal) or bottom → top (vertical)
+			k, step := 0, 1
+			if (a%2 == 0) == o.reverse {
+				k, step = inner-1, -1
+			}
+			for ; k >= 0 && k < inner; k += step {
+				c := image.Pt(k, a)
+				if o.snake != "horizontal" {
+					c = image.Pt(a, inner-1-k)
+				}
+				if !yield(i, c) {
+					return
+				}
+				i++
+			}
+		}
+	}
+}
+
+// cellList returns the grid cell of every tile index
+func (o gridOrder) cellList() ([]image.Point, error) {
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	cells := make([]image.Point, 0, o.rows*o.cols)
+	for _, c := range o.tiles() {
+		cells = append(cells, c)
+	}
+	return cells, nil
+}
+
+// gridCells returns the grid cell (column, row) of each tile index in either
+// vertical or horizontal snake pattern; see gridOrder.tiles
+func gridCells(rows, cols int, snake string, reverse bool) ([]image.Point, error) {
+	return gridOrder{rows: rows, cols: cols, snake: snake, reverse: reverse}.cellList()
+}
+
+// applyOriginIndex reorders paths so that the tile at position origin of the sorted
+// list lands on grid cell (0,0) of the first n cells, whose traversal order cells
+// gives. It can only reverse the list: the tiles run along the traversal either
+// forwards, when origin is the position of (0,0) in it, or backwards from the end
+// of the grid's tiles, when origin is that position counted from the end. Any
+// other origin would need the list rotated, which no acquisition order produces,
+// so it is rejected. Paths beyond the grid keep their place after it.
+func applyOriginIndex(paths []string, cells []image.Point, origin int) ([]string, error) {
+	n := len(cells)
+	first := 0
+	for i, c := range cells {
+		if c == (image.Point{}) {
+			first = i
+		}
+	}
+	if origin < 0 || origin >= n {
+		return nil, fmt.Errorf("origin index %d is outside the %d tiles of the grid", origin, n)
+	}
+	switch origin {
+	case first:
+		return paths, nil
+	case n - 1 - first:
+		if len(paths) < n {
+			return nil, fmt.Errorf("%w: have %d need %d", ErrNotEnoughImages, len(paths), n)
+		}
+		out := append([]string(nil), paths...)
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+		slog.Info("reading the tiles backwards along the grid order", "origin_index", origin, "origin_tile", paths[origin])
+		return out, nil
+	}
+	if first == n-1-first {
+		return nil, fmt.Errorf("with this grid order only tile %d can be at row 0, col 0", first)
+	}
+	return nil, fmt.Errorf("with this grid order only tile %d (forwards) or %d (backwards) can be at row 0, col 0", first, n-1-first)
+}
+
+// loadIndexMap reads an explicit grid placement with one "<row> <col>" (or "<row>,<col>")
+// entry per line, giving the destination cell of each tile in sorted order.
+// Blank lines and lines starting with # are ignored.
+func loadIndexMap(filename string) ([]image.Point, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cells []image.Point
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.ReplaceAll(line, ",", " "))
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<row> <col>\"", filename, lineNo)
+		}
+		r, errR := strconv.Atoi(fields[0])
+		c, errC := strconv.Atoi(fields[1])
+		if errR != nil || errC != nil {
+			return nil, fmt.Errorf("%s:%d: invalid cell %q", filename, lineNo, line)
+		}
+		cells = append(cells, image.Pt(c, r))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cells, nil
+}
+
+// checkCells verifies that cells assigns each tile a distinct cell inside the grid
+func checkCells(cells []image.Point, rows, cols int) error {
+	if len(cells) != rows*cols {
+		return fmt.Errorf("%w: index map has %d cells, grid needs %d", ErrGridMismatch, len(cells), rows*cols)
+	}
+	seen := make(map[image.Point]int)
+	for i, c := range cells {
+		if c.X < 0 || c.X >= cols || c.Y < 0 || c.Y >= rows {
+			return fmt.Errorf("%w: tile %d is mapped to row %d, col %d outside the %dx%d grid", ErrGridMismatch, i, c.Y, c.X, rows, cols)
+		}
+		if j, dup := seen[c]; dup {
+			return fmt.Errorf("%w: tiles %d and %d are both mapped to row %d, col %d", ErrGridMismatch, j, i, c.Y, c.X)
+		}
+		seen[c] = i
+	}
+	return nil
+}
+
+// mosaicOptions holds the placement and blending settings for mosaic
+type mosaicOptions struct {
+	overlapX, overlapY int
+	overlapTurn        int // overlap along the scan axis in reversed snake rows/columns; < 0 uses overlapX/overlapY
+	snake              string
+	snakeReverse       bool            // start the snake bottom → top (vertical) or right → left (horizontal) instead
+	cells              []image.Point   // explicit (col,row) cell per tile, overriding snake
+	missing            []bool          // cells whose tile is a placeholder: left black, but still part of the canvas
+	blend              string          // sum (default), average, feather or none (later tiles overwrite)
+	featherWidth       int             // width of the feather blend band; < 0 uses the overlap
+	featherAxis        string          // x or y feathers along that axis only; "" or both feathers along both
+	sumTaper           int             // with blend sum, ramp each tile's contribution over this many pixels of every inner overlap; 0 disables
+	accumulate         string          // with blend sum, "float" sums in float32 and rescales once at the end; "" or "int" clamps each sum at 65535
+	accumulateScale    string          // rescale of a float accumulation: linear (default) or log
+	centerWeight       float64         // 0-1 strength of a radial profile favouring tile centres when averaging; 0 disables
+	weights            []float64       // per-tile weights; nil sums overlaps
+	trimBelow          float64         // drop outer grid rows/columns whose tiles all have a mean below this; 0 keeps all
+	names              []string        // tile names used when logging placement; optional
+	checkerboard       bool            // QC rendering: alternate tiles overwrite their dimmed neighbours instead of blending
+	overwrite          bool            // later tiles replace earlier ones in overlaps instead of blending
+	bounds             image.Rectangle // for composeAt, the least area the canvas covers in placement coordinates; optional
+
+	// onWeightMap, when set, receives the per-pixel blending weight (coverage for
+	// summed overlaps) as built by weightedCanvas.weightMap
+	onWeightMap func(*image.Gray16)
+
+	// onSeamMask, when set, receives a mask of the pixels two or more tiles cover,
+	// as built by seamMask
+	onSeamMask func(*image.Gray)
+
+	// onPlace, when set, is called by mosaic with the index and canvas position of
+	// each tile it places
+	onPlace func(idx int, pt image.Point)
+
+	// scratch allocates the output image and blending accumulators; nil allocates
+	// them on the heap
+	scratch *scratch
+}
+
+// mosaic creates the mosaic image in either vertical or horizontal snake pattern with blending.
+// Overlaps are summed, or averaged with blend "average" or when per-tile weights are given,
+// or feathered with blend "feather".
+func mosaic(imgs []image.Image, rows, cols int, opts mosaicOptions) (*image.Gray16, error) {
+	overlapX, overlapY := opts.overlapX, opts.overlapY
+
+	if len(imgs) != rows*cols {
+		return nil, fmt.Errorf("%w: number of images (%d) does not match grid size (%d)", ErrGridMismatch, len(imgs), rows*cols)
+	}
+
+	imgW := imgs[0].Bounds().Dx()
+	imgH := imgs[0].Bounds().Dy()
+
+	// A single column (row) has no seams along X (Y), so its overlap never applies;
+	// 1x1 mosaics pass the tile through unchanged.
+	if cols == 1 && overlapX != 0 {
+		slog.Debug("ignoring overlapX for a single-column grid", "overlapX", overlapX)
+		overlapX = 0
+	}
+	if rows == 1 && overlapY != 0 {
+		slog.Debug("ignoring overlapY for a single-row grid", "overlapY", overlapY)
+		overlapY = 0
+	}
+
+	if overlapX < 0 || overlapX >= imgW {
+		return nil, fmt.Errorf("overlapX (%d) must be >= 0 and smaller than the tile width (%d) after downsampling", overlapX, imgW)
+	}
+	if overlapY < 0 || overlapY >= imgH {
+		return nil, fmt.Errorf("overlapY (%d) must be >= 0 and smaller than the tile height (%d) after downsampling", overlapY, imgH)
+	}
+
+	stepX := imgW - overlapX
+	stepY := imgH - overlapY
+
+	// cellPos is the pixel position of a grid cell. Reversed snake rows (horizontal)
+	// or columns (vertical) may step by their own overlap, anchored at the tile where
+	// the scan turns.
+	cellPos := func(c image.Point) image.Point { return image.Pt(c.X*stepX, c.Y*stepY) }
+	if opts.overlapTurn >= 0 {
+		if opts.cells != nil {
+			return nil, fmt.Errorf("a turn overlap needs the snake order and cannot be combined with an index map")
+		}
+		horizontal := opts.snake == "horizontal"
+		dim := imgH
+		if horizontal {
+			dim = imgW
+		}
+		if opts.overlapTurn >= dim {
+			return nil, fmt.Errorf("turn overlap (%d) must be smaller than the tile size (%d) along the scan axis after downsampling", opts.overlapTurn, dim)
+		}
+		stepTurn := dim - opts.overlapTurn
+		// the reversed lines start at the far edge (right, bottom) when the first
+		// line ends there
+		far := horizontal != opts.snakeReverse
+		cellPos = func(c image.Point) image.Point {
+			p := image.Pt(c.X*stepX, c.Y*stepY)
+			switch {
+			case horizontal && c.Y%2 == 1 && far:
+				p.X = (cols-1)*stepX - (cols-1-c.X)*stepTurn
+			case horizontal && c.Y%2 == 1:
+				p.X = c.X * stepTurn
+			case !horizontal && c.X%2 == 1 && far:
+				p.Y = (rows-1)*stepY - (rows-1-c.Y)*stepTurn
+			case !horizontal && c.X%2 == 1:
+				p.Y = c.Y * stepTurn
+			}
+			return p
+		}
+	}
+
+	cells, err := gridOrder{rows, cols, opts.snake, opts.snakeReverse, opts.cells}.cellList()
+	if err != nil {
+		return nil, err
+	}
+	keep := make([]int, len(cells))
+	for idx := range cells {
+		keep[idx] = idx
+	}
+	if opts.trimBelow > 0 {
+		keep = trimEdges(imgs, cells, rows, cols, opts.trimBelow)
+		if len(keep) == 0 {
+			return nil, fmt.Errorf("every tile is below the trim threshold")
+		}
+	}
+
+	// place the kept tiles relative to the top-left kept cell
+	origin := cells[keep[0]]
+	for _, idx := range keep {
+		origin.X = min(origin.X, cells[idx].X)
+		origin.Y = min(origin.Y, cells[idx].Y)
+	}
+	if opts.missing != nil {
+		// the empty cells keep their place on the canvas, but nothing is drawn there
+		tile := image.Rect(0, 0, imgW, imgH)
+		var present []int
+		for _, idx := range keep {
+			opts.bounds = opts.bounds.Union(tile.Add(cellPos(cells[idx]).Sub(cellPos(origin))))
+			if idx >= len(opts.missing) || !opts.missing[idx] {
+				present = append(present, idx)
+			}
+		}
+		keep = present
+	}
+	var kept []image.Image
+	var pts []image.Point
+	var weights []float64
+	for _, idx := range keep {
+		pt := cellPos(cells[idx]).Sub(cellPos(origin))
+		kept = append(kept, imgs[idx])
+		pts = append(pts, pt)
+		name := strconv.Itoa(idx)
+		if idx < len(opts.names) {
+			name = opts.names[idx]
+		}
+		slog.Debug("placing tile", "tile", name, "index", idx, "row", cells[idx].Y, "col", cells[idx].X, "x", pt.X, "y", pt.Y)
+		if opts.onPlace != nil {
+			opts.onPlace(idx, pt)
+		}
+		if opts.weights != nil {
+			weights = append(weights, opts.weights[idx])
+		}
+	}
+	opts.weights = weights
+	opts.overlapX, opts.overlapY = overlapX, overlapY
+	if opts.checkerboard {
+		kept, pts = checkerboard(kept, pts, cells, keep)
+		opts.overwrite, opts.weights = true, nil
+	}
+	return composeAt(kept, pts, opts)
+}
+
+// checkerboard reorders placed tiles for --qc checkerboard: tiles on odd cells are
+// dimmed to half intensity and placed first, so that tiles on even cells overwrite
+// them in every overlap and misalignment shows as broken edges in the pattern
+func checkerboard(imgs []image.Image, pts []image.Point, cells []image.Point, keep []int) ([]image.Image, []image.Point) {
+	var even, odd []int
+	for i, idx := range keep {
+		if (cells[idx].X+cells[idx].Y)%2 == 0 {
+			even = append(even, i)
+		} else {
+			odd = append(odd, i)
+		}
+	}
+	var outImgs []image.Image
+	var outPts []image.Point
+	for _, i := range odd {
+		g := toGray16(imgs[i])
+		dim := image.NewGray16(g.Bounds())
+		for j := 0; j+1 < len(g.Pix); j += 2 {
+			v := (uint16(g.Pix[j])<<8 | uint16(g.Pix[j+1])) / 2
+			dim.Pix[j], dim.Pix[j+1] = uint8(v>>8), uint8(v)
+		}
+		outImgs = append(outImgs, dim)
+		outPts = append(outPts, pts[i])
+	}
+	for _, i := range even {
+		outImgs = append(outImgs, imgs[i])
+		outPts = append(outPts, pts[i])
+	}
+	return outImgs, outPts
+}
+
+// tileMean returns the mean 16-bit gray value of img
+func tileMean(img image.Image) float64 {
+	b := img.Bounds()
+	var sum float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sum += float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+		}
+	}
+	return sum / float64(b.Dx()*b.Dy())
+}
+
+// trimEdges repeatedly drops the outer grid rows and columns whose tiles all have a
+// mean gray value below threshold, and returns the indices of the tiles kept
+func trimEdges(imgs []image.Image, cells []image.Point, rows, cols int, threshold float64) []int {
+	byCell := make(map[image.Point]int)
+	dark := make([]bool, len(cells))
+	for idx, cell := range cells {
+		byCell[cell] = idx
+		dark[idx] = tileMean(imgs[idx]) < threshold
+	}
+
+	r0, r1, c0, c1 := 0, rows-1, 0, cols-1
+	row := func(r int) []int {
+		var idxs []int
+		for c := c0; c <= c1; c++ {
+			idxs = append(idxs, byCell[image.Pt(c, r)])
+		}
+		return idxs
+	}
+	col := func(c int) []int {
+		var idxs []int
+		for r := r0; r <= r1; r++ {
+			idxs = append(idxs, byCell[image.Pt(c, r)])
+		}
+		return idxs
+	}
+	allDark := func(idxs []int) bool {
+		for _, idx := range idxs {
+			if !dark[idx] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for r0 <= r1 && c0 <= c1 {
+		switch {
+		case allDark(row(r0)):
+			slog.Info("trimmed edge row", "row", r0, "tiles", row(r0))
+			r0++
+		case allDark(row(r1)):
+			slog.Info("trimmed edge row", "row", r1, "tiles", row(r1))
+			r1--
+		case allDark(col(c0)):
+			slog.Info("trimmed edge column", "col", c0, "tiles", col(c0))
+			c0++
+		case allDark(col(c1)):
+			slog.Info("trimmed edge column", "col", c1, "tiles", col(c1))
+			c1--
+		default:
+			var keep []int
+			for idx, cell := range cells {
+				if cell.Y >= r0 && cell.Y <= r1 && cell.X >= c0 && cell.X <= c1 {
+					keep = append(keep, idx)
+				}
+			}
+			if r1-r0+1 != rows || c1-c0+1 != cols {
+				slog.Info("trimmed grid", "rows", r1-r0+1, "cols", c1-c0+1)
+			}
+			return keep
+		}
+	}
+	return nil
+}
+
+// composeAt composites imgs onto one canvas with the top-left corner of tile i at pts[i].
+// The canvas is the bounding box of all tiles shifted to start at (0,0), so
+// positions may be negative. Overlaps are blended as in mosaic.
+func composeAt(imgs []image.Image, pts []image.Point, opts mosaicOptions) (*image.Gray16, error) {
+	weights := opts.weights
+	// blend "none" draws each tile over the earlier ones without any arithmetic
+	overwrite := opts.overwrite || opts.blend == "none"
+	name := opts.blend
+	switch {
+	case overwrite:
+		name = "none"
+	case name == "":
+		name = "sum"
+	}
+	mode, ok := blendModes[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid blend mode: %s (use %s)", opts.blend, strings.Join(blendNames(), ", "))
+	}
+	// per-tile weights turn the sum blend into a weighted average
+	average := (mode.fn == nil || weights != nil) && !overwrite
+	floatSum := opts.accumulate == "float"
+	if floatSum && name != "sum" {
+		return nil, fmt.Errorf("float accumulation needs the sum blend, not %s", name)
+	}
+	if len(pts) != len(imgs) {
+		return nil, fmt.Errorf("number of positions (%d) does not match number of images (%d)", len(pts), len(imgs))
+	}
+	if weights != nil && len(weights) != len(imgs) {
+		return nil, fmt.Errorf("number of weights (%d) does not match number of images (%d)", len(weights), len(imgs))
+	}
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("no images to compose")
+	}
+
+	var bbox image.Rectangle
+	for i, img := range imgs {
+		r := image.Rectangle{Min: pts[i], Max: pts[i].Add(img.Bounds().Size())}
+		if i == 0 {
+			bbox = r
+		} else {
+			bbox = bbox.Union(r)
+		}
+	}
+	bbox = bbox.Union(opts.bounds)
+	totalW, totalH := bbox.Dx(), bbox.Dy()
+
+	out, err := opts.scratch.gray16(image.Rect(0, 0, totalW, totalH))
+	if err != nil {
+		return nil, err
+	}
+	var canvas, coverage *weightedCanvas
+	if average {
+		canvas, err = newWeightedCanvas(totalW, totalH, opts.scratch)
+	} else if opts.onWeightMap != nil {
+		coverage, err = newWeightedCanvas(totalW, totalH, opts.scratch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sums *floatCanvas
+	if floatSum {
+		if sums, err = newFloatCanvas(totalW, totalH, opts.scratch); err != nil {
+			return nil, err
+		}
+	}
+	place := func(idx, x, y int) {
+		b := imgs[idx].Bounds()
+		// taper is the sum blend's alpha when --sum-taper is set: tiles ramp in only
+		// where a neighbour overlaps them, and the mosaic's outer edges stay whole
+		var taper func(x, y int) float64
+		if name == "sum" && opts.sumTaper > 0 {
+			tx, ty := min(opts.sumTaper, opts.overlapX), min(opts.sumTaper, opts.overlapY)
+			ax := taperRamp(b.Dx(), tx, x > 0, x+b.Dx() < totalW)
+			ay := taperRamp(b.Dy(), ty, y > 0, y+b.Dy() < totalH)
+			taper = func(x, y int) float64 { return min(ax[x], ay[y]) }
+		}
+		if canvas != nil {
+			w := 1.0
+			if weights != nil {
+				w = weights[idx]
+			}
+			var alpha func(x, y int) float64
+			if mode.alpha != nil {
+				alpha = mode.alpha(b, opts)
+			}
+			if opts.centerWeight > 0 {
+				profile := centerProfile(b.Dx(), b.Dy(), opts.centerWeight)
+				if edge := alpha; edge != nil {
+					alpha = func(x, y int) float64 { return edge(x, y) * profile(x, y) }
+				} else {
+					alpha = profile
+				}
+			}
+			if alpha != nil {
+				canvas.addAlpha(imgs[idx], x, y, w, alpha)
+			} else {
+				canvas.add(imgs[idx], x, y, w)
+			}
+		} else if sums != nil {
+			sums.add(imgs[idx], x, y, taper)
+		} else if taper != nil {
+			sumImagesAlpha(out, imgs[idx], x, y, taper)
+		} else {
+			mode.fn(out, imgs[idx], x, y, opts.overlapX, opts.overlapY)
+		}
+		switch {
+		case coverage != nil && taper != nil:
+			coverage.coverAlpha(x, y, b.Dx(), b.Dy(), taper)
+		case coverage != nil:
+			coverage.cover(x, y, b.Dx(), b.Dy(), 1)
+		}
+	}
+
+	for idx, pt := range pts {
+		p := pt.Sub(bbox.Min)
+		place(idx, p.X, p.Y)
+	}
+
+	if canvas != nil {
+		canvas.writeTo(out)
+	}
+	if sums != nil {
+		sums.writeTo(out, opts.accumulateScale)
+	}
+	if opts.onSeamMask != nil {
+		rects := make([]image.Rectangle, len(imgs))
+		for i, img := range imgs {
+			p := pts[i].Sub(bbox.Min)
+			rects[i] = image.Rectangle{Min: p, Max: p.Add(img.Bounds().Size())}
+		}
+		opts.onSeamMask(seamMask(rects, totalW, totalH))
+	}
+	if opts.onWeightMap != nil {
+		if canvas != nil {
+			opts.onWeightMap(canvas.weightMap())
+		} else {
+			opts.onWeightMap(coverage.weightMap())
+		}
+	}
+	return out, nil
+}
+
+// channelOrder lists the colour planes accepted by --assign
+var channelOrder = []string{"red", "green", "blue"}
+
+// parseAssign parses a channel mapping such as "red=*_DAPI*,green=*_GFP*"
+func parseAssign(s string) (map[string]string, error) {
+	channels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		name, pattern, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid channel assignment %q (use channel=glob)", part)
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "red", "green", "blue":
+		default:
+			return nil, fmt.Errorf("invalid channel %q (use red, green or blue)", name)
+		}
+		if _, dup := channels[name]; dup {
+			return nil, fmt.Errorf("channel %s assigned more than once", name)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern for %s: %v", name, err)
+		}
+		channels[name] = pattern
+	}
+	return channels, nil
+}
+
+// channelGeometry holds per-channel overrides of the global grid geometry
+type channelGeometry struct {
+	overlapX, overlapY, downsample int
+}
+
+// parseChannelGeometry parses per-channel overrides such as
+// "green:overlapX=25,overlapY=25;blue:downsample=2". Unset values are taken from def.
+func parseChannelGeometry(s string, def channelGeometry) (map[string]channelGeometry, error) {
+	geoms := make(map[string]channelGeometry)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, settings, ok := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("invalid channel geometry %q (use channel:key=value,...)", entry)
+		}
+		switch name {
+		case "red", "green", "blue":
+		default:
+			return nil, fmt.Errorf("invalid channel %q (use red, green or blue)", name)
+		}
+		g := def
+		for _, kv := range strings.Split(settings, ",") {
+			key, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			v, err := strconv.Atoi(val)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("invalid setting %q for channel %s", kv, name)
+			}
+			switch key {
+			case "overlapX":
+				g.overlapX = v
+			case "overlapY":
+				g.overlapY = v
+			case "downsample":
+				if v <= 0 {
+					return nil, fmt.Errorf("downsample for channel %s must be >= 1", name)
+				}
+				g.downsample = v
+			default:
+				return nil, fmt.Errorf("unknown setting %q for channel %s (use overlapX, overlapY or downsample)", key, name)
+			}
+		}
+		geoms[name] = g
+	}
+	return geoms, nil
+}
+
+// channelOutput holds the output settings of one --split-channels plane
+type channelOutput struct {
+	bitDepth    int
+	compression string
+}
+
+// parseChannelOutput parses per-channel output overrides for --split-channels such
+// as "red:bitdepth=8;blue:compression=none". Unset values are taken from def.
+func parseChannelOutput(s string, def channelOutput) (map[string]channelOutput, error) {
+	outs := make(map[string]channelOutput)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, settings, ok := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("invalid channel output %q (use channel:key=value,...)", entry)
+		}
+		switch name {
+		case "red", "green", "blue":
+		default:
+			return nil, fmt.Errorf("invalid channel %q (use red, green or blue)", name)
+		}
+		o := def
+		for _, kv := range strings.Split(settings, ",") {
+			key, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid setting %q for channel %s", kv, name)
+			}
+			switch key {
+			case "bitdepth":
+				v, err := strconv.Atoi(val)
+				if err != nil || (v != 8 && v != 16) {
+					return nil, fmt.Errorf("bitdepth for channel %s must be 8 or 16", name)
+				}
+				o.bitDepth = v
+			case "compression":
+				if _, err := tiffCompression(val); err != nil {
+					return nil, fmt.Errorf("channel %s: %v", name, err)
+				}
+				o.compression = val
+			default:
+				return nil, fmt.Errorf("unknown setting %q for channel %s (use bitdepth or compression)", key, name)
+			}
+		}
+		outs[name] = o
+	}
+	return outs, nil
+}
+
+// selectTiles returns the first n of the sorted paths making up the grid. Having fewer is
+// an error; extra paths are an error with exact, and are otherwise logged as ignored.
+// what names the selection in messages, e.g. a channel.
+func selectTiles(paths []string, n int, exact bool, what string) ([]string, error) {
+	if what != "" {
+		what = " for " + what
+	}
+	if len(paths) < n {
+		return nil, fmt.Errorf("%w%s: have %d need %d", ErrNotEnoughImages, what, len(paths), n)
+	}
+	if len(paths) > n {
+		if exact {
+			return nil, fmt.Errorf("%w: matched %d images%s but the grid needs exactly %d (--require-exact)", ErrGridMismatch, len(paths), what, n)
+		}
+		for _, p := range paths[n:] {
+			slog.Warn("ignoring image beyond the grid", "path", p, "matched", len(paths), "grid", n)
+		}
+	}
+	return paths[:n], nil
+}
+
+// logOverlaps reports the grid overlaps actually applied once downsampling by ds
+// has rounded them, in downsampled pixels and in the input pixels they stand for.
+// An overlap that ds does not divide is rounded to the nearest pixel, as the tiles
+// are, which is logged at info level; exact ones are logged at debug level. A negative turn overlap is unset.
+func logOverlaps(overlapX, overlapY, overlapTurn, ds int, attrs ...any) {
+	if ds <= 1 {
+		return
+	}
+	for _, o := range []struct {
+		name  string
+		value int
+	}{{"overlapX", overlapX}, {"overlapY", overlapY}, {"overlap-turn", overlapTurn}} {
+		if o.value < 0 {
+			continue
+		}
+		applied := scaledPx(o.value, ds)
+		level := slog.LevelDebug
+		if o.value%ds != 0 {
+			level = slog.LevelInfo
+		}
+		slog.Log(context.Background(), level, "effective overlap after downsampling",
+			append([]any{"axis", o.name, "requested", o.value, "downsample", ds, "applied", applied, "applied_input_px", applied * ds}, attrs...)...)
+	}
+}
+
+// filterGlob returns the paths whose base name matches the glob pattern
+func filterGlob(paths []string, pattern string) []string {
+	var matched []string
+	for _, p := range paths {
+		if ok, _ := filepath.Match(pattern, filepath.Base(p)); ok {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
+
+// loadOptions controls how tiles are read and preprocessed
+type loadOptions struct {
+	downsample int
+	filter     resize.InterpolationFunction // filter used to downsample
+	timeout    time.Duration                // per-tile decode timeout, 0 for none
+	skipErrors bool                         // replace unreadable tiles with blank ones
+
+	normalize         bool // rescale tiles to a common percentile window
+	normLow, normHigh float64
+
+	promoteDepth bool // promote 8-bit tiles to 16-bit instead of failing when tiles mix bit depths
+
+	gamma   *gammaCurve  // curve linearizing each tile as loaded, before any correction; nil for none
+	denoise *denoiseSpec // filter applied to each tile as loaded, before flat-field correction; nil for none
+	flat    *flatField   // flat-field correction applied before downsampling; nil for none
+
+	exposure map[string]float64 // per-path factor normalizing each tile's exposure, applied before flat-field correction; nil for none
+
+	checkpoint *checkpoint // cache of the corrected tiles kept across runs; nil for none
+
+	client *http.Client // fetches remote tiles and reads their headers
+}
+
+// loadTIFFTimeout loads a TIFF like loadTIFF but gives up after timeout, which is
+// reported as a *TileError too.
+// A decode that never returns is abandoned and its goroutine left to finish on its own.
+func loadTIFFTimeout(path string, timeout time.Duration, client *http.Client) (image.Image, error) {
+	if timeout <= 0 {
+		return loadTIFF(path, client)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		img image.Image
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		img, err := loadTIFF(path, client)
+		done <- result{img, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.img, r.err
+	case <-ctx.Done():
+		return nil, &TileError{path, fmt.Errorf("decode timed out after %v", timeout)}
+	}
+}
+
+// scaledPx returns the pixel count v divided by factor, rounded to the nearest
+// pixel as downsampled tiles are
+func scaledPx(v, factor int) int {
+	return (v + factor/2) / factor
+}
+
+// roundedSize returns size divided by factor, rounded to the nearest pixel
+func roundedSize(size image.Point, factor int) image.Point {
+	return image.Pt(scaledPx(size.X, factor), scaledPx(size.Y, factor))
+}
+
+// nearSize reports whether a and b differ by at most one pixel along each axis
+func nearSize(a, b image.Point) bool {
+	d := a.Sub(b)
+	return d.X >= -1 && d.X <= 1 && d.Y >= -1 && d.Y <= 1
+}
+
+// loadTiles loads and optionally downsamples the given TIFF files.
+// With skipErrors, tiles that fail to load are reported and replaced by blank
+// tiles the size of the others.
+func loadTiles(paths []string, opts loadOptions) ([]image.Image, error) {
+	imgs := make([]image.Image, len(paths))
+	// depths holds each tile's depth as decoded, since --input-gamma already
+	// promotes 8-bit tiles while loading
+	depths := make([]int, len(paths))
+	var failed []int
+	var size image.Point
+	var target image.Point // downsampled size of the first tile, shared by tiles that round to within a pixel of it
+	for i, p := range paths {
+		slog.Info("processing tile", "path", p)
+		var key string
+		cacheable := false
+		if opts.checkpoint != nil {
+			key, cacheable = opts.checkpoint.key(p, i, len(paths), opts)
+			if cacheable {
+				if img, depth, ok := opts.checkpoint.load(key, target); ok {
+					if opts.downsample > 1 && target == (image.Point{}) {
+						target = img.Bounds().Size()
+					}
+					depths[i] = depth
+					imgs[i] = img
+					size = img.Bounds().Size()
+					continue
+				}
+			}
+		}
+		img, err := loadTIFFTimeout(p, opts.timeout, opts.client)
+		if err != nil {
+			if !opts.skipErrors {
+				return nil, err
+			}
+			// err names the tile
+			slog.Warn("skipping tile", "err", err)
+			failed = append(failed, i)
+			continue
+		}
+		depths[i] = tileDepth(img)
+		if opts.gamma != nil {
+			img = opts.gamma.apply(img)
+		}
+		if opts.denoise != nil {
+			img = opts.denoise.apply(img)
+		}
+		if f, ok := opts.exposure[p]; ok && f != 1 {
+			img = scaleTile(img, f)
+		}
+		if opts.flat != nil {
+			if img, err = opts.flat.correct(i, len(paths), p, img); err != nil {
+				return nil, err
+			}
+		}
+		if opts.downsample > 1 {
+			// rounding alone would still leave e.g. 1022 and 1023 px tiles 511 and 512
+			// px wide at a factor of 2, and the grid steps by the first tile's size
+			sz := roundedSize(img.Bounds().Size(), opts.downsample)
+			if target == (image.Point{}) {
+				target = sz
+			} else if sz != target && nearSize(sz, target) {
+				slog.Debug("resizing tile to the common downsampled size", "path", p, "size", img.Bounds().Size(), "rounded", sz, "target", target)
+				sz = target
+			}
+			// resize treats a zero dimension as "keep the aspect ratio", which would
+			// leave the tile silently at full size
+			if sz.X == 0 || sz.Y == 0 {
+				return nil, fmt.Errorf("%s: the %v tile is smaller than the downsample factor %d", p, img.Bounds().Size(), opts.downsample)
+			}
+			img = resize.Resize(uint(sz.X), uint(sz.Y), img, opts.filter)
+		}
+		if cacheable {
+			opts.checkpoint.store(key, img, depths[i])
+		}
+		imgs[i] = img
+		size = img.Bounds().Size()
+	}
+	if opts.checkpoint != nil {
+		opts.checkpoint.summarize()
+	}
+
+	if len(failed) == len(paths) && len(paths) > 0 {
+		return nil, fmt.Errorf("none of the %d tiles could be loaded", len(paths))
+	}
+	blank := make(map[int]bool)
+	for _, i := range failed {
+		imgs[i] = image.NewGray16(image.Rectangle{Max: size})
+		blank[i] = true
+	}
+
+	if err := checkDepths(imgs, depths, paths, blank, opts.promoteDepth); err != nil {
+		return nil, err
+	}
+	if opts.normalize {
+		normalizeTiles(imgs, blank, opts.normLow, opts.normHigh)
+	}
+	return imgs, nil
+}
+
+// composite merges per-channel grayscale mosaics into the colour planes of a single RGBA image.
+// Unassigned channels are left black.
+func composite(planes map[string]*image.Gray16) (*image.RGBA64, error) {
+	var bounds image.Rectangle
+	for _, name := range channelOrder {
+		p, ok := planes[name]
+		if !ok {
+			continue
+		}
+		if bounds.Empty() {
+			bounds = p.Bounds()
+		} else if p.Bounds() != bounds {
+			return nil, fmt.Errorf("channel %s mosaic is %v, expected %v", name, p.Bounds().Size(), bounds.Size())
+		}
+	}
+
+	out := image.NewRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBA64{A: 0xffff}
+			if p, ok := planes["red"]; ok {
+				c.R = p.Gray16At(x, y).Y
+			}
+			if p, ok := planes["green"]; ok {
+				c.G = p.Gray16At(x, y).Y
+			}
+			if p, ok := planes["blue"]; ok {
+				c.B = p.Gray16At(x, y).Y
+			}
+			out.SetRGBA64(x, y, c)
+		}
+	}
+	return out, nil
+}
+
+// UsageError marks errors caused by invalid command-line usage
+type UsageError struct {
+	err error
+}
+
+func (e UsageError) Error() string { return e.err.Error() }
+func (e UsageError) Unwrap() error { return e.err }
+
+// Run parses the command line args of a stitchr run, without the program name,
+// and stitches the mosaic. Flags are parsed into the process flag set, and logging
+// and HTTP are configured from them.
+func Run(args []string) error {
+	return run(args, true)
+}
+
+// setupLogging installs the default logger writing to stderr at the given level.
+// When relTo is set, paths under that directory are logged relative to it.
+func setupLogging(level string, asJSON bool, relTo string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level: %s (use debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if relTo != "" {
+		// paths also appear inside messages and errors, so every string is rewritten
+		prefix := filepath.Clean(relTo) + string(filepath.Separator)
+		opts.ReplaceAttr = func(_ []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindString {
+				a.Value = slog.StringValue(strings.ReplaceAll(a.Value.String(), prefix, ""))
+			}
+			return a
+		}
+	}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if asJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// placementModes groups the flags choosing how tiles are placed, which exclude one
+// another: each mode would place the same tiles somewhere else
+var placementModes = []struct {
+	name  string
+	flags []string
+}{
+	{"snake order", []string{"snake", "col-start", "row-start", "overlap-turn", "origin-index"}},
+	{"index map", []string{"index-map"}},
+	{"cells in file names", []string{"fill"}},
+	{"positions", []string{"positions", "overview", "tiles"}},
+}
+
+// checkPlacementModes returns an error naming the flags of every placement mode
+// selected among the flags set, when more than one is. --fill only selects a mode
+// when partial.
+func checkPlacementModes(set map[string]bool, partial bool) error {
+	var used []string
+	for _, m := range placementModes {
+		var flags []string
+		for _, f := range m.flags {
+			switch {
+			case f == "fill" && set[f] && partial:
+				flags = append(flags, "--fill partial")
+			case f != "fill" && set[f]:
+				flags = append(flags, "--"+f)
+			}
+		}
+		if flags != nil {
+			used = append(used, fmt.Sprintf("%s (%s)", m.name, strings.Join(flags, ", ")))
+		}
+	}
+	if len(used) > 1 {
+		list := strings.Join(used[:len(used)-1], ", ") + " and " + used[len(used)-1]
+		return fmt.Errorf("conflicting placement modes: %s; each places the tiles differently, so use the flags of one", list)
+	}
+	return nil
+}
+
+// flagConflicts lists, for each flag, the flags it cannot be combined with and the
+// reason. A flag is named with its value, e.g. "--fill partial", when only that
+// value conflicts; placement modes are checked by checkPlacementModes instead.
+var flagConflicts = []struct {
+	flag   string
+	reason string // what flag does that the others contradict; may be empty
+	with   []string
+}{
+	{"--stack", "lists the tiles", []string{"--dir", "--list", "--tiles"}},
+	{"--tiles", "lists the tiles and their positions", []string{"--dir", "--list", "--positions", "--overview"}},
+	{"--overview", "places the tiles", []string{"--positions"}},
+	{"--assign", "stitches each channel on the grid", []string{"--positions", "--overview", "--tiles", "--color"}},
+	{"--split-channels", "writes one grayscale output per colour channel", []string{"--color", "--assign"}},
+	{"--blend feather", "follows the grid overlap", []string{"--positions", "--overview", "--tiles"}},
+	{"--sum-taper", "follows the grid overlap", []string{"--positions", "--overview", "--tiles"}},
+	// each plane would be rescaled by its own factor, changing the colours
+	{"--accumulate float", "rescales a single plane", []string{"--color", "--assign", "--qc checkerboard"}},
+	{"--qc checkerboard", "needs the grid", []string{"--positions", "--overview", "--tiles"}},
+	{"--detect-order", "tries the tile orders of the grid", []string{"--positions", "--overview", "--tiles", "--fill partial", "--index-map", "--assign", "--export-tiles", "--scan-overlap"}},
+	{"--verify-order", "checks the grid order", []string{"--positions", "--overview", "--tiles", "--assign"}},
+	{"--seam-report", "scores the grid seams", []string{"--positions", "--overview", "--tiles", "--assign"}},
+	{"--seam-min-ncc", "scores the grid seams", []string{"--positions", "--overview", "--tiles", "--assign"}},
+	{"--register-report", "measures grid seams", []string{"--positions", "--overview", "--tiles", "--assign"}},
+	{"--fill partial", "places tiles by the cells in their names", []string{"--positions", "--overview", "--tiles", "--index-map", "--assign", "--export-tiles", "--trim-edges", "--overlap-turn", "--verify-order", "--seam-report", "--seam-min-ncc", "--register-report"}},
+	{"--autoflat-overlaps", "needs the grid overlaps", []string{"--positions", "--overview", "--tiles", "--assign", "--export-tiles", "--overlap-turn"}},
+	{"--exclude", "blanks the grid cells of excluded tiles", []string{"--assign", "--export-tiles", "--seam-report", "--seam-min-ncc", "--register-report"}},
+	{"--origin-index", "orders the grid's tile list", []string{"--positions", "--overview", "--tiles", "--fill partial", "--index-map", "--assign", "--export-tiles", "--watch"}},
+	{"--overlap-turn", "follows the snake order", []string{"--positions", "--overview", "--tiles", "--index-map"}},
+	{"--sort time", "orders the listed tiles", []string{"--tiles", "--watch"}},
+	{"--max-dimension", "needs a grid mosaic", []string{"--positions", "--overview", "--tiles", "--export-tiles", "--channel-geometry"}},
+	{"--normalize-tiles", "needs the whole grid", []string{"--export-tiles"}},
+	{"--scan-overlap", "scans the tiles of one channel, selected with --regex,", []string{"--assign"}},
+	{"--export-rows", "needs a grid stitch", []string{"--positions", "--overview", "--tiles", "--assign", "--export-tiles"}},
+	{"--weightmap", "", []string{"--assign"}},
+	{"--seam-mask", "", []string{"--assign"}},
+	{"--histogram", "", []string{"--split-channels"}},
+	{"--diff", "compares a single mosaic", []string{"--split-channels"}},
+	{"--write-tileconfig", "", []string{"--assign", "--export-tiles"}},
+	{"--svg-overlay", "draws the unrotated grayscale or colour mosaic", []string{"--assign", "--export-tiles", "--out-rotate", "--out-flip", "--force-square-canvas", "--align"}},
+}
+
+// checkFlagConflicts returns an error for the first entry of flagConflicts whose
+// flag is in use together with any of the flags it excludes, naming those given
+func checkFlagConflicts(inUse map[string]bool) error {
+	for _, c := range flagConflicts {
+		if !inUse[c.flag] {
+			continue
+		}
+		var given []string
+		for _, f := range c.with {
+			if inUse[f] {
+				given = append(given, f)
+			}
+		}
+		if given == nil {
+			continue
+		}
+		list := given[0]
+		if len(given) > 1 {
+			list = strings.Join(given[:len(given)-1], ", ") + " or " + given[len(given)-1]
+		}
+		if c.reason == "" {
+			return fmt.Errorf("%s cannot be combined with %s", c.flag, list)
+		}
+		return fmt.Errorf("%s %s and cannot be combined with %s", c.flag, c.reason, list)
+	}
+	return nil
+}
+
+// channelPaths derives one output path per channel suffix, e.g. mosaic_r.tiff
+func channelPaths(path string, suffixes ...string) []string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	names := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		names[i] = base + "_" + s + ext
+	}
+	return names
+}
@@ -0,0 +1,529 @@
+package stitch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+// FuzzLessPath checks that lessPath is a strict weak ordering, which sort.Slice
+// needs to order tiles consistently
+func FuzzLessPath(f *testing.F) {
+	seeds := [][3]string{
+		{"tile-1_a.tif", "tile-2_a.tif", "tile-10_a.tif"},
+		{"tile-01_a.tif", "tile-1_a.tif", "tile-001_b.tif"},
+		{"scan-3_x.tif", "scan.tif", "other.tif"},
+		{"a-99999999999999999999_x.tif", "a-100000000000000000000_x.tif", "a-5_x.tif"},
+		{"-1_-2_", "-2_-1_", "-_"},
+		{"", "-0_", "-00_"},
+	}
+	for _, s := range seeds {
+		f.Add(s[0], s[1], s[2])
+	}
+	f.Fuzz(func(t *testing.T, a, b, c string) {
+		if lessPath(a, a) {
+			t.Errorf("lessPath(%q, %q) is true, want false", a, a)
+		}
+		if lessPath(a, b) && lessPath(b, a) {
+			t.Errorf("lessPath(%q, %q) and lessPath(%q, %q) are both true", a, b, b, a)
+		}
+		if lessPath(a, b) && lessPath(b, c) && !lessPath(a, c) {
+			t.Errorf("lessPath orders %q < %q < %q but not %q < %q", a, b, c, a, c)
+		}
+	})
+}
+
+// constantTile returns a w x h tile of the single value v
+func constantTile(w, h int, v uint16) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 2 {
+		img.Pix[i], img.Pix[i+1] = uint8(v>>8), uint8(v)
+	}
+	return img
+}
+
+// TestFeatherCornerWeights checks that feathering weighs every pixel away from the
+// mosaic's border 1 in total, including where the overlaps of a 2x2 grid cross,
+// and that a grid of equal tiles blends back to their value there
+func TestFeatherCornerWeights(t *testing.T) {
+	const w, h, v = 40, 32, 20000
+	tests := []struct {
+		overlapX, overlapY, feather int
+	}{
+		{8, 8, -1},
+		{11, 7, -1},
+		{12, 6, 4},
+		{10, 10, 2},
+		{9, 5, 3},
+		{10, 7, 4},
+		{6, 9, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("overlap=%dx%d/feather=%d", tt.overlapX, tt.overlapY, tt.feather), func(t *testing.T) {
+			tiles := make([]image.Image, 4)
+			for i := range tiles {
+				tiles[i] = constantTile(w, h, v)
+			}
+			var weights *image.Gray16
+			out, err := mosaic(tiles, 2, 2, mosaicOptions{
+				overlapX:     tt.overlapX,
+				overlapY:     tt.overlapY,
+				overlapTurn:  -1,
+				blend:        "feather",
+				featherWidth: tt.feather,
+				onWeightMap:  func(m *image.Gray16) { weights = m },
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := out.Bounds()
+			for y := b.Min.Y + tt.overlapY; y < b.Max.Y-tt.overlapY; y++ {
+				for x := b.Min.X + tt.overlapX; x < b.Max.X-tt.overlapX; x++ {
+					if got := int(weights.Gray16At(x, y).Y); got < weightMapScale-1 || got > weightMapScale+1 {
+						t.Fatalf("total weight at (%d, %d) is %d/%d, want 1", x, y, got, weightMapScale)
+					}
+					if got := out.Gray16At(x, y).Y; got < v-1 || got > v+1 {
+						t.Fatalf("pixel (%d, %d) is %d, want %d", x, y, got, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMosaicRejectsLargeOverlap checks that an overlap reaching the tile size is an
+// error naming the axis rather than a panic or a nonsense canvas
+func TestMosaicRejectsLargeOverlap(t *testing.T) {
+	const w, h = 20, 16
+	tests := []struct {
+		overlapX, overlapY int
+		want               string
+	}{
+		{w, 0, "overlapX"},
+		{w + 7, 2, "overlapX"},
+		{-1, 2, "overlapX"},
+		{3, h, "overlapY"},
+		{3, 3 * h, "overlapY"},
+	}
+	for _, tt := range tests {
+		tiles := make([]image.Image, 4)
+		for i := range tiles {
+			tiles[i] = constantTile(w, h, 100)
+		}
+		_, err := mosaic(tiles, 2, 2, mosaicOptions{overlapX: tt.overlapX, overlapY: tt.overlapY, overlapTurn: -1})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("overlap %dx%d: got error %v, want one about %s", tt.overlapX, tt.overlapY, err, tt.want)
+		}
+	}
+}
+
+// TestMosaicSingleRowOrColumn checks that 1x1, 1xN and Nx1 grids without overlap
+// reproduce the tiles exactly, in both snake orders and every blend
+func TestMosaicSingleRowOrColumn(t *testing.T) {
+	const w, h = 24, 18
+	for _, grid := range []image.Point{{1, 1}, {5, 1}, {1, 4}} {
+		cols, rows := grid.X, grid.Y
+		scene := syntheticScene(cols*w, rows*h)
+		for _, snake := range []string{"vertical", "horizontal"} {
+			cells, err := gridCells(rows, cols, snake, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tiles := make([]image.Image, len(cells))
+			for i, c := range cells {
+				tiles[i] = scene.SubImage(image.Rect(c.X*w, c.Y*h, (c.X+1)*w, (c.Y+1)*h))
+			}
+			for _, blend := range []string{"sum", "average", "feather"} {
+				out, err := mosaic(tiles, rows, cols, mosaicOptions{snake: snake, blend: blend, featherWidth: -1, overlapTurn: -1})
+				if err != nil {
+					t.Fatalf("%dx%d %s %s: %v", rows, cols, snake, blend, err)
+				}
+				if d := maxDiff(t, out, scene); d != 0 {
+					t.Errorf("%dx%d %s %s: mosaic differs from the tiles by up to %d", rows, cols, snake, blend, d)
+				}
+			}
+		}
+	}
+}
+
+// offsetTile returns a copy of img whose bounds start at off instead of the origin,
+// as some decoders return
+func offsetTile(img *image.Gray16, off image.Point) *image.Gray16 {
+	out := *img
+	out.Pix = append([]uint8(nil), img.Pix...)
+	out.Rect = img.Rect.Add(off)
+	return &out
+}
+
+// TestNonZeroBoundsMin checks that tiles whose bounds do not start at the origin
+// are stitched and corrected exactly like the same tiles at the origin
+func TestNonZeroBoundsMin(t *testing.T) {
+	const rows, cols, w, h, ox, oy = 2, 3, 30, 22, 6, 4
+	scene := syntheticScene(cols*w-(cols-1)*ox, rows*h-(rows-1)*oy)
+	cells, err := gridCells(rows, cols, "vertical", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atOrigin := make([]image.Image, len(cells))
+	offset := make([]image.Image, len(cells))
+	for i, c := range cells {
+		x0, y0 := c.X*(w-ox), c.Y*(h-oy)
+		tile := toGray16(scene.SubImage(image.Rect(x0, y0, x0+w, y0+h)))
+		atOrigin[i] = tile
+		offset[i] = offsetTile(tile, image.Pt(37+i, -11))
+	}
+
+	for _, blend := range []string{"sum", "average", "feather", "none"} {
+		opts := mosaicOptions{overlapX: ox, overlapY: oy, overlapTurn: -1, blend: blend, featherWidth: -1}
+		want, err := mosaic(atOrigin, rows, cols, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mosaic(offset, rows, cols, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := maxDiff(t, got, want); d != 0 {
+			t.Errorf("blend %s: offset tiles differ by up to %d", blend, d)
+		}
+	}
+
+	median, err := parseDenoise("median:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrections := map[string]func(image.Image) image.Image{
+		"gamma":    newGammaCurve(2.2).apply,
+		"denoise":  median.apply,
+		"exposure": func(img image.Image) image.Image { return scaleTile(img, 1.5) },
+		"gray16":   func(img image.Image) image.Image { return toGray16(img) },
+	}
+	for name, correct := range corrections {
+		if d := maxDiff(t, correct(offset[0]), correct(atOrigin[0])); d != 0 {
+			t.Errorf("%s: offset tile differs by up to %d", name, d)
+		}
+	}
+}
+
+// TestDownsampleTinyTile checks that a downsample factor shrinking a tile to nothing
+// is an error naming the tile, while one leaving a pixel still loads
+func TestDownsampleTinyTile(t *testing.T) {
+	tests := []struct {
+		w, h, factor int
+		want         image.Point // zero when loading must fail
+	}{
+		{3, 3, 2, image.Pt(2, 2)},
+		{3, 3, 8, image.Point{}},
+		{40, 1, 4, image.Point{}},
+		{1, 40, 2, image.Pt(1, 20)},
+		{5, 5, 10, image.Pt(1, 1)},
+		{5, 5, 11, image.Point{}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "tiny-1_a.tif")
+		if err := encodeFile(path, encoders["tiff"], constantTile(tt.w, tt.h, 500), EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		imgs, err := loadTiles([]string{path}, loadOptions{downsample: tt.factor, filter: resize.Bilinear})
+		if tt.want == (image.Point{}) {
+			if err == nil || !strings.Contains(err.Error(), "smaller than the downsample factor") {
+				t.Errorf("%dx%d at factor %d: got error %v, want the tile to be too small", tt.w, tt.h, tt.factor, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%dx%d at factor %d: %v", tt.w, tt.h, tt.factor, err)
+		} else if got := imgs[0].Bounds().Size(); got != tt.want {
+			t.Errorf("%dx%d at factor %d: downsampled to %v, want %v", tt.w, tt.h, tt.factor, got, tt.want)
+		}
+	}
+}
+
+// TestDownsampleNonDivisible checks that tiles whose sizes are not multiples of the
+// downsample factor, and differ by a pixel, all come out at the first tile's
+// rounded size, so the grid steps evenly and the canvas has the expected size
+func TestDownsampleNonDivisible(t *testing.T) {
+	tests := []struct {
+		widths []int
+		h      int
+		factor int
+		want   image.Point
+	}{
+		{[]int{23, 22, 24}, 17, 2, image.Pt(12, 9)},
+		{[]int{22, 23, 21}, 16, 2, image.Pt(11, 8)},
+		{[]int{31, 32, 30}, 19, 3, image.Pt(10, 6)},
+		{[]int{29, 29, 29}, 29, 4, image.Pt(7, 7)},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		var paths []string
+		for i, w := range tt.widths {
+			p := filepath.Join(dir, fmt.Sprintf("tile-%d_a.tif", i))
+			if err := encodeFile(p, encoders["tiff"], constantTile(w, tt.h, 1000), EncodeOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, p)
+		}
+		imgs, err := loadTiles(paths, loadOptions{downsample: tt.factor, filter: resize.Bilinear})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, img := range imgs {
+			if got := img.Bounds().Size(); got != tt.want {
+				t.Errorf("widths %v at factor %d: tile %d is %v, want %v", tt.widths, tt.factor, i, got, tt.want)
+			}
+		}
+		const overlap = 2
+		out, err := mosaic(imgs, 1, len(imgs), mosaicOptions{overlapX: overlap, overlapTurn: -1, snake: "horizontal"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.Bounds().Dx(), len(imgs)*tt.want.X-(len(imgs)-1)*overlap; got != want {
+			t.Errorf("widths %v at factor %d: canvas is %d wide, want %d", tt.widths, tt.factor, got, want)
+		}
+	}
+}
+
+// TestFitDownsampleNonDivisible checks that the factor fitDownsample picks for
+// tile sizes and overlaps it does not divide keeps the canvas the real load and
+// mosaic build within maxDim
+func TestFitDownsampleNonDivisible(t *testing.T) {
+	tests := []struct {
+		w, h, overlapX, overlapY, rows, cols, maxDim int
+	}{
+		{1001, 9, 0, 0, 1, 2, 1000},
+		{1001, 9, 0, 0, 1, 2, 1002},
+		{301, 201, 31, 21, 2, 3, 400},
+		{95, 67, 13, 9, 3, 4, 100},
+		{63, 63, 7, 7, 2, 2, 40},
+	}
+	for _, tt := range tests {
+		ds, err := fitDownsample(tt.w, tt.h, tt.overlapX, tt.overlapY, tt.rows, tt.cols, tt.maxDim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(t.TempDir(), "tile.tif")
+		if err := encodeFile(p, encoders["tiff"], constantTile(tt.w, tt.h, 1000), EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadTiles([]string{p}, loadOptions{downsample: ds, filter: resize.Bilinear})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs := make([]image.Image, tt.rows*tt.cols)
+		for i := range imgs {
+			imgs[i] = loaded[0]
+		}
+		out, err := mosaic(imgs, tt.rows, tt.cols, mosaicOptions{
+			overlapX: scaledPx(tt.overlapX, ds), overlapY: scaledPx(tt.overlapY, ds), overlapTurn: -1, snake: "vertical",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := max(out.Bounds().Dx(), out.Bounds().Dy()); got > tt.maxDim {
+			t.Errorf("%+v: factor %d makes a %v canvas, longer than %d", tt, ds, out.Bounds().Size(), tt.maxDim)
+		}
+	}
+}
+
+// TestDPIRange checks that --dpi outside what a JPEG can record is a usage error
+// and that the ends of the range write their resolution
+func TestDPIRange(t *testing.T) {
+	dir := t.TempDir()
+	tile := filepath.Join(dir, "tile-1_a.tif")
+	if err := encodeFile(tile, encoders["tiff"], constantTile(8, 6, 1000), EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		dpi string
+		ok  bool
+	}{
+		{"0", false}, {"-72", false}, {"0.4", false}, {"65536", false}, {"1e12", false}, {"NaN", false},
+		{"0.5", true}, {"300", true}, {"65535", true},
+	} {
+		out := filepath.Join(dir, "mosaic.jpg")
+		err := run([]string{"--dir", dir, "--rows", "1", "--cols", "1", "--out", out, "--quiet", "--dpi", tt.dpi}, false)
+		var usage UsageError
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("--dpi %s: %v", tt.dpi, err)
+		case !tt.ok && !errors.As(err, &usage):
+			t.Errorf("--dpi %s: got error %v, want a usage error", tt.dpi, err)
+		case tt.ok:
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the JFIF APP0 segment follows the start-of-image marker
+			if d := binary.BigEndian.Uint16(data[14:]); d == 0 || string(data[6:10]) != "JFIF" {
+				t.Errorf("--dpi %s: JFIF density %d", tt.dpi, d)
+			}
+		}
+	}
+	if err := Encode(io.Discard, constantTile(8, 6, 1000), "png", EncodeOptions{DPI: 1e9}); err == nil {
+		t.Error("Encode accepted a 1e9 dpi")
+	}
+}
+
+// TestHistogramBinsBitDepth checks that a bad --bitdepth is reported as such
+// rather than through the --histogram-bins limit that depends on it
+func TestHistogramBinsBitDepth(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		depth, bins string
+		want        string
+	}{
+		{"12", "70000", "bitdepth must be 8 or 16"},
+		{"8", "300", "--histogram-bins must be between 1 and 256 for 8-bit output"},
+	} {
+		err := run([]string{"--dir", dir, "--rows", "1", "--cols", "1", "--quiet", "--bitdepth", tt.depth,
+			"--histogram", filepath.Join(dir, "hist.csv"), "--histogram-bins", tt.bins}, false)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("--bitdepth %s --histogram-bins %s: got error %v, want %q", tt.depth, tt.bins, err, tt.want)
+		}
+	}
+}
+
+// TestMosaicFeatherWidthZero checks that library callers can ask for a zero-width
+// feather, a hard seam, apart from the default of feathering the whole overlap
+func TestMosaicFeatherWidthZero(t *testing.T) {
+	tiles := []image.Image{constantTile(20, 4, 1000), constantTile(20, 4, 3000)}
+	blended := func(out *image.Gray16) int {
+		n := 0
+		for x := 0; x < out.Rect.Dx(); x++ {
+			if v := out.Gray16At(x, 2).Y; v != 1000 && v != 3000 {
+				n++
+			}
+		}
+		return n
+	}
+	zero := 0
+	for _, tt := range []struct {
+		name  string
+		width *int
+		want  int // pixels of the row mixing both tiles
+	}{{"unset", nil, 8}, {"0", &zero, 0}} {
+		out, err := Mosaic(tiles, 1, 2, MosaicOptions{OverlapX: 8, Snake: "horizontal", Blend: "feather", FeatherWidth: tt.width})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := blended(out); got != tt.want {
+			t.Errorf("feather width %s: %d blended pixels, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRegisterBlend checks that a registered BlendFunc is selected by its name and
+// that registering over an averaging blend panics and leaves it in place
+func TestRegisterBlend(t *testing.T) {
+	tiles := []image.Image{constantTile(20, 4, 1000), constantTile(20, 4, 3000)}
+	RegisterBlend("max-test", func(dst *image.Gray16, src image.Image, x0, y0, _, _ int) {
+		b := src.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				v := src.(*image.Gray16).Gray16At(b.Min.X+x, b.Min.Y+y)
+				if v.Y > dst.Gray16At(x0+x, y0+y).Y {
+					dst.SetGray16(x0+x, y0+y, v)
+				}
+			}
+		}
+	})
+	defer delete(blendModes, "max-test")
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "feather") {
+				t.Errorf("registering feather: got panic %v, want one naming feather", r)
+			}
+		}()
+		RegisterBlend("feather", func(dst *image.Gray16, src image.Image, x0, y0, _, _ int) {
+			overwriteImage(dst, src, x0, y0)
+		})
+	}()
+
+	out, err := Mosaic(tiles, 1, 2, MosaicOptions{OverlapX: 8, Snake: "horizontal", Blend: "max-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 12; x < 20; x++ {
+		if v := out.Gray16At(x, 2).Y; v != 3000 {
+			t.Errorf("max-test: overlap pixel %d is %d, want 3000", x, v)
+		}
+	}
+	out, err = Mosaic(tiles, 1, 2, MosaicOptions{OverlapX: 8, Snake: "horizontal", Blend: "feather"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := out.Gray16At(15, 2).Y; v == 1000 || v == 3000 {
+		t.Errorf("feather: overlap pixel is %d, want the tiles blended", v)
+	}
+}
+
+// TestCheckFlagConflicts checks that conflicting flags are reported with only the
+// flags actually given, and that flags without conflicts pass
+func TestCheckFlagConflicts(t *testing.T) {
+	tests := []struct {
+		inUse []string
+		want  string // "" when the flags may be combined
+	}{
+		{[]string{"--dir", "--svg-overlay", "--blend feather"}, ""},
+		{[]string{"--svg-overlay", "--out-flip"}, "--svg-overlay draws the unrotated grayscale or colour mosaic and cannot be combined with --out-flip"},
+		{[]string{"--svg-overlay", "--align", "--out-rotate"}, "--svg-overlay draws the unrotated grayscale or colour mosaic and cannot be combined with --out-rotate or --align"},
+		{[]string{"--weightmap", "--assign"}, "--weightmap cannot be combined with --assign"},
+		{[]string{"--stack", "--dir", "--list", "--tiles"}, "--stack lists the tiles and cannot be combined with --dir, --list or --tiles"},
+		{[]string{"--fill partial", "--seam-min-ncc"}, "--fill partial places tiles by the cells in their names and cannot be combined with --seam-min-ncc"},
+	}
+	for _, tt := range tests {
+		inUse := make(map[string]bool)
+		for _, f := range tt.inUse {
+			inUse[f] = true
+		}
+		err := checkFlagConflicts(inUse)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", tt.inUse, err)
+		case tt.want != "" && (err == nil || err.Error() != tt.want):
+			t.Errorf("%v: got error %v, want %q", tt.inUse, err, tt.want)
+		}
+	}
+}
+
+// TestOriginIndexReversal checks that --origin-index only reverses the grid's
+// tiles: the snake start keeps the list, the start counted from the end reads it
+// backwards, and any other position is rejected
+func TestOriginIndexReversal(t *testing.T) {
+	cells, err := gridCells(2, 3, "vertical", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := 0
+	for i, c := range cells {
+		if c == (image.Point{}) {
+			first = i
+		}
+	}
+	paths := []string{"a", "b", "c", "d", "e", "f", "extra"}
+	got, err := applyOriginIndex(paths, cells, first)
+	if err != nil || strings.Join(got, "") != "abcdefextra" {
+		t.Errorf("origin %d: got %v (%v), want the list unchanged", first, got, err)
+	}
+	got, err = applyOriginIndex(paths, cells, len(cells)-1-first)
+	if err != nil || strings.Join(got, "") != "fedcbaextra" {
+		t.Errorf("origin %d: got %v (%v), want the grid's tiles reversed", len(cells)-1-first, got, err)
+	}
+	for origin := range cells {
+		if origin == first || origin == len(cells)-1-first {
+			continue
+		}
+		if _, err := applyOriginIndex(paths, cells, origin); err == nil {
+			t.Errorf("origin %d: got no error, want it rejected", origin)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package stitch
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"log/slog"
+	"path/filepath"
+)
+
+// tileLayout is where one tile landed on the mosaic canvas
+type tileLayout struct {
+	index int // in the sorted tile list
+	name  string
+	rect  image.Rectangle
+}
+
+// seamLines returns a line through the middle of each overlap between two placed
+// tiles, along the overlap's longer side. Overlaps spanning less than half the
+// tiles along that side, such as diagonal neighbours' corners, are not seams.
+func seamLines(tiles []tileLayout) [][2]image.Point {
+	var lines [][2]image.Point
+	for i := range tiles {
+		for j := i + 1; j < len(tiles); j++ {
+			a, b := tiles[i].rect, tiles[j].rect
+			r := a.Intersect(b)
+			if r.Empty() {
+				continue
+			}
+			vertical := r.Dx() < r.Dy()
+			if vertical && 2*r.Dy() < min(a.Dy(), b.Dy()) || !vertical && 2*r.Dx() < min(a.Dx(), b.Dx()) {
+				continue
+			}
+			if vertical {
+				x := (r.Min.X + r.Max.X) / 2
+				lines = append(lines, [2]image.Point{{x, r.Min.Y}, {x, r.Max.Y}})
+			} else {
+				y := (r.Min.Y + r.Max.Y) / 2
+				lines = append(lines, [2]image.Point{{r.Min.X, y}, {r.Max.X, y}})
+			}
+		}
+	}
+	return lines
+}
+
+// positionedLayout returns where tiles placed at pts land on the canvas that
+// composeAt builds for them, which starts at their top-left extent
+func positionedLayout(imgs []image.Image, paths []string, pts []image.Point) []tileLayout {
+	layout := make([]tileLayout, len(imgs))
+	var bbox image.Rectangle
+	for i, img := range imgs {
+		layout[i] = tileLayout{i, paths[i], image.Rectangle{Min: pts[i], Max: pts[i].Add(img.Bounds().Size())}}
+		if i == 0 {
+			bbox = layout[i].rect
+		}
+		bbox = bbox.Union(layout[i].rect)
+	}
+	for i := range layout {
+		layout[i].rect = layout[i].rect.Sub(bbox.Min)
+	}
+	return layout
+}
+
+// saveSVGOverlay writes the overlay of layout for the mosaic saved at mosaicPath,
+// referencing it relative to the overlay's directory. canvas is the saved part of
+// the stitched canvas, before the output was rescaled by scale.
+func saveSVGOverlay(path, mosaicPath string, canvas image.Rectangle, scale float64, layout []tileLayout) error {
+	var href string
+	if mosaicPath == "-" {
+		slog.Warn("the mosaic went to stdout; the SVG overlay has no image to reference", "path", path)
+	} else if dir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		if abs, err := filepath.Abs(mosaicPath); err == nil {
+			href, _ = filepath.Rel(dir, abs)
+		}
+	}
+	if href == "" && mosaicPath != "-" {
+		href = mosaicPath
+	}
+	out := image.Pt(int(float64(canvas.Dx())*scale+0.5), int(float64(canvas.Dy())*scale+0.5))
+	if err := writeSVGOverlay(path, filepath.ToSlash(href), canvas, out, layout); err != nil {
+		return err
+	}
+	slog.Info("SVG overlay saved", "path", path, "tiles", len(layout))
+	return nil
+}
+
+// writeSVGOverlay writes the tile rectangles, their indices and the seams between
+// them to path as SVG, drawn over the mosaic image at href (omitted when empty).
+// canvas is the mosaic's extent in the tiles' coordinates and out its size in
+// output pixels, so the overlay lines up with a rescaled mosaic.
+func writeSVGOverlay(path, href string, canvas image.Rectangle, out image.Point, tiles []tileLayout) error {
+	return writeOutput(path, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%d\" height=\"%d\" viewBox=\"%d %d %d %d\">\n",
+			out.X, out.Y, canvas.Min.X, canvas.Min.Y, canvas.Dx(), canvas.Dy())
+		if href != "" {
+			fmt.Fprintf(w, "  <image xlink:href=\"%s\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" preserveAspectRatio=\"none\"/>\n",
+				html.EscapeString(href), canvas.Min.X, canvas.Min.Y, canvas.Dx(), canvas.Dy())
+		}
+		// strokes keep their width in output pixels however far the viewer zooms
+		fmt.Fprintln(w, `  <g fill="none" stroke="yellow" stroke-width="1" vector-effect="non-scaling-stroke">`)
+		for _, t := range tiles {
+			fmt.Fprintf(w, "    <rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\"><title>%d %s</title></rect>\n",
+				t.rect.Min.X, t.rect.Min.Y, t.rect.Dx(), t.rect.Dy(), t.index, html.EscapeString(filepath.Base(t.name)))
+		}
+		fmt.Fprintln(w, `  </g>`)
+		fmt.Fprintln(w, `  <g stroke="cyan" stroke-width="1" stroke-dasharray="4 3" vector-effect="non-scaling-stroke">`)
+		for _, l := range seamLines(tiles) {
+			fmt.Fprintf(w, "    <line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\"/>\n", l[0].X, l[0].Y, l[1].X, l[1].Y)
+		}
+		fmt.Fprintln(w, `  </g>`)
+		fmt.Fprintln(w, `  <g fill="yellow" font-family="sans-serif" text-anchor="middle" dominant-baseline="central">`)
+		for _, t := range tiles {
+			size := max(1, min(t.rect.Dx(), t.rect.Dy())/6)
+			c := t.rect.Min.Add(t.rect.Size().Div(2))
+			fmt.Fprintf(w, "    <text x=\"%d\" y=\"%d\" font-size=\"%d\">%d</text>\n", c.X, c.Y, size, t.index)
+		}
+		fmt.Fprintln(w, `  </g>`)
+		fmt.Fprintln(w, "</svg>")
+		return w.Flush()
+	})
+}
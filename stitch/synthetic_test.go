@@ -0,0 +1,290 @@
+package stitch
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/tiff"
+)
+
+func TestMain(m *testing.M) {
+	// every stitch logs each tile it loads
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// the synthetic grid cut by the end-to-end tests
+const synthRows, synthCols, synthW, synthH, synthOX, synthOY = 3, 4, 48, 40, 11, 7
+
+// syntheticScene returns a w x h image with a gradient and high-frequency texture,
+// so that a tile placed even one pixel off changes the result
+func syntheticScene(w, h int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := x*97 + y*61 + (x*y%13)*1500
+			img.SetGray16(x, y, color.Gray16{uint16(v % 60000)})
+		}
+	}
+	return img
+}
+
+// synthScene returns the scene the synthetic grid reconstructs
+func synthScene() *image.Gray16 {
+	return syntheticScene(synthCols*synthW-(synthCols-1)*synthOX, synthRows*synthH-(synthRows-1)*synthOY)
+}
+
+// writeSyntheticTiles cuts scene into the synthetic grid and writes the tiles as
+// TIFFs in dir, in acquisition order for the given snake
+func writeSyntheticTiles(t *testing.T, dir string, scene *image.Gray16, snake string, reverse bool) {
+	t.Helper()
+	cells, err := gridCells(synthRows, synthCols, snake, reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSyntheticCells(t, dir, scene, cells)
+}
+
+// writeSyntheticCells cuts scene into the synthetic grid and writes the tile of
+// each cell in turn as a TIFF in dir
+func writeSyntheticCells(t *testing.T, dir string, scene *image.Gray16, cells []image.Point) {
+	t.Helper()
+	for i, c := range cells {
+		x0, y0 := c.X*(synthW-synthOX), c.Y*(synthH-synthOY)
+		tile := scene.SubImage(image.Rect(x0, y0, x0+synthW, y0+synthH))
+		if err := encodeFile(filepath.Join(dir, fmt.Sprintf("tile-%03d.tif", i)), encoders["tiff"], tile, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// synthArgs returns the command line stitching the synthetic grid in dir to out
+func synthArgs(dir, out string, extra ...string) []string {
+	args := []string{
+		"--dir", dir, "--rows", fmt.Sprint(synthRows), "--cols", fmt.Sprint(synthCols),
+		"--overlapX", fmt.Sprint(synthOX), "--overlapY", fmt.Sprint(synthOY), "--out", out, "--quiet",
+	}
+	return append(args, extra...)
+}
+
+// readTIFFFile decodes the TIFF at path
+func readTIFFFile(t *testing.T, path string) image.Image {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := tiff.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// maxDiff returns the largest absolute pixel difference between two images of the
+// same size
+func maxDiff(t *testing.T, a, b image.Image) int {
+	t.Helper()
+	if a.Bounds().Size() != b.Bounds().Size() {
+		t.Fatalf("size %v, want %v", a.Bounds().Size(), b.Bounds().Size())
+	}
+	ga, gb := toGray16(a), toGray16(b)
+	worst := 0
+	for y := 0; y < ga.Rect.Dy(); y++ {
+		for x := 0; x < ga.Rect.Dx(); x++ {
+			d := int(ga.Gray16At(x, y).Y) - int(gb.Gray16At(x, y).Y)
+			worst = max(worst, d, -d)
+		}
+	}
+	return worst
+}
+
+// TestStitchSynthetic stitches the synthetic grid through the command line in
+// every snake order and checks that the scene is reconstructed
+func TestStitchSynthetic(t *testing.T) {
+	scene := synthScene()
+	for _, snake := range []string{"vertical", "horizontal"} {
+		for _, reverse := range []bool{false, true} {
+			for _, blend := range []string{"average", "feather"} {
+				t.Run(fmt.Sprintf("%s/reverse=%v/%s", snake, reverse, blend), func(t *testing.T) {
+					dir := t.TempDir()
+					writeSyntheticTiles(t, dir, scene, snake, reverse)
+					out := filepath.Join(t.TempDir(), "mosaic.tif")
+					args := synthArgs(dir, out, "--snake", snake, "--blend", blend)
+					if reverse {
+						args = append(args, "--col-start", "top", "--row-start", "right")
+					}
+					if err := run(args, false); err != nil {
+						t.Fatal(err)
+					}
+					if d := maxDiff(t, readTIFFFile(t, out), scene); d > 1 {
+						t.Errorf("mosaic differs from the scene by up to %d", d)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestFeatherWeightMap checks through --weightmap that feathering weighs every
+// pixel inside the mosaic 1 in total, four-tile corners included
+func TestFeatherWeightMap(t *testing.T) {
+	dir, tmp := t.TempDir(), t.TempDir()
+	writeSyntheticTiles(t, dir, synthScene(), "vertical", false)
+	wm := filepath.Join(tmp, "weights.tif")
+	if err := run(synthArgs(dir, filepath.Join(tmp, "mosaic.tif"), "--blend", "feather", "--weightmap", wm), false); err != nil {
+		t.Fatal(err)
+	}
+	g := toGray16(readTIFFFile(t, wm))
+	for y := synthOY; y < g.Rect.Dy()-synthOY; y++ {
+		for x := synthOX; x < g.Rect.Dx()-synthOX; x++ {
+			if d := int(g.Gray16At(x, y).Y) - weightMapScale; d < -1 || d > 1 {
+				t.Fatalf("total weight at (%d, %d) deviates from 1 by %d/%d", x, y, d, weightMapScale)
+			}
+		}
+	}
+}
+
+// TestDownsampleOddSizes rewrites two synthetic tiles one pixel narrower and one
+// wider than the others and checks that halving them gives every tile one size
+func TestDownsampleOddSizes(t *testing.T) {
+	dir := t.TempDir()
+	scene := synthScene()
+	writeSyntheticTiles(t, dir, scene, "vertical", false)
+	cells, err := gridCells(synthRows, synthCols, "vertical", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dw := range map[int]int{0: -1, len(cells) - 1: 1} {
+		x0, y0 := cells[i].X*(synthW-synthOX), cells[i].Y*(synthH-synthOY)
+		if i == len(cells)-1 {
+			// the last tile grows to the left, staying within the scene
+			x0--
+		}
+		path := filepath.Join(dir, fmt.Sprintf("tile-%03d.tif", i))
+		if err := encodeFile(path, encoders["tiff"], scene.SubImage(image.Rect(x0, y0, x0+synthW+dw, y0+synthH)), EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := getImagePaths(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgs, err := loadTiles(paths, loadOptions{downsample: 2, filter: resize.Bilinear})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := roundedSize(image.Pt(synthW, synthH), 2)
+	for i, img := range imgs {
+		if sz := img.Bounds().Size(); sz != want {
+			t.Errorf("tile %d downsampled to %v, want %v", i, sz, want)
+		}
+	}
+}
+
+// TestSumTaperDownsampled checks that --sum-taper is scaled to the nearest pixel
+// by --downsample, like the overlaps: 5 at a factor of 3 ramps over 2 pixels,
+// as 6 does, and 2 still tapers over 1 pixel rather than turning the taper off
+func TestSumTaperDownsampled(t *testing.T) {
+	dir, tmp := t.TempDir(), t.TempDir()
+	writeSyntheticTiles(t, dir, synthScene(), "vertical", false)
+	stitch := func(taper string) image.Image {
+		out := filepath.Join(tmp, "mosaic-"+taper+".tif")
+		args := synthArgs(dir, out, "--downsample", "3")
+		if taper != "" {
+			args = append(args, "--sum-taper", taper)
+		}
+		if err := run(args, false); err != nil {
+			t.Fatal(err)
+		}
+		return readTIFFFile(t, out)
+	}
+	if d := maxDiff(t, stitch("5"), stitch("6")); d != 0 {
+		t.Errorf("--sum-taper 5 differs from 6 by up to %d, want both to ramp over 2 pixels", d)
+	}
+	if d := maxDiff(t, stitch("2"), stitch("")); d == 0 {
+		t.Error("--sum-taper 2 gives the untapered sum, want a 1-pixel ramp")
+	}
+}
+
+// TestSummaryIgnoresLogLevel checks that the summary is printed to stderr as one
+// plain line even when the logs are JSON and limited to errors, and that --quiet
+// leaves it out
+func TestSummaryIgnoresLogLevel(t *testing.T) {
+	dir, tmp := t.TempDir(), t.TempDir()
+	writeSyntheticTiles(t, dir, synthScene(), "vertical", false)
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	for _, quiet := range []bool{false, true} {
+		f, err := os.Create(filepath.Join(tmp, fmt.Sprintf("stderr-%v.txt", quiet)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stderr = f
+		out := filepath.Join(tmp, "mosaic.tif")
+		// synthArgs passes --quiet, so the args are built here
+		args := []string{"--dir", dir, "--rows", fmt.Sprint(synthRows), "--cols", fmt.Sprint(synthCols),
+			"--overlapX", fmt.Sprint(synthOX), "--overlapY", fmt.Sprint(synthOY), "--out", out,
+			"--log-level", "error", "--log-json", fmt.Sprintf("--quiet=%v", quiet)}
+		err = run(args, false)
+		os.Stderr = stderr
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(data)
+		if quiet {
+			if got != "" {
+				t.Errorf("with --quiet: stderr is %q, want nothing", got)
+			}
+			continue
+		}
+		w, h := synthScene().Rect.Dx(), synthScene().Rect.Dy()
+		want := fmt.Sprintf("summary: %s %dx%d 16-bit grayscale, ", out, w, h)
+		if !strings.HasPrefix(got, want) || strings.Count(got, "\n") != 1 {
+			t.Errorf("stderr is %q, want one line starting %q", got, want)
+		}
+	}
+	// the JSON handler writes to the stderr of its run, so later tests log nowhere
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// TestDetectOrderRaster writes the synthetic grid in a raster order and checks
+// that --detect-order finds it and prints it as an index map, since no flags
+// select it
+func TestDetectOrderRaster(t *testing.T) {
+	dir := t.TempDir()
+	want := rasterOrder(synthRows, synthCols, false, false, false)
+	writeSyntheticCells(t, dir, synthScene(), want.cells)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := detectOrder(paths, synthRows, synthCols, [2]uint16{}, image.Pt(synthW-synthOX, synthH-synthOY), 0.5, synthOX, synthOY, loadOptions{}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	head := "Recommended: raster, row by row from the top left (not expressible with current flags"
+	if !strings.HasPrefix(out.String(), head) {
+		t.Fatalf("got %q, want it to start with %q", out.String(), head)
+	}
+	if !strings.HasSuffix(out.String(), indexMapText(want.cells)) {
+		t.Errorf("got %q, want it to end with the index map\n%s", out.String(), indexMapText(want.cells))
+	}
+}
@@ -0,0 +1,181 @@
+package stitch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// TIFF field numbers used by the metadata readers
+const (
+	tagDescription  = 270
+	tagDateTime     = 306
+	tagExifIFD      = 34665
+	tagDateTimeOrig = 36867 // in the EXIF IFD
+)
+
+// ifdEntry is one field of a TIFF image file directory; values of up to four
+// bytes are held in raw, longer ones are at the offset raw holds
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	raw   [4]byte
+}
+
+// tiffIFD is the first image file directory of a classic (not Big) TIFF
+type tiffIFD struct {
+	r      *io.SectionReader
+	bo     binary.ByteOrder
+	fields map[uint16]ifdEntry
+}
+
+// ifdTypeSize is the size in bytes of one value of each numeric TIFF field type
+var ifdTypeSize = map[uint16]int{1: 1, 3: 2, 4: 4, 5: 8, 6: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// readIFD reads the header and first image file directory of the TIFF in r
+func readIFD(r *io.SectionReader) (*tiffIFD, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	bo, err := tiffByteOrder(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	return readIFDAt(r, bo, int64(bo.Uint32(hdr[4:])))
+}
+
+// readIFDAt reads the image file directory at offset off of the TIFF in r
+func readIFDAt(r *io.SectionReader, bo binary.ByteOrder, off int64) (*tiffIFD, error) {
+	d := &tiffIFD{r: r, bo: bo, fields: make(map[uint16]ifdEntry)}
+	var cnt [2]byte
+	if _, err := r.ReadAt(cnt[:], off); err != nil {
+		return nil, err
+	}
+	entries := make([]byte, 12*int(d.bo.Uint16(cnt[:])))
+	if _, err := r.ReadAt(entries, off+2); err != nil {
+		return nil, err
+	}
+	for e := entries; len(e) >= 12; e = e[12:] {
+		var f ifdEntry
+		f.typ, f.count = d.bo.Uint16(e[2:]), d.bo.Uint32(e[4:])
+		copy(f.raw[:], e[8:12])
+		d.fields[d.bo.Uint16(e[0:])] = f
+	}
+	return d, nil
+}
+
+// values returns the field tag as bytes, one ifdTypeSize chunk per value. ok is
+// false when the field is missing or not numeric.
+func (d *tiffIFD) values(tag uint16) (b []byte, typ uint16, ok bool, err error) {
+	f, found := d.fields[tag]
+	size := ifdTypeSize[f.typ]
+	if !found || size == 0 || f.count == 0 {
+		return nil, 0, false, nil
+	}
+	n := int(f.count) * size
+	if n <= 4 {
+		return f.raw[:n], f.typ, true, nil
+	}
+	off := int64(d.bo.Uint32(f.raw[:]))
+	if err := d.span(off, int64(n)); err != nil {
+		return nil, 0, false, fmt.Errorf("TIFF field %d: %v", tag, err)
+	}
+	b = make([]byte, n)
+	if _, err := d.r.ReadAt(b, off); err != nil {
+		return nil, 0, false, err
+	}
+	return b, f.typ, true, nil
+}
+
+// span checks that the n bytes at offset off lie within the file, so that a
+// corrupt count cannot make a reader allocate more than the file holds
+func (d *tiffIFD) span(off, n int64) error {
+	if off < 0 || n < 0 || n > d.r.Size()-off {
+		return fmt.Errorf("%d bytes at offset %d lie outside the %d byte file", n, off, d.r.Size())
+	}
+	return nil
+}
+
+// floats returns every value of the numeric field tag converted to float64
+func (d *tiffIFD) floats(tag uint16) ([]float64, bool, error) {
+	b, typ, ok, err := d.values(tag)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	size := ifdTypeSize[typ]
+	vals := make([]float64, 0, len(b)/size)
+	bo := d.bo
+	for ; len(b) >= size; b = b[size:] {
+		var v float64
+		switch typ {
+		case 1:
+			v = float64(b[0])
+		case 3:
+			v = float64(bo.Uint16(b))
+		case 4, 13: // LONG, IFD offset
+			v = float64(bo.Uint32(b))
+		case 5:
+			v = float64(bo.Uint32(b)) / float64(bo.Uint32(b[4:]))
+		case 6:
+			v = float64(int8(b[0]))
+		case 8:
+			v = float64(int16(bo.Uint16(b)))
+		case 9:
+			v = float64(int32(bo.Uint32(b)))
+		case 10:
+			v = float64(int32(bo.Uint32(b))) / float64(int32(bo.Uint32(b[4:])))
+		case 11:
+			v = float64(math.Float32frombits(bo.Uint32(b)))
+		case 12:
+			v = math.Float64frombits(bo.Uint64(b))
+		}
+		vals = append(vals, v)
+	}
+	return vals, true, nil
+}
+
+// number returns the first value of an integer field, or def when it is missing
+func (d *tiffIFD) number(tag uint16, def int) (int, error) {
+	v, ok, err := d.floats(tag)
+	if err != nil || !ok {
+		return def, err
+	}
+	return int(v[0]), nil
+}
+
+// text returns the ASCII field tag without its terminating NUL
+func (d *tiffIFD) text(tag uint16) (string, bool, error) {
+	f, found := d.fields[tag]
+	if !found || f.typ != 2 || f.count == 0 {
+		return "", false, nil
+	}
+	b := f.raw[:min(f.count, 4)]
+	if f.count > 4 {
+		off := int64(d.bo.Uint32(f.raw[:]))
+		if err := d.span(off, int64(f.count)); err != nil {
+			return "", false, fmt.Errorf("TIFF field %d: %v", tag, err)
+		}
+		b = make([]byte, f.count)
+		if _, err := d.r.ReadAt(b, off); err != nil {
+			return "", false, err
+		}
+	}
+	return strings.TrimRight(string(b), "\x00"), true, nil
+}
+
+// sub reads the directory that the pointer field tag, such as the EXIF IFD,
+// points to. ok is false when the field is missing.
+func (d *tiffIFD) sub(tag uint16) (*tiffIFD, bool, error) {
+	off, err := d.number(tag, 0)
+	if err != nil || off == 0 {
+		return nil, false, err
+	}
+	sd, err := readIFDAt(d.r, d.bo, int64(off))
+	if err != nil {
+		return nil, false, err
+	}
+	return sd, true, nil
+}
@@ -0,0 +1,31 @@
+package stitch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// TestIFDFieldOutsideFile checks that a field whose count reaches past the end of
+// the file is rejected before anything that size is allocated
+func TestIFDFieldOutsideFile(t *testing.T) {
+	le := binary.LittleEndian
+	data := []byte("II*\x00")
+	data = le.AppendUint32(data, 8)
+	data = le.AppendUint16(data, 1)
+	data = le.AppendUint16(data, tagDescription)
+	data = le.AppendUint16(data, 2) // ASCII
+	data = le.AppendUint32(data, 0xfffffff0)
+	data = le.AppendUint32(data, 26)
+	data = le.AppendUint32(data, 0) // no further IFDs
+	data = append(data, "ImageJ=1.54\x00"...)
+
+	d, err := readIFD(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.text(tagDescription); err == nil {
+		t.Error("got no error, want the field rejected")
+	}
+}
@@ -0,0 +1,162 @@
+package stitch
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/tiff"
+)
+
+// tiffConfig reads only the header of a TIFF on disk or, through client, at a URL
+func tiffConfig(path string, client *http.Client) (image.Config, error) {
+	if isURL(path) {
+		resp, err := client.Get(path)
+		if err != nil {
+			return image.Config{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return image.Config{}, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+		}
+		return tiff.DecodeConfig(resp.Body)
+	}
+	sr, f, err := openTIFF(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	return tiff.DecodeConfig(sr)
+}
+
+// validateMode is the value of --validate-only: empty when it is off, "header"
+// to read only each tile's header, or "deep" to decode every tile in full. Given
+// bare, like a boolean flag, it selects the header check.
+type validateMode string
+
+func (m *validateMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *validateMode) Set(s string) error {
+	switch s {
+	case "true", "header":
+		*m = "header"
+	case "false":
+		*m = ""
+	case "deep":
+		*m = "deep"
+	default:
+		return fmt.Errorf("invalid validate mode %q (use header or deep)", s)
+	}
+	return nil
+}
+
+func (m *validateMode) IsBoolFlag() bool { return true }
+
+// validateTiles reads the header of every path, or with deep decodes each in full,
+// one tile at a time and through the same decoder and timeout as a stitch, so
+// truncated or corrupt image data is caught as well as bad headers. With uniform
+// it also checks that all tiles share the size of the first readable one. Every
+// problem is logged before an error summarising them is returned.
+func validateTiles(paths []string, uniform, deep bool, timeout time.Duration, client *http.Client) error {
+	var size image.Point
+	bad := 0
+	for _, p := range paths {
+		var s image.Point
+		if deep {
+			img, err := loadTIFFTimeout(p, timeout, client)
+			if err != nil {
+				// err names the tile
+				slog.Error("tile does not decode", "err", err)
+				bad++
+				continue
+			}
+			s = img.Bounds().Size()
+		} else {
+			cfg, err := tiffConfig(p, client)
+			if err != nil {
+				slog.Error("tile header does not read", "path", p, "err", err)
+				bad++
+				continue
+			}
+			s = image.Pt(cfg.Width, cfg.Height)
+		}
+		switch {
+		case size == image.Point{}:
+			size = s
+		case uniform && s != size:
+			slog.Error("tile size differs", "path", p, "size", s, "expected", size)
+			bad++
+			continue
+		}
+		slog.Debug("tile ok", "path", p, "size", s)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d tiles failed validation", bad, len(paths))
+	}
+	slog.Info("all tiles valid", "count", len(paths), "size", size)
+	return nil
+}
+
+// cellPatterns find a tile's grid indices in its file name, such as r2c0,
+// row02_col03 or x3_y2; the capture groups are the row and column indices, in
+// that order unless the pattern's swap is set
+var cellPatterns = []struct {
+	re   *regexp.Regexp
+	swap bool // the first group is the column
+}{
+	{regexp.MustCompile(`(?i)(?:^|[^a-z])r(?:ow)?[_-]?(\d+)[_-]?c(?:ol)?[_-]?(\d+)`), false},
+	{regexp.MustCompile(`(?i)(?:^|[^a-z])x[_-]?(\d+)[_-]?y[_-]?(\d+)`), true},
+}
+
+// namedGridSize returns the number of rows and columns spanned by the grid
+// indices encoded in the file names, when every name carries them in the same form
+func namedGridSize(paths []string) (rows, cols int, ok bool) {
+	for _, pat := range cellPatterns {
+		minR, maxR, minC, maxC := -1, -1, -1, -1
+		matched := true
+		for _, p := range paths {
+			m := pat.re.FindStringSubmatch(filepath.Base(p))
+			if m == nil {
+				matched = false
+				break
+			}
+			r, _ := strconv.Atoi(m[1])
+			c, _ := strconv.Atoi(m[2])
+			if pat.swap {
+				r, c = c, r
+			}
+			if minR < 0 {
+				minR, maxR, minC, maxC = r, r, c, c
+			}
+			minR, maxR = min(minR, r), max(maxR, r)
+			minC, maxC = min(minC, c), max(maxC, c)
+		}
+		if matched && len(paths) > 0 {
+			return maxR - minR + 1, maxC - minC + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// checkTransposed warns when the file names imply a rows x cols grid with rows and
+// columns the other way round, the usual sign of swapped --rows and --cols
+func checkTransposed(paths []string, rows, cols int) {
+	r, c, ok := namedGridSize(paths)
+	if !ok || rows == cols {
+		return
+	}
+	if r == cols && c == rows {
+		slog.Warn("file names suggest rows and columns are swapped", "rows", rows, "cols", cols,
+			"named_rows", r, "named_cols", c)
+	}
+}
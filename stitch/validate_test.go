@@ -0,0 +1,45 @@
+package stitch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestValidateTilesDecodesData checks that --validate-only=deep catches a tile
+// whose header reads but whose compressed image data is corrupt, which the default
+// header check lets through
+func TestValidateTilesDecodesData(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "tile-1_a.tif")
+	bad := filepath.Join(dir, "tile-2_a.tif")
+	for _, p := range []string{good, bad} {
+		if err := encodeFile(p, encoders["tiff"], syntheticScene(64, 48), EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Deflate stream starts after the 8-byte header; the directory follows it
+	for i := 16; i < 80; i++ {
+		data[i] = 0xff
+	}
+	if err := os.WriteFile(bad, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tiffConfig(bad, nil); err != nil {
+		t.Fatalf("header of the corrupted tile no longer reads: %v", err)
+	}
+
+	if err := validateTiles([]string{good}, true, true, 0, nil); err != nil {
+		t.Errorf("valid tile: %v", err)
+	}
+	if err := validateTiles([]string{good, bad}, true, false, 0, nil); err != nil {
+		t.Errorf("header check: %v", err)
+	}
+	if err := validateTiles([]string{good, bad}, true, true, 0, nil); err == nil {
+		t.Error("tile with corrupt image data passed deep validation")
+	}
+}
@@ -0,0 +1,73 @@
+package stitch
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dirSnapshot returns a fingerprint of the matching tiles in dir (names, sizes and
+// modification times) and how many there are
+func dirSnapshot(dir string, regex *regexp.Regexp) (string, int, error) {
+	paths, err := getImagePaths(dir, regex)
+	if err != nil {
+		return "", 0, err
+	}
+	var b strings.Builder
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			// removed between listing and stat; the next poll sees the change
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), len(paths), nil
+}
+
+// watchArgs rebuilds the command line of fs without the watch flags, for the
+// stitches run from the watch loop
+func watchArgs(fs *flag.FlagSet) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "watch" || f.Name == "watch-interval" {
+			return
+		}
+		args = append(args, "--"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// watchDir polls dir every interval and restitches with args once at least n tiles
+// are present and the directory has not changed for a whole interval, so that
+// tiles still being written are not read. It runs until interrupted; a failed
+// stitch is logged and retried after the next change.
+func watchDir(dir string, regex *regexp.Regexp, n int, interval time.Duration, args []string) error {
+	slog.Info("watching for tiles", "dir", dir, "grid", n, "interval", interval)
+	var last, stitched string
+	for ; ; time.Sleep(interval) {
+		snap, count, err := dirSnapshot(dir, regex)
+		if err != nil {
+			return err
+		}
+		if snap != last {
+			slog.Debug("tiles changed", "dir", dir, "count", count)
+			last = snap
+			continue
+		}
+		if snap == stitched || count < n {
+			continue
+		}
+		stitched = snap
+		start := time.Now()
+		if err := run(args, false); err != nil {
+			slog.Error("watch stitch failed", "err", err)
+			continue
+		}
+		slog.Info("mosaic updated", "tiles", count, "elapsed", time.Since(start).Round(time.Millisecond))
+	}
+}